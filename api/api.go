@@ -15,45 +15,182 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
+	"bookstore/model"
+	"bookstore/notify"
+	"bookstore/oidc"
 	"bookstore/storage"
 
 	"github.com/gorilla/mux"
 )
 
 type handler struct {
-	store *storage.Storage
+	store  storage.Store
+	config *Config
+	audit  *auditRecorder
 }
 
-const tokenValidity = 15 * time.Minute
+// Config holds the optional settings of the API.
+type Config struct {
+	// Notifier delivers the password reset and email confirmation tokens, without notifier no tokens are sent
+	Notifier notify.Notifier
+	// OIDC enables the login through an OpenID Connect provider
+	OIDC *oidc.Provider
+	// OIDCAutoProvision creates users, who log in through OIDC for the first time
+	OIDCAutoProvision bool
+	// ClientCertificates authenticates requests without token by their verified TLS client certificate,
+	// whose common name is the user name
+	ClientCertificates bool
+	// RequestTimeout ends the context of every request, so its queries stop
+	// when the server gave up on the response, 0 for no timeout
+	RequestTimeout time.Duration
+}
+
+const (
+	tokenValidity                  = 15 * time.Minute
+	refreshTokenValidity           = 30 * 24 * time.Hour
+	passwordResetTokenValidity     = time.Hour
+	emailConfirmationTokenValidity = 24 * time.Hour
+	mfaChallengeValidity           = 5 * time.Minute
+	oidcLoginValidity              = 10 * time.Minute
+	impersonationTokenValidity     = 10 * time.Minute
+)
+
+// routeScopes declares the scope, which a token needs for each route.
+// An empty scope allows every token, routes missing here are refused by the middleware.
+var routeScopes = map[string]string{
+	// public routes, which need no token
+	"Authenticate":     "",
+	"AuthenticateTOTP": "",
+	"RefreshToken":     "",
+	"ForgotPassword":   "",
+	"ResetPassword":    "",
+	"ConfirmEmail":     "",
+	"Signup":           "",
+	"JWKS":             "",
+	"OIDCLogin":        "",
+	"OIDCLink":         "",
+	"OIDCCallback":     "",
+	"ListBooks":        "",
+	"GetBook":          "",
+
+	"Logout":          "",
+	"GetMe":           "",
+	"IntrospectToken": model.ScopeUsersAdmin,
+
+	"ListUsers":        model.ScopeUsersRead,
+	"GetUser":          model.ScopeUsersRead,
+	"ListRoles":        model.ScopeUsersRead,
+	"UpdateUser":       model.ScopeUsersWrite,
+	"EnrolTOTP":        model.ScopeUsersWrite,
+	"VerifyTOTP":       model.ScopeUsersWrite,
+	"DisableTOTP":      model.ScopeUsersWrite,
+	"ListUserTokens":   model.ScopeUsersWrite,
+	"CreateUserToken":  model.ScopeUsersWrite,
+	"DeleteUserToken":  model.ScopeUsersWrite,
+	"CreateUser":       model.ScopeUsersAdmin,
+	"DeleteUser":       model.ScopeUsersAdmin,
+	"UnlockUser":       model.ScopeUsersAdmin,
+	"ListPendingUsers": model.ScopeUsersAdmin,
+	"ApproveUser":      model.ScopeUsersAdmin,
+	"RejectUser":       model.ScopeUsersAdmin,
+	"ImpersonateUser":  model.ScopeUsersAdmin,
+	"GetSettings":      model.ScopeUsersAdmin,
+	"UpdateSettings":   model.ScopeUsersAdmin,
+	"ListAuditEvents":  model.ScopeUsersAdmin,
+
+	"ListUserBooks":  model.ScopeBooksRead,
+	"CreateUserBook": model.ScopeBooksWrite,
+	"UpdateUserBook": model.ScopeBooksWrite,
+	"DeleteUserBook": model.ScopeBooksWrite,
+}
 
 // Serve declares API routes for the application.
-func Serve(router *mux.Router, store *storage.Storage) {
-	handler := &handler{store}
+func Serve(router *mux.Router, store storage.Store, config *Config) {
+	if config == nil {
+		config = &Config{}
+	}
+	audit := &auditRecorder{store}
+	handler := &handler{store, config, audit}
 
-	middleware := newMiddleware(store)
+	middleware := newMiddleware(store, config, audit)
 
+	if config.RequestTimeout > 0 {
+		router.Use(middleware.handleDeadline)
+	}
 	router.Use(middleware.handleMediaTypes)
+	router.NotFoundHandler = problemHandler(http.StatusNotFound)
+	router.MethodNotAllowedHandler = problemHandler(http.StatusMethodNotAllowed)
 
 	usersRoute := router.PathPrefix("/users").Subrouter()
 	booksRoute := router.PathPrefix("/books").Subrouter()
+	rolesRoute := router.PathPrefix("/roles").Subrouter()
+	settingsRoute := router.PathPrefix("/settings").Subrouter()
+	adminRoute := router.PathPrefix("/admin").Subrouter()
 
 	usersRoute.Use(middleware.handleToken)
+	rolesRoute.Use(middleware.handleToken)
+	settingsRoute.Use(middleware.handleToken)
+	adminRoute.Use(middleware.handleToken)
 
 	router.HandleFunc("/authenticate", handler.authenticate).Methods(http.MethodPost).Name("Authenticate")
+	router.HandleFunc("/authenticate/totp", handler.authenticateTOTP).Methods(http.MethodPost).Name("AuthenticateTOTP")
+	router.HandleFunc("/token/refresh", handler.refreshToken).Methods(http.MethodPost).Name("RefreshToken")
+	router.HandleFunc("/password/forgot", handler.forgotPassword).Methods(http.MethodPost).Name("ForgotPassword")
+	router.HandleFunc("/password/reset", handler.resetPassword).Methods(http.MethodPost).Name("ResetPassword")
+	router.HandleFunc("/email/confirm", handler.confirmEmail).Methods(http.MethodPost).Name("ConfirmEmail")
+	router.HandleFunc("/signup", handler.signup).Methods(http.MethodPost).Name("Signup")
+	router.HandleFunc("/.well-known/jwks.json", handler.jwks).Methods(http.MethodGet).Name("JWKS")
+	if config.OIDC != nil {
+		router.HandleFunc("/oidc/login", handler.oidcLogin).Methods(http.MethodGet).Name("OIDCLogin")
+		router.HandleFunc("/oidc/link", handler.oidcLink).Methods(http.MethodPost).Name("OIDCLink")
+		router.HandleFunc("/oidc/callback", handler.oidcCallback).Methods(http.MethodGet).Name("OIDCCallback")
+	}
+	router.Handle("/logout", middleware.handleToken(http.HandlerFunc(handler.logout))).Methods(http.MethodPost).Name("Logout")
+	router.Handle("/me", middleware.handleToken(http.HandlerFunc(handler.getMe))).Methods(http.MethodGet).Name("GetMe")
+	router.Handle("/token/introspect", middleware.handleToken(http.HandlerFunc(handler.introspectToken))).Methods(http.MethodPost).Name("IntrospectToken")
 	usersRoute.HandleFunc("", handler.listUsers).Methods(http.MethodGet).Name("ListUsers")
 	usersRoute.HandleFunc("", handler.createUser).Methods(http.MethodPost).Name("CreateUser")
+	usersRoute.HandleFunc("/pending", handler.listPendingUsers).Methods(http.MethodGet).Name("ListPendingUsers")
 	usersRoute.HandleFunc("/{userID:[0-9]+}", handler.updateUser).Methods(http.MethodPut).Name("UpdateUser")
 	usersRoute.HandleFunc("/{userID:[0-9]+}", handler.deleteUser).Methods(http.MethodDelete).Name("DeleteUser")
 	usersRoute.HandleFunc("/{userID:[0-9]+}", handler.getUser).Methods(http.MethodGet).Name("GetUser")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/unlock", handler.unlockUser).Methods(http.MethodPost).Name("UnlockUser")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/approve", handler.approveUser).Methods(http.MethodPost).Name("ApproveUser")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/reject", handler.rejectUser).Methods(http.MethodPost).Name("RejectUser")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/impersonate", handler.impersonateUser).Methods(http.MethodPost).Name("ImpersonateUser")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/totp", handler.enrolTOTP).Methods(http.MethodPost).Name("EnrolTOTP")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/totp/verify", handler.verifyTOTP).Methods(http.MethodPost).Name("VerifyTOTP")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/totp", handler.disableTOTP).Methods(http.MethodDelete).Name("DisableTOTP")
 
 	usersRoute.HandleFunc("/{userID:[0-9]+}/books", handler.listUserBooks).Methods(http.MethodGet).Name("ListUserBooks")
 	usersRoute.HandleFunc("/{userID:[0-9]+}/books", handler.createUserBook).Methods(http.MethodPost).Name("CreateUserBook")
 	usersRoute.HandleFunc("/{userID:[0-9]+}/books/{bookID:[0-9]+}", handler.updateUserBook).Methods(http.MethodPut).Name("UpdateUserBook")
 	usersRoute.HandleFunc("/{userID:[0-9]+}/books/{bookID:[0-9]+}", handler.deleteUserBook).Methods(http.MethodDelete).Name("DeleteUserBook")
 
+	usersRoute.HandleFunc("/{userID:[0-9]+}/tokens", handler.listUserTokens).Methods(http.MethodGet).Name("ListUserTokens")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/tokens", handler.createUserToken).Methods(http.MethodPost).Name("CreateUserToken")
+	usersRoute.HandleFunc("/{userID:[0-9]+}/tokens/{tokenID:[0-9]+}", handler.deleteUserToken).Methods(http.MethodDelete).Name("DeleteUserToken")
+
+	rolesRoute.HandleFunc("", handler.listRoles).Methods(http.MethodGet).Name("ListRoles")
+
+	settingsRoute.HandleFunc("", handler.getSettings).Methods(http.MethodGet).Name("GetSettings")
+	settingsRoute.HandleFunc("", handler.updateSettings).Methods(http.MethodPut).Name("UpdateSettings")
+
+	adminRoute.HandleFunc("/audit", handler.listAuditEvents).Methods(http.MethodGet).Name("ListAuditEvents")
+
 	booksRoute.HandleFunc("", handler.listBooks).Methods(http.MethodGet).Name("ListBooks")
 	booksRoute.HandleFunc("/{bookID:[0-9]+}", handler.getBook).Methods(http.MethodGet).Name("GetBook")
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if name := route.GetName(); name != "" {
+			if _, declared := routeScopes[name]; !declared {
+				panic(fmt.Sprintf("api: route %s declares no scope", name))
+			}
+		}
+		return nil
+	})
 }
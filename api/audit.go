@@ -0,0 +1,207 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bookstore/model"
+	"bookstore/policy"
+	"bookstore/storage"
+	"bookstore/validator"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditRecorder appends security relevant events to the audit log.
+type auditRecorder struct {
+	store storage.Store
+}
+
+// record completes the event with the details of the request and stores it.
+// The action defaults to the name of the route, the target to the path and the actor
+// to the user of the request. A failed write is logged, but does not fail the request.
+func (a *auditRecorder) record(r *http.Request, event model.AuditEvent) {
+	event.CreatedAt = time.Now()
+	event.IP = clientIP(r)
+	if event.Action == "" {
+		if route := mux.CurrentRoute(r); route != nil {
+			event.Action = route.GetName()
+		}
+	}
+	if event.Target == "" {
+		event.Target = r.URL.Path
+	}
+	if event.Actor == "" {
+		if user, err := requestUser(r); err == nil {
+			event.ActorID = &user.ID
+			event.Actor = user.Username
+		}
+	}
+	if actor := requestActor(r); actor != nil && event.Impersonator == "" {
+		event.Impersonator = actor.Username
+	}
+	if event.Outcome == "" {
+		event.Outcome = auditOutcome(event.Status)
+	}
+
+	log.WithFields(log.Fields{
+		"audit":        event.Action,
+		"actor":        event.Actor,
+		"impersonator": event.Impersonator,
+		"target":       event.Target,
+		"ip":           event.IP,
+		"outcome":      event.Outcome,
+		"status":       event.Status,
+	}).Info("[Audit] ", event.Detail)
+
+	// not bound to the request, the events of cancelled requests are kept as well
+	if err := a.store.CreateAuditEvent(&event); err != nil {
+		log.Errorf("[Audit] Could not write the audit event: %v", err)
+	}
+}
+
+// recordUser records an event of the user, who is not in the request context yet, e.g. at the login.
+func (a *auditRecorder) recordUser(r *http.Request, user *model.User, status int, detail string) {
+	a.record(r, model.AuditEvent{ActorID: &user.ID, Actor: user.Username, Status: status, Detail: detail})
+}
+
+// auditOutcome derives the outcome from the status of the response.
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests:
+		return model.AuditOutcomeDenied
+	case status >= http.StatusBadRequest:
+		return model.AuditOutcomeFailure
+	}
+	return model.AuditOutcomeSuccess
+}
+
+// auditDetail describes the change made by a handler in the audit event of the request.
+func auditDetail(r *http.Request, format string, args ...interface{}) {
+	if event, ok := r.Context().Value(AuditEventKey).(*model.AuditEvent); ok {
+		event.Detail = fmt.Sprintf(format, args...)
+	}
+}
+
+// withAuditEvent adds an event to the context, which handlers describe through auditDetail.
+func withAuditEvent(r *http.Request) (*http.Request, *model.AuditEvent) {
+	event := &model.AuditEvent{}
+	return r.WithContext(context.WithValue(r.Context(), AuditEventKey, event)), event
+}
+
+// auditedRequest reports whether a request of an authenticated user goes to the audit log:
+// all changes, all refused requests and everything done while impersonating another user.
+func auditedRequest(r *http.Request, status int, impersonated bool) bool {
+	return impersonated || r.Method != http.MethodGet ||
+		status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// statusRecorder remembers the status code, which the handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (h *handler) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[ListAuditEvents] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if !policy.CanReadAuditLog(ru) {
+		log.Errorf("[ListAuditEvents] User with id %d tried to read the audit log", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	actor, err := queryStringParam(r, "actor")
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error reading query parameter: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	action, err := queryStringParam(r, "action")
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error reading query parameter: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	target, err := queryStringParam(r, "target")
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error reading query parameter: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	outcome, err := queryStringParam(r, "outcome")
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error reading query parameter: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	search := model.AuditEventListingRequest{Actor: actor, Action: action, Target: target, Outcome: outcome}
+	search.Since, err = queryTimeParam(r, "since")
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error reading query parameter: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	search.Until, err = queryTimeParam(r, "until")
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error reading query parameter: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	search.Limit, err = queryInt64Param(r, "limit")
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error reading query parameter: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	err = validator.ValidateAuditEventListing(search)
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Validation Error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	events, err := store.AuditEvents(search)
+	if err != nil {
+		log.Errorf("[ListAuditEvents] Error in loading the audit events from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, events)
+}
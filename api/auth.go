@@ -15,20 +15,34 @@
 package api
 
 import (
+	"context"
 	"net/http"
-	"net/http/httputil"
+	"strconv"
 	"time"
 
 	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/storage"
+	"bookstore/validator"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/unrolled/render"
 )
 
 type tokenMsg struct {
-	Token string `json:"token" xml:"token"`
+	Token        string `json:"token" xml:"token"`
+	RefreshToken string `json:"refresh_token,omitempty" xml:"refresh_token,omitempty"`
+	Scope        string `json:"scope" xml:"scope"`
+}
+
+// mfaMsg is returned by /authenticate instead of the tokens, if the user has to enter a TOTP code.
+type mfaMsg struct {
+	MFARequired bool   `json:"mfa_required" xml:"mfa_required"`
+	MFAToken    string `json:"mfa_token" xml:"mfa_token"`
 }
 
 func (h *handler) authenticate(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	if r.Method != http.MethodPost {
 		log.Error("[authenticate] Method not Post")
 		renderResult(w, r, http.StatusBadRequest, strToObjectError("Authenticate should be Post"))
@@ -41,8 +55,6 @@ func (h *handler) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dump, _ := httputil.DumpRequest(r, false)
-	log.Infof("%s", dump)
 	username := r.Form.Get("username")
 	password := r.Form.Get("password")
 
@@ -52,20 +64,387 @@ func (h *handler) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.store.CheckPassword(username, password)
+	scope := model.FormatScope(model.ParseScope(r.Form.Get("scope")))
+	if err := validator.ValidateScope(scope, model.Scopes); err != nil {
+		log.Errorf("[authenticate] Invalid scope: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	attempt := h.beginLogin(w, r, username)
+	if attempt == nil {
+		return
+	}
+
+	err = store.CheckPassword(username, password)
 	if err != nil {
 		log.Error("[authenticate] Username or password not correct")
+		h.failLogin(r.Context(), attempt)
+		h.audit.record(r, model.AuditEvent{Actor: username, Status: http.StatusBadRequest, Detail: "credentials incorrect"})
 		renderResult(w, r, http.StatusBadRequest, strToObjectError("Credentials incorrect"))
 		return
 	}
 
-	token, err := auth.JWTToken(username, time.Now().Add(tokenValidity))
+	user, err := store.UserByUsername(username)
+	if err != nil {
+		log.Errorf("[authenticate] Could not load user: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		// the user was deleted after the password was checked, which is answered like an unknown user
+		log.Errorf("[authenticate] User %s was deleted during the login", username)
+		h.failLogin(r.Context(), attempt)
+		h.audit.record(r, model.AuditEvent{Actor: username, Status: http.StatusBadRequest, Detail: "credentials incorrect"})
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Credentials incorrect"))
+		return
+	}
+
+	if user.Status != model.UserStatusActive {
+		log.Errorf("[authenticate] User %s is not approved yet", user.Username)
+		h.audit.recordUser(r, user, http.StatusForbidden, "account pending approval")
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Account pending approval"))
+		return
+	}
+
+	if user.TOTPEnabled {
+		// the throttle is kept until the second factor is verified,
+		// otherwise the password would allow unlimited guesses of the code.
+		challenge, challengeHash := auth.OpaqueToken()
+		err := store.CreateMFAChallenge(user.ID, challengeHash, scope, time.Now().Add(mfaChallengeValidity))
+		if err != nil {
+			log.Errorf("[authenticate] Could not create MFA challenge: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		h.audit.recordUser(r, user, http.StatusOK, "password correct, TOTP code required")
+		renderResult(w, r, http.StatusOK, &mfaMsg{MFARequired: true, MFAToken: challenge})
+		return
+	}
+
+	h.completeLogin(w, r, user, scope)
+}
+
+// authenticateTOTP is the second step of the login of users with TOTP.
+// It exchanges the challenge of the first step and a TOTP or recovery code for the tokens.
+func (h *handler) authenticateTOTP(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		log.Error("[AuthenticateTOTP] Could not parse form")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Could not parse parameters"))
+		return
+	}
+
+	mfaToken := r.Form.Get("mfa_token")
+	code := r.Form.Get("code")
+
+	if mfaToken == "" || code == "" {
+		log.Error("[AuthenticateTOTP] Empty MFA token or code")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("MFA token or code empty"))
+		return
+	}
+
+	challenge, err := store.MFAChallengeByHash(auth.HashToken(mfaToken))
+	if err != nil {
+		log.Errorf("[AuthenticateTOTP] Error loading the MFA challenge from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if challenge == nil || time.Now().After(challenge.ExpiresAt) {
+		log.Error("[AuthenticateTOTP] Unknown or expired MFA challenge")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid MFA token"))
+		return
+	}
+
+	user, err := store.UserByID(challenge.UserID)
+	if err != nil {
+		log.Errorf("[AuthenticateTOTP] Could not load user %d: %v", challenge.UserID, err)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid MFA token"))
+		return
+	}
+
+	attempt := h.beginLogin(w, r, user.Username)
+	if attempt == nil {
+		return
+	}
+
+	valid, err := h.checkSecondFactor(r.Context(), user.ID, code)
+	if err != nil {
+		log.Errorf("[AuthenticateTOTP] Error checking the code: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !valid {
+		log.Errorf("[AuthenticateTOTP] Code of user %s not correct", user.Username)
+		h.failLogin(r.Context(), attempt)
+		h.audit.recordUser(r, user, http.StatusBadRequest, "code incorrect")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Code incorrect"))
+		return
+	}
+
+	deleted, err := store.DeleteMFAChallenge(challenge.ID)
+	if err != nil {
+		log.Errorf("[AuthenticateTOTP] Error deleting the MFA challenge: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !deleted {
+		log.Errorf("[AuthenticateTOTP] MFA challenge of user %s was already answered", user.Username)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid MFA token"))
+		return
+	}
+
+	h.completeLogin(w, r, user, challenge.Scope)
+}
+
+// checkSecondFactor accepts either a TOTP code, which was not used before, or an unused recovery code.
+func (h *handler) checkSecondFactor(ctx context.Context, userID int64, code string) (bool, error) {
+	store := h.store.WithContext(ctx)
+	totp, err := store.UserTOTP(userID)
+	if err != nil || totp == nil || !totp.Enabled {
+		return false, err
+	}
+
+	if step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now()); ok {
+		return store.UseTOTPStep(userID, step)
+	}
+
+	return store.UseRecoveryCode(userID, auth.HashRecoveryCode(code))
+}
+
+// loginAttempt holds the throttle policies, which apply to a login.
+type loginAttempt struct {
+	policies map[string]auth.ThrottlePolicy
+	now      time.Time
+}
+
+// beginLogin checks the throttles of the user name and the client address.
+// If the login is refused, the error is rendered and nil is returned.
+func (h *handler) beginLogin(w http.ResponseWriter, r *http.Request, username string) *loginAttempt {
+	store := h.store.WithContext(r.Context())
+	attempt := &loginAttempt{
+		policies: map[string]auth.ThrottlePolicy{
+			auth.UserThrottleSubject(username):  auth.UserThrottle,
+			auth.IPThrottleSubject(clientIP(r)): auth.IPThrottle,
+		},
+		now: time.Now(),
+	}
+
+	for subject := range attempt.policies {
+		throttle, err := store.LoginThrottle(subject)
+		if err != nil {
+			log.Errorf("[authenticate] Could not load login throttle: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return nil
+		}
+		if throttle != nil && throttle.Blocked(attempt.now) {
+			log.Errorf("[authenticate] Login for %s blocked until %s", subject, throttle.BlockedUntil.Format(time.RFC3339))
+			h.audit.record(r, model.AuditEvent{Actor: username, Status: http.StatusTooManyRequests, Detail: "login blocked for " + subject})
+			w.Header().Set("Retry-After", strconv.Itoa(int(throttle.BlockedUntil.Sub(attempt.now).Seconds())+1))
+			renderResult(w, r, http.StatusTooManyRequests, strToObjectError("Too many failed attempts"))
+			return nil
+		}
+	}
+
+	return attempt
+}
+
+// failLogin records the failed login for all subjects of the attempt. The throttles are loaded again
+// and updated in a transaction, as concurrent attempts may have failed since beginLogin.
+func (h *handler) failLogin(ctx context.Context, attempt *loginAttempt) {
+	for subject, policy := range attempt.policies {
+		err := h.store.WithContext(ctx).WithTx(func(tx storage.Store) error {
+			throttle, err := tx.LockLoginThrottle(subject)
+			if err != nil {
+				return err
+			}
+			throttle = policy.Fail(throttle, subject, attempt.now)
+			if throttle.Locked {
+				log.Errorf("[authenticate] Too many failed attempts, %s locked until %s", subject, throttle.BlockedUntil.Format(time.RFC3339))
+			}
+			return tx.SaveLoginThrottle(throttle)
+		})
+		if err != nil {
+			log.Errorf("[authenticate] Could not save login throttle: %v", err)
+		}
+	}
+}
+
+// completeLogin resets the throttle of the user and renders new tokens with the scope.
+func (h *handler) completeLogin(w http.ResponseWriter, r *http.Request, user *model.User, scope string) {
+	store := h.store.WithContext(r.Context())
+	if err := store.DeleteLoginThrottle(auth.UserThrottleSubject(user.Username)); err != nil {
+		log.Errorf("[authenticate] Could not reset login throttle: %v", err)
+	}
 
+	msg, err := h.issueTokens(r.Context(), user, auth.TokenFamily(), scope)
 	if err != nil {
 		log.Errorf("[authenticate] Could not create token: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Internal Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.audit.recordUser(r, user, http.StatusOK, "login with scope "+scope)
+	renderResult(w, r, http.StatusOK, msg)
+}
+
+func (h *handler) refreshToken(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		log.Error("[RefreshToken] Could not parse form")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Could not parse parameters"))
+		return
+	}
+
+	refreshToken := r.Form.Get("refresh_token")
+	if refreshToken == "" {
+		log.Error("[RefreshToken] Empty refresh token")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Refresh token empty"))
+		return
+	}
+
+	stored, err := store.RefreshTokenByHash(auth.HashToken(refreshToken))
+	if err != nil {
+		log.Errorf("[RefreshToken] Error loading the refresh token from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if stored == nil {
+		log.Error("[RefreshToken] Unknown refresh token")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid refresh token"))
+		return
+	}
+
+	if stored.Revoked {
+		log.Errorf("[RefreshToken] Revoked refresh token of user %d presented", stored.UserID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid refresh token"))
+		return
+	}
+
+	used, err := store.UseRefreshToken(stored.ID)
+	if err != nil {
+		log.Errorf("[RefreshToken] Error using the refresh token: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !used {
+		// a refresh token is only valid once, so a second use means it was stolen.
+		// Neither the thief nor the legitimate client may continue with this family.
+		log.Errorf("[RefreshToken] Reuse of refresh token detected for user %d, revoking family %s", stored.UserID, stored.FamilyID)
+		if err := store.RevokeRefreshTokenFamily(stored.FamilyID); err != nil {
+			log.Errorf("[RefreshToken] Error revoking the refresh token family: %v", err)
+		}
+		if user, err := store.UserByID(stored.UserID); err == nil {
+			h.audit.recordUser(r, user, http.StatusBadRequest, "reuse of refresh token detected, token family revoked")
+		}
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid refresh token"))
+		return
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		log.Errorf("[RefreshToken] Expired refresh token of user %d presented", stored.UserID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid refresh token"))
 		return
 	}
 
-	renderResult(w, r, http.StatusOK, &tokenMsg{Token: token})
+	user, err := store.UserByID(stored.UserID)
+	if err != nil {
+		log.Errorf("[RefreshToken] Could not load user %d: %v", stored.UserID, err)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid refresh token"))
+		return
+	}
+
+	if user.Status != model.UserStatusActive {
+		// the account was set back to pending, the session ends like with an access token
+		log.Errorf("[RefreshToken] User %s is not approved, revoking family %s", user.Username, stored.FamilyID)
+		if err := store.RevokeRefreshTokenFamily(stored.FamilyID); err != nil {
+			log.Errorf("[RefreshToken] Error revoking the refresh token family: %v", err)
+		}
+		h.audit.recordUser(r, user, http.StatusForbidden, "account pending approval, token family revoked")
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Account pending approval"))
+		return
+	}
+
+	msg, err := h.issueTokens(r.Context(), user, stored.FamilyID, model.FormatScope(model.ParseScope(stored.Scope)))
+	if err != nil {
+		log.Errorf("[RefreshToken] Could not create token: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, msg)
+}
+
+// issueTokens creates an access token and a refresh token with the scope in the given family.
+func (h *handler) issueTokens(ctx context.Context, user *model.User, familyID, scope string) (*tokenMsg, error) {
+	token, err := auth.JWTToken(user.ID, user.Username, user.TokenVersion, scope, time.Now().Add(tokenValidity))
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, refreshTokenHash := auth.OpaqueToken()
+	err = h.store.WithContext(ctx).CreateRefreshToken(user.ID, familyID, refreshTokenHash, scope, time.Now().Add(refreshTokenValidity))
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenMsg{Token: token, RefreshToken: refreshToken, Scope: scope}, nil
+}
+
+func (h *handler) logout(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[Logout] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	claims, err := requestClaims(r)
+	if err != nil {
+		log.Errorf("[Logout] No JWT in context: %v", err)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Personal access tokens have to be deleted instead"))
+		return
+	}
+
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if err := store.DenyToken(jti, time.Unix(int64(exp), 0)); err != nil {
+		log.Errorf("[Logout] Error denying the token: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := r.ParseForm(); err == nil && r.Form.Get("refresh_token") != "" {
+		stored, err := store.RefreshTokenByHash(auth.HashToken(r.Form.Get("refresh_token")))
+		if err != nil {
+			log.Errorf("[Logout] Error loading the refresh token from the database: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		if stored != nil && stored.UserID == ru.ID {
+			if err := store.RevokeRefreshTokenFamily(stored.FamilyID); err != nil {
+				log.Errorf("[Logout] Error revoking the refresh token family: %v", err)
+				renderResult(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	renderResult(w, r, http.StatusNoContent, nil)
+}
+
+// jwks publishes the public signing keys. The key set is only defined as JSON,
+// so it is rendered as such regardless of the Accept header.
+func (h *handler) jwks(w http.ResponseWriter, r *http.Request) {
+	render.New().JSON(w, http.StatusOK, auth.JWKS())
 }
@@ -18,12 +18,15 @@ import (
 	"net/http"
 
 	"bookstore/model"
+	"bookstore/policy"
+	"bookstore/storage"
 	"bookstore/validator"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func (h *handler) listBooks(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	authorID, err := queryInt64Param(r, "author-id")
 	if err != nil {
 		log.Errorf("[ListBooks] Error reading query parameter: %v", err)
@@ -69,10 +72,10 @@ func (h *handler) listBooks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	books, err := h.store.SearchBooks(*search)
+	books, err := store.SearchBooks(*search)
 	if err != nil {
 		log.Errorf("[ListBooks] Error in loading the books from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -80,23 +83,20 @@ func (h *handler) listBooks(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handler) getBook(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	bookID := routeInt64Param(r, "bookID")
 
-	book, err := h.store.BookByID(bookID)
+	book, err := store.BookByID(bookID)
 	if err != nil {
 		log.Errorf("[GetBook] Error in loading the book from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
-		return
-	}
-	if book == nil {
-		log.Errorf("[GetBook] Book with id %d not found", bookID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 	renderResult(w, r, http.StatusOK, book)
 }
 
 func (h *handler) listUserBooks(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	_, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[ListUserBooks] No User in context: %v", err)
@@ -107,23 +107,17 @@ func (h *handler) listUserBooks(w http.ResponseWriter, r *http.Request) {
 
 	userID := routeInt64Param(r, "userID")
 
-	user, err := h.store.UserByID(userID)
-	if err != nil {
+	// the books of an unknown user are not found, instead of being empty
+	if _, err := store.UserByID(userID); err != nil {
 		log.Errorf("[ListUserBooks] Error in loading the user from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
-		return
-	}
-
-	if user == nil {
-		log.Errorf("[ListUserBooks] User with id %d not found", userID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	books, err := h.store.UserBooks(userID)
+	books, err := store.UserBooks(userID)
 	if err != nil {
 		log.Errorf("[ListUserBooks] Error in loading the user books from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -131,6 +125,7 @@ func (h *handler) listUserBooks(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handler) createUserBook(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[CreateUserBook] No user in context: %v", err)
@@ -140,20 +135,14 @@ func (h *handler) createUserBook(w http.ResponseWriter, r *http.Request) {
 
 	userID := routeInt64Param(r, "userID")
 
-	user, err := h.store.UserByID(userID)
+	user, err := store.UserByID(userID)
 	if err != nil {
 		log.Errorf("[CreateUserBook] Error loading the user from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
-		return
-	}
-
-	if user == nil {
-		log.Errorf("[CreateUserBook] User with id %d not found", userID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	if !ru.IsAdmin && user.ID != ru.ID {
+	if !policy.CanWriteBooks(ru, user.ID) {
 		log.Errorf("[CreateUserBook] User with id %d tried to create book for another user", ru.ID)
 		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
 		return
@@ -166,21 +155,31 @@ func (h *handler) createUserBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := validator.ValidateBookCreation(h.store, userID, &bookCreationRequest); err != nil {
-		log.Errorf("[CreateUserBook] Validation error: %v", err)
-		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+	var validationErr error
+	var b *model.Book
+	err = store.WithTx(func(tx storage.Store) error {
+		if validationErr = validator.ValidateBookCreation(tx, userID, &bookCreationRequest); validationErr != nil {
+			return validationErr
+		}
+		b, err = tx.CreateBook(userID, &bookCreationRequest)
+		return err
+	})
+	if isValidationError(validationErr) {
+		log.Errorf("[CreateUserBook] Validation error: %v", validationErr)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(validationErr))
 		return
 	}
-	b, err := h.store.CreateBook(userID, &bookCreationRequest)
 	if err != nil {
 		log.Errorf("[CreateUserBook] Error in user book creation from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	auditDetail(r, "created book %d %q", b.ID, b.Title)
 	renderResult(w, r, http.StatusCreated, b)
 }
 
 func (h *handler) updateUserBook(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[UpdateUserBook] No user in context: %v", err)
@@ -191,20 +190,14 @@ func (h *handler) updateUserBook(w http.ResponseWriter, r *http.Request) {
 	userID := routeInt64Param(r, "userID")
 	bookID := routeInt64Param(r, "bookID")
 
-	book, err := h.store.BookByIDAndUserID(userID, bookID)
+	book, err := store.BookByIDAndUserID(userID, bookID)
 	if err != nil {
 		log.Errorf("[UpdateUserBook] Error loading the user from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	if book == nil {
-		log.Errorf("[UpdateUserBook] book with id %d not found", bookID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
-		return
-	}
-
-	if !ru.IsAdmin && book.User.ID != ru.ID {
+	if !policy.CanWriteBooks(ru, book.User.ID) {
 		log.Errorf("[UpdateUserBook] User with id %d tried to update another user's book", ru.ID)
 		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
 		return
@@ -217,23 +210,30 @@ func (h *handler) updateUserBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := validator.ValidateBookModification(h.store, userID, bookID, &bookModificationRequest); err != nil {
-		log.Errorf("[UpdateUserBook] Validation error: %v", err)
-		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+	var validationErr error
+	err = store.WithTx(func(tx storage.Store) error {
+		if validationErr = validator.ValidateBookModification(tx, userID, bookID, &bookModificationRequest); validationErr != nil {
+			return validationErr
+		}
+		bookModificationRequest.Patch(book)
+		return tx.UpdateBook(book)
+	})
+	if isValidationError(validationErr) {
+		log.Errorf("[UpdateUserBook] Validation error: %v", validationErr)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(validationErr))
 		return
 	}
-
-	bookModificationRequest.Patch(book)
-	err = h.store.UpdateBook(book)
 	if err != nil {
 		log.Errorf("[UpdateUserBook] Error in user book update from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	auditDetail(r, "updated book %d %q", book.ID, book.Title)
 	renderResult(w, r, http.StatusOK, book)
 }
 
 func (h *handler) deleteUserBook(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[DeleteUserBook] No user in context: %v", err)
@@ -244,30 +244,25 @@ func (h *handler) deleteUserBook(w http.ResponseWriter, r *http.Request) {
 	userID := routeInt64Param(r, "userID")
 	bookID := routeInt64Param(r, "bookID")
 
-	book, err := h.store.BookByIDAndUserID(userID, bookID)
+	book, err := store.BookByIDAndUserID(userID, bookID)
 	if err != nil {
 		log.Errorf("[DeleteUserBook] Error loading the user from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	if book == nil {
-		log.Errorf("[DeleteUserBook] book with id %d not found", bookID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
-		return
-	}
-
-	if !ru.IsAdmin && book.User.ID != ru.ID {
+	if !policy.CanWriteBooks(ru, book.User.ID) {
 		log.Errorf("[DeleteUserBook] User with id %d tried to delete another user's book", ru.ID)
 		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
 		return
 	}
 
-	err = h.store.DeleteBook(bookID)
+	err = store.DeleteBook(bookID)
 	if err != nil {
 		log.Errorf("[DeleteUserBook] Error in user book deletion from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	auditDetail(r, "deleted book %d %q", book.ID, book.Title)
 	renderResult(w, r, http.StatusNoContent, book)
 }
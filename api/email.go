@@ -0,0 +1,112 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/notify"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const emailConfirmationBody = `The email address of your bookstore account %q was set to this address.
+
+Use the following token to confirm it, it is valid until %s:
+
+%s
+
+If you did not set the address, you can ignore this message.
+`
+
+// sendEmailConfirmation mails a token to the unconfirmed email of the user.
+// A failure only leaves the email unconfirmed, so it is logged and not returned.
+func (h *handler) sendEmailConfirmation(ctx context.Context, user *model.User) {
+	if user.Email == "" || user.EmailVerified {
+		return
+	}
+	if h.config.Notifier == nil {
+		log.Errorf("[EmailConfirmation] No notifier configured, confirmation token for user with id %d not sent", user.ID)
+		return
+	}
+
+	token, tokenHash := auth.OpaqueToken()
+	expiresAt := time.Now().Add(emailConfirmationTokenValidity)
+	if err := h.store.WithContext(ctx).CreateEmailConfirmationToken(user.ID, user.Email, tokenHash, expiresAt); err != nil {
+		log.Errorf("[EmailConfirmation] Error in confirmation token creation from the database: %v", err)
+		return
+	}
+
+	err := h.config.Notifier.Send(&notify.Message{
+		To:      user.Email,
+		Subject: "Confirm your bookstore email address",
+		Body:    fmt.Sprintf(emailConfirmationBody, user.Username, expiresAt.Format(time.RFC1123), token),
+	})
+	if err != nil {
+		log.Errorf("[EmailConfirmation] Error sending the confirmation token: %v", err)
+	}
+}
+
+func (h *handler) confirmEmail(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		log.Error("[ConfirmEmail] Could not parse form")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Could not parse parameters"))
+		return
+	}
+
+	token := r.Form.Get("token")
+	if token == "" {
+		log.Error("[ConfirmEmail] Empty token")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Token empty"))
+		return
+	}
+
+	stored, err := store.EmailConfirmationTokenByHash(auth.HashToken(token))
+	if err != nil {
+		log.Errorf("[ConfirmEmail] Error loading the confirmation token from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if stored == nil || stored.Used || time.Now().After(stored.ExpiresAt) {
+		log.Error("[ConfirmEmail] Unknown, used or expired confirmation token")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid confirmation token"))
+		return
+	}
+
+	confirmed, err := store.ConfirmEmail(stored.ID)
+	if err != nil {
+		log.Errorf("[ConfirmEmail] Error confirming the email in the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the token is also refused, once the user changed the email after it was sent
+	if !confirmed {
+		log.Errorf("[ConfirmEmail] Confirmation token of user with id %d is used or outdated", stored.UserID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid confirmation token"))
+		return
+	}
+
+	log.Infof("[ConfirmEmail] Email of user with id %d confirmed", stored.UserID)
+	renderResult(w, r, http.StatusNoContent, nil)
+}
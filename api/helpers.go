@@ -15,29 +15,30 @@
 package api
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"bookstore/model"
 
 	"github.com/elnormous/contenttype"
+	"github.com/form3tech-oss/jwt-go"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/unrolled/render"
 )
 
-type errorMsg struct {
-	XMLName      xml.Name `json:"-" xml:"error"`
-	ErrorMessage string   `json:"error_message" xml:"error_message"`
-}
-
 const (
-	ApplicationJSON = "application/json"
-	AppicationXML   = "application/xml"
-	TextXML         = "text/xml"
+	ApplicationJSON        = "application/json"
+	AppicationXML          = "application/xml"
+	TextXML                = "text/xml"
+	ApplicationProblemJSON = "application/problem+json"
+	ApplicationProblemXML  = "application/problem+xml"
 )
 
 type ListContainer interface {
@@ -53,6 +54,11 @@ const (
 	UserKey ContextKey = iota
 	ContentTypeKey
 	AcceptKey
+	PersonalAccessTokenKey
+	ScopesKey
+	ActorKey
+	ClientCertificateKey
+	AuditEventKey
 )
 
 func requestUser(r *http.Request) (*model.User, error) {
@@ -68,6 +74,68 @@ func requestUser(r *http.Request) (*model.User, error) {
 	return nil, fmt.Errorf("no value for key user in context")
 }
 
+func requestClaims(r *http.Request) (jwt.MapClaims, error) {
+	if v := r.Context().Value("token"); v != nil {
+		token, valid := v.(*jwt.Token)
+		if !valid {
+			return nil, fmt.Errorf("value is not from type jwt.Token %v", v)
+		}
+
+		claims, valid := token.Claims.(jwt.MapClaims)
+		if !valid {
+			return nil, fmt.Errorf("claims are not from type jwt.MapClaims %v", token.Claims)
+		}
+
+		return claims, nil
+	}
+
+	return nil, fmt.Errorf("no value for key token in context")
+}
+
+func requestPersonalAccessToken(r *http.Request) (*model.PersonalAccessToken, error) {
+	if v := r.Context().Value(PersonalAccessTokenKey); v != nil {
+		value, valid := v.(*model.PersonalAccessToken)
+		if !valid {
+			return nil, fmt.Errorf("value is not from type model.PersonalAccessToken %v", v)
+		}
+
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("no value for key personal access token in context")
+}
+
+func requestClientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if v := r.Context().Value(ClientCertificateKey); v != nil {
+		value, valid := v.(*x509.Certificate)
+		if !valid {
+			return nil, fmt.Errorf("value is not from type x509.Certificate %v", v)
+		}
+
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("no value for key client certificate in context")
+}
+
+// requestActor returns the user, who impersonates the request user, or nil.
+func requestActor(r *http.Request) *model.User {
+	if v, ok := r.Context().Value(ActorKey).(*model.User); ok {
+		return v
+	}
+
+	return nil
+}
+
+// requestScopes returns the scopes of the token, which authenticated the request.
+func requestScopes(r *http.Request) []string {
+	if v, ok := r.Context().Value(ScopesKey).([]string); ok {
+		return v
+	}
+
+	return nil
+}
+
 func requestContentType(r *http.Request) (*contenttype.MediaType, error) {
 	if v := r.Context().Value(ContentTypeKey); v != nil {
 		value, valid := v.(*contenttype.MediaType)
@@ -92,11 +160,14 @@ func requestAccept(r *http.Request) (*contenttype.MediaType, error) {
 
 	return nil, fmt.Errorf("no value for key Accept in context")
 }
-func errToObjectError(err error) *errorMsg {
-	return &errorMsg{ErrorMessage: err.Error()}
-}
-func strToObjectError(err string) *errorMsg {
-	return &errorMsg{ErrorMessage: err}
+
+// clientIP returns the address of the client without port. Proxy headers are not trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func queryInt64Param(r *http.Request, param string) (*int64, error) {
@@ -130,6 +201,24 @@ func queryStringParam(r *http.Request, param string) (*string, error) {
 	return &v[0], nil
 }
 
+// queryTimeParam reads a time in RFC 3339 format.
+func queryTimeParam(r *http.Request, param string) (*time.Time, error) {
+	vars := r.URL.Query()
+	v, ok := vars[param]
+	if !ok {
+		return nil, nil
+	}
+	if len(v) > 1 {
+		return nil, fmt.Errorf("more than one query parameter: %s", param)
+	}
+	value, err := time.Parse(time.RFC3339, v[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &value, nil
+}
+
 func routeInt64Param(r *http.Request, param string) int64 {
 	vars := mux.Vars(r)
 	value, err := strconv.ParseInt(vars[param], 10, 64)
@@ -144,7 +233,17 @@ func routeInt64Param(r *http.Request, param string) int64 {
 	return value
 }
 
+// renderResult renders the object in the accepted media type. Errors are rendered as problem
+// details, storage errors with the status of their kind, so all handlers answer them alike.
 func renderResult(w http.ResponseWriter, r *http.Request, status int, object interface{}) {
+	if err, ok := object.(error); ok {
+		status, object = errorResult(status, err)
+	}
+	if p, ok := object.(*problem); ok {
+		renderProblem(w, r, status, p)
+		return
+	}
+
 	render := render.New()
 	accept, err := requestAccept(r)
 	if err != nil {
@@ -154,13 +253,13 @@ func renderResult(w http.ResponseWriter, r *http.Request, status int, object int
 	}
 
 	switch accept.Type + "/" + accept.Subtype {
-	case ApplicationJSON:
+	case ApplicationJSON, ApplicationProblemJSON:
 		if o, ok := object.(ListContainer); ok {
 			render.JSON(w, status, o.List())
 		} else {
 			render.JSON(w, status, object)
 		}
-	case AppicationXML, TextXML:
+	case AppicationXML, TextXML, ApplicationProblemXML:
 		render.XML(w, status, object)
 	default:
 		log.Errorf("[renderResult] accept type unknow - should not happen - %v", accept.Type)
@@ -0,0 +1,98 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/policy"
+	"bookstore/validator"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ImpersonatedByHeader marks the responses to requests, which were made while impersonating a user.
+const ImpersonatedByHeader = "X-Impersonated-By"
+
+// defaultImpersonationScope lets support staff see what the user sees, without changing anything.
+var defaultImpersonationScope = model.FormatScope([]string{model.ScopeBooksRead, model.ScopeUsersRead})
+
+func (h *handler) impersonateUser(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[ImpersonateUser] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if actor := requestActor(r); actor != nil {
+		log.Errorf("[ImpersonateUser] User %s acting as %s tried to impersonate another user", actor.Username, ru.Username)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+	user, err := store.UserByID(userID)
+	if err != nil {
+		log.Errorf("[ImpersonateUser] Error in loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !policy.CanImpersonate(ru, user) {
+		log.Errorf("[ImpersonateUser] User with id %d is not allowed to impersonate user with id %d", ru.ID, user.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	if user.Status != model.UserStatusActive {
+		log.Errorf("[ImpersonateUser] User with id %d is not approved yet", user.ID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Account pending approval"))
+		return
+	}
+
+	var impersonationRequest model.ImpersonationRequest
+	if err := unmarshalRequestObject(w, r, &impersonationRequest); err != nil {
+		log.Errorf("[ImpersonateUser] JSON decoding error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	if impersonationRequest.Scope == "" {
+		impersonationRequest.Scope = defaultImpersonationScope
+	}
+
+	if err := validator.ValidateScope(impersonationRequest.Scope, requestScopes(r)); err != nil {
+		log.Errorf("[ImpersonateUser] Validation error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	token, err := auth.ImpersonationToken(user.ID, user.Username, user.TokenVersion, impersonationRequest.Scope, ru.ID, ru.Username, time.Now().Add(impersonationTokenValidity))
+	if err != nil {
+		log.Errorf("[ImpersonateUser] Could not create token: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Infof("[ImpersonateUser] User %s impersonates user %s with scope %s", ru.Username, user.Username, impersonationRequest.Scope)
+	auditDetail(r, "impersonation token for user %s with scope %s", user.Username, impersonationRequest.Scope)
+
+	renderResult(w, r, http.StatusCreated, &tokenMsg{Token: token, Scope: impersonationRequest.Scope})
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/policy"
+
+	"github.com/form3tech-oss/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+func (h *handler) getMe(w http.ResponseWriter, r *http.Request) {
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[GetMe] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	me := &model.CurrentUser{User: ru, Actor: requestActor(r)}
+	if claims, err := requestClaims(r); err == nil {
+		me.Token = jwtTokenInfo(claims)
+	} else if pat, err := requestPersonalAccessToken(r); err == nil {
+		me.Token = personalAccessTokenInfo(pat)
+	} else if cert, err := requestClientCertificate(r); err == nil {
+		me.Token = clientCertificateInfo(cert)
+	} else {
+		log.Errorf("[GetMe] No token in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, me)
+}
+
+func (h *handler) introspectToken(w http.ResponseWriter, r *http.Request) {
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[IntrospectToken] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if !policy.CanIntrospectTokens(ru) {
+		log.Errorf("[IntrospectToken] User with id %d is not allowed to introspect tokens", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		log.Errorf("[IntrospectToken] Error parsing form: %v", err)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Form could not be parsed"))
+		return
+	}
+
+	token := r.Form.Get("token")
+	if token == "" {
+		log.Error("[IntrospectToken] No token given")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("token is mandatory"))
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, h.introspect(r.Context(), token))
+}
+
+// introspect checks the token the same way as the middleware does.
+// Every token, which would be refused there, is reported as inactive.
+func (h *handler) introspect(ctx context.Context, token string) *model.TokenIntrospection {
+	store := h.store.WithContext(ctx)
+	inactive := &model.TokenIntrospection{Active: false}
+
+	var user, actor *model.User
+	var info model.TokenInfo
+	var claims jwt.MapClaims
+	if auth.IsPersonalAccessToken(token) {
+		u, pat, err := personalAccessTokenUser(store, token)
+		if err != nil {
+			log.Infof("[IntrospectToken] Inactive personal access token: %v", err)
+			return inactive
+		}
+		user, info = u, personalAccessTokenInfo(pat)
+	} else {
+		var err error
+		claims, err = auth.ParseToken(token)
+		if err != nil {
+			log.Infof("[IntrospectToken] Invalid token: %v", err)
+			return inactive
+		}
+		user, err = claimsUser(store, claims)
+		if err != nil {
+			log.Infof("[IntrospectToken] Inactive token: %v", err)
+			return inactive
+		}
+		info = jwtTokenInfo(claims)
+		actor, err = claimsActor(store, claims, user)
+		if err != nil {
+			log.Infof("[IntrospectToken] Inactive token: %v", err)
+			return inactive
+		}
+	}
+
+	if user.Status != model.UserStatusActive {
+		log.Infof("[IntrospectToken] User %s is not approved yet", user.Username)
+		return inactive
+	}
+
+	introspection := &model.TokenIntrospection{
+		Active:    true,
+		Scope:     model.FormatScope(info.Scopes),
+		TokenType: info.Type,
+		Username:  user.Username,
+		UserID:    user.ID,
+		Subject:   user.Username,
+		ID:        info.ID,
+	}
+	if info.IssuedAt != nil {
+		introspection.IssuedAt = info.IssuedAt.Unix()
+	}
+	if info.ExpiresAt != nil {
+		introspection.ExpiresAt = info.ExpiresAt.Unix()
+	}
+	if actor != nil {
+		introspection.Actor = &model.TokenActor{Subject: actor.Username}
+	}
+	if claims != nil {
+		introspection.Issuer, _ = claims["iss"].(string)
+		if nbf, ok := claims["nbf"].(float64); ok {
+			introspection.NotBefore = int64(nbf)
+		}
+	}
+
+	return introspection
+}
+
+func jwtTokenInfo(claims jwt.MapClaims) model.TokenInfo {
+	info := model.TokenInfo{
+		Type:      model.TokenTypeJWT,
+		IssuedAt:  claimTime(claims, "iat"),
+		ExpiresAt: claimTime(claims, "exp"),
+	}
+	info.ID, _ = claims["jti"].(string)
+	scope, _ := claims["scope"].(string)
+	info.Scopes = model.ParseScope(scope)
+
+	return info
+}
+
+func personalAccessTokenInfo(pat *model.PersonalAccessToken) model.TokenInfo {
+	createdAt := pat.CreatedAt
+	return model.TokenInfo{
+		Type:     model.TokenTypePersonalAccessToken,
+		IssuedAt: &createdAt,
+		Scopes:   model.ParseScope(pat.Scope),
+	}
+}
+
+// clientCertificateInfo describes the client certificate, which authenticated the request.
+func clientCertificateInfo(cert *x509.Certificate) model.TokenInfo {
+	notBefore, notAfter := cert.NotBefore.UTC(), cert.NotAfter.UTC()
+	return model.TokenInfo{
+		Type:      model.TokenTypeClientCertificate,
+		ID:        cert.SerialNumber.Text(16),
+		IssuedAt:  &notBefore,
+		ExpiresAt: &notAfter,
+		Scopes:    model.ParseScope(""),
+	}
+}
+
+// claimTime returns a NumericDate claim as time, or nil if it is missing.
+func claimTime(claims jwt.MapClaims, name string) *time.Time {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return nil
+	}
+	t := time.Unix(int64(value), 0).UTC()
+	return &t
+}
@@ -16,35 +16,60 @@ package api
 
 import (
 	"context"
+	"crypto/x509"
+	"fmt"
 	"net/http"
+	"strings"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware"
 	"github.com/elnormous/contenttype"
 	log "github.com/sirupsen/logrus"
 
 	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/policy"
 	"bookstore/storage"
 
 	"github.com/form3tech-oss/jwt-go"
+	"github.com/gorilla/mux"
 )
 
 type middleware struct {
-	store         *storage.Storage
+	store         storage.Store
+	config        *Config
 	jwtMiddleware *jwtmiddleware.JWTMiddleware
+	audit         *auditRecorder
 }
 
-func newMiddleware(s *storage.Storage) *middleware {
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			return auth.HMACKey(), nil
+func newMiddleware(s storage.Store, config *Config, audit *auditRecorder) *middleware {
+	m := &middleware{store: s, config: config, audit: audit}
+	m.jwtMiddleware = jwtmiddleware.New(jwtmiddleware.Options{
+		// The keyring may hold keys of different algorithms, so the signing method is not constant.
+		// ValidationKey checks that the algorithm of the token matches the key,
+		// important to avoid security issues described here: https://auth0.com/blog/critical-vulnerabilities-in-json-web-token-libraries/
+		ValidationKeyGetter: auth.ValidationKey,
+		UserProperty:        "token",
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err string) {
+			m.unauthorized(w, r, err)
 		},
-		// When set, the middleware verifies that tokens are signed with the specific signing algorithm
-		// If the signing method is not constant the ValidationKeyGetter callback can be used to implement additional checks
-		// Important to avoid security issues described here: https://auth0.com/blog/critical-vulnerabilities-in-json-web-token-libraries/
-		SigningMethod: auth.SigningMethod(),
-		UserProperty:  "token",
 	})
-	return &middleware{s, jwtMiddleware}
+	return m
+}
+
+// unauthorized refuses a request without valid credentials and records it in the audit log.
+func (m *middleware) unauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	m.audit.record(r, model.AuditEvent{Status: http.StatusUnauthorized, Detail: detail})
+	renderResult(w, r, http.StatusUnauthorized, strToObjectError("Unauthorized"))
+}
+
+// handleDeadline cancels the context of the request after the request timeout.
+func (m *middleware) handleDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), m.config.RequestTimeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func (m *middleware) handleMediaTypes(next http.Handler) http.Handler {
@@ -52,7 +77,7 @@ func (m *middleware) handleMediaTypes(next http.Handler) http.Handler {
 		mediaType, err := contenttype.GetMediaType(r)
 		if err != nil {
 			log.Errorf("[Middleware][MediaTypes] Content-Type could not be parsed: %v", err)
-			http.Error(w, "Erronous Content-Type", http.StatusBadRequest)
+			renderProblem(w, r, http.StatusBadRequest, strToObjectError("Erronous Content-Type"))
 			return
 		}
 		log.Info("Media type:", mediaType.String())
@@ -61,12 +86,14 @@ func (m *middleware) handleMediaTypes(next http.Handler) http.Handler {
 			contenttype.NewMediaType(ApplicationJSON),
 			contenttype.NewMediaType(AppicationXML),
 			contenttype.NewMediaType(TextXML),
+			contenttype.NewMediaType(ApplicationProblemJSON),
+			contenttype.NewMediaType(ApplicationProblemXML),
 		}
 
 		accepted, extParameters, err := contenttype.GetAcceptableMediaType(r, availableMediaTypes)
 		if err != nil {
 			log.Errorf("[Middleware][MediaTypes] Accept could not be parsed: %v", err)
-			http.Error(w, "Erronous Accept", http.StatusBadRequest)
+			renderProblem(w, r, http.StatusBadRequest, strToObjectError("Erronous Accept"))
 			return
 		}
 		log.Info("Accepted media type:", accepted.String(), "extension parameters:", extParameters)
@@ -78,38 +105,261 @@ func (m *middleware) handleMediaTypes(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// handleToken authenticates the request with either a JWT or a personal access token.
+// Requests without token may authenticate with a TLS client certificate, if enabled.
 func (m *middleware) handleToken(next http.Handler) http.Handler {
+	jwtHandler := m.handleJWT(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" && m.config.ClientCertificates {
+			if cert := verifiedClientCertificate(r); cert != nil {
+				m.handleClientCertificate(next, cert, w, r)
+				return
+			}
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if auth.IsPersonalAccessToken(token) {
+			m.handlePersonalAccessToken(next, token, w, r)
+			return
+		}
+		jwtHandler.ServeHTTP(w, r)
+	})
+}
+
+func (m *middleware) handlePersonalAccessToken(next http.Handler, token string, w http.ResponseWriter, r *http.Request) {
+	store := m.store.WithContext(r.Context())
+	user, pat, err := personalAccessTokenUser(store, token)
+	if err != nil {
+		log.Errorf("[Middleware][HandleToken] %v", err)
+		m.unauthorized(w, r, err.Error())
+		return
+	}
+	if err := store.TouchPersonalAccessToken(pat.ID); err != nil {
+		log.Errorf("[Middleware][HandleToken] Problem updating the personal access token: %v", err)
+	}
+
+	*r = *r.WithContext(context.WithValue(r.Context(), PersonalAccessTokenKey, pat))
+	m.serveUser(next, user, nil, model.ParseScope(pat.Scope), w, r)
+}
+
+func (m *middleware) handleClientCertificate(next http.Handler, cert *x509.Certificate, w http.ResponseWriter, r *http.Request) {
+	username := cert.Subject.CommonName
+	user, err := m.store.WithContext(r.Context()).UserByUsername(username)
+	if err != nil {
+		log.Errorf("[Middleware][HandleToken] Problem loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusUnauthorized, strToObjectError("Unauthorized"))
+		return
+	}
+	if user == nil {
+		log.Errorf("[Middleware][HandleToken] No user found for the client certificate %q", cert.Subject.String())
+		m.unauthorized(w, r, fmt.Sprintf("no user found for the client certificate %q", cert.Subject.String()))
+		return
+	}
+
+	*r = *r.WithContext(context.WithValue(r.Context(), ClientCertificateKey, cert))
+	m.serveUser(next, user, nil, model.ParseScope(""), w, r)
+}
+
+// verifiedClientCertificate returns the client certificate, if the TLS handshake verified it against the client CAs.
+func verifiedClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func (m *middleware) handleJWT(next http.Handler) http.Handler {
 	return m.jwtMiddleware.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := r.Context().Value("token")
 		claims, ok := token.(*jwt.Token).Claims.(jwt.MapClaims)
 		if !ok {
 			log.Error("[Middleware][HandleToken] Token could not be cast to MapClaims")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			renderResult(w, r, http.StatusUnauthorized, strToObjectError("Unauthorized"))
 			return
 		}
-		sub, ok := claims["sub"].(string)
-		if !ok {
-			log.Error("[Middleware][HandleToken] sub could not be cast to string")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-		user, err := m.store.UserByUsername(sub)
+		store := m.store.WithContext(r.Context())
+		user, err := claimsUser(store, claims)
 		if err != nil {
-			log.Errorf("[Middleware][HandleToken] Problem loading the user from the database: %v", err)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Errorf("[Middleware][HandleToken] %v", err)
+			m.unauthorized(w, r, err.Error())
 			return
 		}
-		if user == nil {
-			log.Errorf("[Middleware][HandleToken] No user found with user name: %s", sub)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		actor, err := claimsActor(store, claims, user)
+		if err != nil {
+			log.Errorf("[Middleware][HandleToken] %v", err)
+			m.unauthorized(w, r, err.Error())
 			return
 		}
+		scope, _ := claims["scope"].(string)
 
-		// If we get here, everything worked and we can set the
-		// user property in context.
-		newRequest := r.WithContext(context.WithValue(r.Context(), UserKey, user))
-		// Update the current request with the new context information.
-		*r = *newRequest
-		next.ServeHTTP(w, r)
+		m.serveUser(next, user, actor, model.ParseScope(scope), w, r)
 	}))
 }
+
+// personalAccessTokenUser returns the owner of a personal access token.
+func personalAccessTokenUser(store storage.Store, token string) (*model.User, *model.PersonalAccessToken, error) {
+	pat, err := store.PersonalAccessTokenByHash(auth.HashToken(token))
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem loading the personal access token from the database: %v", err)
+	}
+	if pat == nil {
+		return nil, nil, fmt.Errorf("unknown personal access token")
+	}
+	user, err := store.UserByID(pat.UserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem loading the user %d from the database: %v", pat.UserID, err)
+	}
+
+	return user, pat, nil
+}
+
+// claimsUser returns the user of verified JWT claims,
+// as long as the token was neither revoked nor put on the denylist.
+func claimsUser(store storage.Store, claims jwt.MapClaims) (*model.User, error) {
+	sub, ok := claims["sub"].(string)
+	if !ok {
+		return nil, fmt.Errorf("sub could not be cast to string")
+	}
+	user, err := store.UserByUsername(sub)
+	if err != nil {
+		return nil, fmt.Errorf("problem loading the user from the database: %v", err)
+	}
+	if user == nil {
+		return nil, fmt.Errorf("no user found with user name: %s", sub)
+	}
+	// the user name of a deleted user can be taken by a new one
+	uid, ok := claims["uid"].(float64)
+	if !ok || int64(uid) != user.ID {
+		return nil, fmt.Errorf("token of user %s was issued to another user with the same name", sub)
+	}
+	version, ok := claims["ver"].(float64)
+	if !ok || int64(version) != user.TokenVersion {
+		return nil, fmt.Errorf("token of user %s was revoked", sub)
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok {
+		return nil, fmt.Errorf("jti could not be cast to string")
+	}
+	denied, err := store.TokenDenied(jti)
+	if err != nil {
+		return nil, fmt.Errorf("problem checking the denylist: %v", err)
+	}
+	if denied {
+		return nil, fmt.Errorf("token %s of user %s is on the denylist", jti, sub)
+	}
+
+	return user, nil
+}
+
+// claimsActor returns the user, who acts as the subject of an impersonation token,
+// or nil for a normal token. The actor has to be allowed to impersonate the user still.
+func claimsActor(store storage.Store, claims jwt.MapClaims, user *model.User) (*model.User, error) {
+	act, ok := claims["act"]
+	if !ok {
+		return nil, nil
+	}
+	actClaims, ok := act.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("act could not be cast to an object")
+	}
+	sub, ok := actClaims["sub"].(string)
+	if !ok {
+		return nil, fmt.Errorf("sub of act could not be cast to string")
+	}
+	actor, err := store.UserByUsername(sub)
+	if err != nil {
+		return nil, fmt.Errorf("problem loading the actor from the database: %v", err)
+	}
+	if uid, ok := actClaims["uid"].(float64); actor != nil && (!ok || int64(uid) != actor.ID) {
+		return nil, fmt.Errorf("act of the token was issued to another user with the name %s", sub)
+	}
+	if actor == nil || actor.Status != model.UserStatusActive || !policy.CanImpersonate(actor, user) {
+		return nil, fmt.Errorf("%s may no longer act as %s", sub, user.Username)
+	}
+
+	return actor, nil
+}
+
+// totpEnrolmentRoutes stay reachable for admins, who have to enrol TOTP first.
+var totpEnrolmentRoutes = map[string]bool{
+	"EnrolTOTP":  true,
+	"VerifyTOTP": true,
+	"Logout":     true,
+}
+
+// serveUser continues the request as the authenticated user,
+// if the scopes of the token include the scope of the route.
+// Changes, refused requests and requests made by an actor impersonating the user are audited.
+func (m *middleware) serveUser(next http.Handler, user *model.User, actor *model.User, scopes []string, w http.ResponseWriter, r *http.Request) {
+	// the user is known from here on, so the audit event names the user also if the request is refused
+	ctx := context.WithValue(r.Context(), UserKey, user)
+	if actor != nil {
+		ctx = context.WithValue(ctx, ActorKey, actor)
+	}
+	request, event := withAuditEvent(r.WithContext(ctx))
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		if auditedRequest(request, recorder.status, actor != nil) {
+			event.Status = recorder.status
+			m.audit.record(request, *event)
+		}
+	}()
+
+	if actor != nil {
+		log.Infof("[Middleware][HandleToken] User %s acts as user %s: %s %s", actor.Username, user.Username, r.Method, r.URL.Path)
+		w.Header().Set(ImpersonatedByHeader, actor.Username)
+	}
+
+	if user.Status != model.UserStatusActive {
+		log.Errorf("[Middleware][HandleToken] User %s is not approved yet", user.Username)
+		renderResult(recorder, r, http.StatusForbidden, strToObjectError("Account pending approval"))
+		return
+	}
+
+	var routeName string
+	if route := mux.CurrentRoute(r); route != nil {
+		routeName = route.GetName()
+	}
+
+	// routes without declared scope are refused, so a new route can not be used by every token by accident
+	scope, declared := routeScopes[routeName]
+	if !declared {
+		log.Errorf("[Middleware][HandleToken] Route %q declares no scope", routeName)
+		renderResult(recorder, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+	if scope != "" && !model.HasScope(scopes, scope) {
+		log.Errorf("[Middleware][HandleToken] Token of user %s lacks the scope %s", user.Username, scope)
+		event.Detail = fmt.Sprintf("insufficient scope, %s required", scope)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		renderResult(recorder, r, http.StatusForbidden, strToObjectError("Insufficient scope"))
+		return
+	}
+
+	if user.IsAdmin && !user.TOTPEnabled {
+		if !totpEnrolmentRoutes[routeName] {
+			settings, err := m.store.WithContext(r.Context()).Settings()
+			if err != nil {
+				log.Errorf("[Middleware][HandleToken] Problem loading the settings from the database: %v", err)
+				renderResult(recorder, r, http.StatusUnauthorized, strToObjectError("Unauthorized"))
+				return
+			}
+			if settings.RequireAdminTOTP {
+				log.Errorf("[Middleware][HandleToken] Admin %s has to enrol TOTP first", user.Username)
+				event.Detail = "TOTP enrolment required"
+				renderResult(recorder, r, http.StatusForbidden, strToObjectError("TOTP enrolment required"))
+				return
+			}
+		}
+	}
+
+	// If we get here, everything worked and we can set the
+	// user property in context.
+	ctx = context.WithValue(request.Context(), ScopesKey, scopes)
+	// Update the current request with the new context information.
+	*r = *request.WithContext(ctx)
+
+	next.ServeHTTP(recorder, r)
+}
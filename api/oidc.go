@@ -0,0 +1,309 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/oidc"
+	"bookstore/policy"
+	"bookstore/storage"
+	"bookstore/validator"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// oidcLinkMsg is returned by /oidc/link with the URL, where the user logs in at the identity provider.
+type oidcLinkMsg struct {
+	URL string `json:"url" xml:"url"`
+}
+
+// oidcLogin redirects to the identity provider.
+func (h *handler) oidcLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, err := h.startOIDCLogin(r.Context(), 0)
+	if err != nil {
+		log.Errorf("[OIDCLogin] Could not store the login: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcLink starts a login at the identity provider, which links the identity to the local user.
+// The user proves the account with the password and, if enrolled, a TOTP or recovery code,
+// so users, who are not linked by email, can log in through the provider as well.
+func (h *handler) oidcLink(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	if err := r.ParseForm(); err != nil {
+		log.Error("[OIDCLink] Could not parse form")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Could not parse parameters"))
+		return
+	}
+
+	username := r.Form.Get("username")
+	password := r.Form.Get("password")
+
+	if username == "" || password == "" {
+		log.Error("[OIDCLink] Empty username or password")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Username or password empty"))
+		return
+	}
+
+	attempt := h.beginLogin(w, r, username)
+	if attempt == nil {
+		return
+	}
+
+	if err := store.CheckPassword(username, password); err != nil {
+		log.Error("[OIDCLink] Username or password not correct")
+		h.failLogin(r.Context(), attempt)
+		h.audit.record(r, model.AuditEvent{Actor: username, Status: http.StatusBadRequest, Detail: "credentials incorrect"})
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Credentials incorrect"))
+		return
+	}
+
+	user, err := store.UserByUsername(username)
+	if err != nil {
+		log.Errorf("[OIDCLink] Could not load user: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		// the user was deleted after the password was checked, which is answered like an unknown user
+		log.Errorf("[OIDCLink] User %s was deleted during the login", username)
+		h.failLogin(r.Context(), attempt)
+		h.audit.record(r, model.AuditEvent{Actor: username, Status: http.StatusBadRequest, Detail: "credentials incorrect"})
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Credentials incorrect"))
+		return
+	}
+
+	if user.TOTPEnabled {
+		valid, err := h.checkSecondFactor(r.Context(), user.ID, r.Form.Get("code"))
+		if err != nil {
+			log.Errorf("[OIDCLink] Error checking the code: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !valid {
+			log.Errorf("[OIDCLink] Code of user %s not correct", user.Username)
+			h.failLogin(r.Context(), attempt)
+			h.audit.recordUser(r, user, http.StatusBadRequest, "code incorrect")
+			renderResult(w, r, http.StatusBadRequest, strToObjectError("Code incorrect"))
+			return
+		}
+	}
+
+	if err := store.DeleteLoginThrottle(auth.UserThrottleSubject(user.Username)); err != nil {
+		log.Errorf("[OIDCLink] Could not reset login throttle: %v", err)
+	}
+
+	authURL, err := h.startOIDCLogin(r.Context(), user.ID)
+	if err != nil {
+		log.Errorf("[OIDCLink] Could not store the login: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.audit.recordUser(r, user, http.StatusOK, "linking an identity of the identity provider")
+	renderResult(w, r, http.StatusOK, &oidcLinkMsg{URL: authURL})
+}
+
+// startOIDCLogin stores the state, nonce and PKCE verifier of a new login until the provider
+// redirects back to oidcCallback and returns the URL of the provider. With a userID other than 0
+// the login links the identity to the user.
+func (h *handler) startOIDCLogin(ctx context.Context, userID int64) (string, error) {
+	state, stateHash := auth.OpaqueToken()
+	nonce, _ := auth.OpaqueToken()
+	codeVerifier, _ := auth.OpaqueToken()
+
+	err := h.store.WithContext(ctx).CreateOIDCLogin(stateHash, nonce, codeVerifier, userID, time.Now().Add(oidcLoginValidity))
+	if err != nil {
+		return "", err
+	}
+
+	return h.config.OIDC.AuthCodeURL(state, nonce, codeVerifier), nil
+}
+
+// oidcCallback redeems the authorization code and issues the tokens of the user, who is linked to the identity.
+// Second factors are left to the identity provider, so users with a second factor or the permission
+// to manage users are not linked by email, but only through /oidc/link.
+func (h *handler) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	query := r.URL.Query()
+
+	if providerError := query.Get("error"); providerError != "" {
+		log.Errorf("[OIDCCallback] Identity provider returned error %s: %s", providerError, query.Get("error_description"))
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Login failed"))
+		return
+	}
+
+	state := query.Get("state")
+	code := query.Get("code")
+	if state == "" || code == "" {
+		log.Error("[OIDCCallback] Empty state or code")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("State or code empty"))
+		return
+	}
+
+	login, err := store.UseOIDCLogin(auth.HashToken(state))
+	if err != nil {
+		log.Errorf("[OIDCCallback] Error loading the login from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if login == nil || time.Now().After(login.ExpiresAt) {
+		log.Error("[OIDCCallback] Unknown or expired state")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid state"))
+		return
+	}
+
+	identity, err := h.config.OIDC.Exchange(code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		log.Errorf("[OIDCCallback] Could not redeem the code: %v", err)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Login failed"))
+		return
+	}
+
+	user, err := store.UserByIdentity(identity.Issuer, identity.Subject)
+	if err != nil {
+		log.Errorf("[OIDCCallback] Error loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if login.UserID != 0 {
+		if user != nil && user.ID != login.UserID {
+			log.Errorf("[OIDCCallback] Subject %s of %s is linked to another user", identity.Subject, identity.Issuer)
+			h.audit.record(r, model.AuditEvent{Actor: identity.Subject, Status: http.StatusConflict, Detail: "identity of " + identity.Issuer + " linked to another user"})
+			renderResult(w, r, http.StatusConflict, strToObjectError("Identity linked to another user"))
+			return
+		}
+		if user == nil {
+			if err := store.LinkIdentity(login.UserID, identity.Issuer, identity.Subject); err != nil {
+				log.Errorf("[OIDCCallback] Could not link the identity: %v", err)
+				renderResult(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if user, err = store.UserByID(login.UserID); err != nil {
+				log.Errorf("[OIDCCallback] Could not load user %d: %v", login.UserID, err)
+				renderResult(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			log.Infof("[OIDCCallback] Linked subject %s of %s to user %s", identity.Subject, identity.Issuer, user.Username)
+		}
+	}
+
+	linked := user != nil
+
+	if user == nil && identity.Email != "" && identity.EmailVerified {
+		user, err = store.UserByEmail(identity.Email)
+		if err != nil {
+			log.Errorf("[OIDCCallback] Error loading the user from the database: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if user != nil && !policy.CanLinkIdentityByEmail(user) {
+			log.Errorf("[OIDCCallback] User %s has to link the subject %s of %s with the password", user.Username, identity.Subject, identity.Issuer)
+			h.audit.recordUser(r, user, http.StatusForbidden, "identity of "+identity.Issuer+" not linked by email")
+			renderResult(w, r, http.StatusForbidden, strToObjectError("Identity has to be linked with password and second factor"))
+			return
+		}
+	}
+
+	if user == nil {
+		if !h.config.OIDCAutoProvision {
+			log.Errorf("[OIDCCallback] No user for subject %s of %s", identity.Subject, identity.Issuer)
+			h.audit.record(r, model.AuditEvent{Actor: identity.Subject, Status: http.StatusForbidden, Detail: "no user for the subject of " + identity.Issuer})
+			renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+			return
+		}
+
+		userCreationRequest := oidcUserCreationRequest(identity)
+		var validationErr error
+		err = store.WithTx(func(tx storage.Store) error {
+			if validationErr = validator.ValidateExternalUserCreation(tx, userCreationRequest); validationErr != nil {
+				return validationErr
+			}
+			if user, err = tx.CreateUser(userCreationRequest); err != nil {
+				return err
+			}
+			return tx.LinkIdentity(user.ID, identity.Issuer, identity.Subject)
+		})
+		if isValidationError(validationErr) {
+			log.Errorf("[OIDCCallback] Validation error: %v", validationErr)
+			renderResult(w, r, http.StatusConflict, errToObjectError(validationErr))
+			return
+		}
+		if err != nil {
+			log.Errorf("[OIDCCallback] Error creating the user: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		log.Infof("[OIDCCallback] Created user %s for subject %s of %s", user.Username, identity.Subject, identity.Issuer)
+	} else if !linked {
+		if err := store.LinkIdentity(user.ID, identity.Issuer, identity.Subject); err != nil {
+			log.Errorf("[OIDCCallback] Could not link the identity: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if user.Status != model.UserStatusActive {
+		log.Errorf("[OIDCCallback] User %s is not approved yet", user.Username)
+		h.audit.recordUser(r, user, http.StatusForbidden, "account pending approval")
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Account pending approval"))
+		return
+	}
+
+	msg, err := h.issueTokens(r.Context(), user, auth.TokenFamily(), model.FormatScope(model.Scopes))
+	if err != nil {
+		log.Errorf("[OIDCCallback] Could not create token: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.audit.recordUser(r, user, http.StatusOK, "login through "+identity.Issuer)
+
+	renderResult(w, r, http.StatusOK, msg)
+}
+
+// oidcUserCreationRequest describes the user, who is provisioned for a new identity.
+// The user has no password and can only log in through the identity provider.
+func oidcUserCreationRequest(identity *oidc.Identity) *model.UserCreationRequest {
+	request := &model.UserCreationRequest{
+		Username:  identity.PreferredUsername,
+		Pseudonym: identity.Name,
+		Role:      model.DefaultRole,
+	}
+	if identity.EmailVerified {
+		// the provider confirmed the email already
+		request.Email = identity.Email
+		request.EmailVerified = true
+	}
+	if request.Username == "" {
+		request.Username = request.Email
+	}
+	if request.Pseudonym == "" {
+		request.Pseudonym = request.Username
+	}
+
+	return request
+}
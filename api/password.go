@@ -0,0 +1,177 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/notify"
+	"bookstore/storage"
+	"bookstore/validator"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const passwordResetBody = `A password reset was requested for your bookstore account %q.
+
+Use the following token to set a new password, it is valid until %s:
+
+%s
+
+If you did not request the reset, you can ignore this message.
+`
+
+func (h *handler) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		log.Error("[ForgotPassword] Could not parse form")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Could not parse parameters"))
+		return
+	}
+
+	username := r.Form.Get("username")
+	if username == "" {
+		log.Error("[ForgotPassword] Empty username")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Username empty"))
+		return
+	}
+
+	// the response is the same for unknown users and the token is sent in the background,
+	// so neither the response nor its timing can be used to find user names
+	user, err := store.UserByUsername(username)
+	if err != nil {
+		log.Errorf("[ForgotPassword] Error loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch {
+	case user == nil:
+		log.Errorf("[ForgotPassword] Password reset requested for unknown user %s", username)
+	case user.Email == "":
+		log.Errorf("[ForgotPassword] User with id %d has no email address", user.ID)
+	case h.config.Notifier == nil:
+		log.Errorf("[ForgotPassword] No notifier configured, reset token for user with id %d not sent", user.ID)
+	default:
+		go h.sendPasswordReset(h.config.Notifier, user)
+	}
+
+	renderResult(w, r, http.StatusNoContent, nil)
+}
+
+// sendPasswordReset creates a reset token and mails it to the user. It outlives the request,
+// so it does not use its context, and failures are only logged.
+func (h *handler) sendPasswordReset(notifier notify.Notifier, user *model.User) {
+	token, tokenHash := auth.OpaqueToken()
+	expiresAt := time.Now().Add(passwordResetTokenValidity)
+	if err := h.store.CreatePasswordResetToken(user.ID, tokenHash, expiresAt); err != nil {
+		log.Errorf("[ForgotPassword] Error in reset token creation from the database: %v", err)
+		return
+	}
+
+	err := notifier.Send(&notify.Message{
+		To:      user.Email,
+		Subject: "Reset your bookstore password",
+		Body:    fmt.Sprintf(passwordResetBody, user.Username, expiresAt.Format(time.RFC1123), token),
+	})
+	if err != nil {
+		log.Errorf("[ForgotPassword] Error sending the reset token: %v", err)
+	}
+}
+
+func (h *handler) resetPassword(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		log.Error("[ResetPassword] Could not parse form")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Could not parse parameters"))
+		return
+	}
+
+	token := r.Form.Get("token")
+	password := r.Form.Get("password")
+	if token == "" || password == "" {
+		log.Error("[ResetPassword] Empty token or password")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Token or password empty"))
+		return
+	}
+
+	stored, err := store.PasswordResetTokenByHash(auth.HashToken(token))
+	if err != nil {
+		log.Errorf("[ResetPassword] Error loading the reset token from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if stored == nil || stored.Used || time.Now().After(stored.ExpiresAt) {
+		log.Error("[ResetPassword] Unknown, used or expired reset token")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid reset token"))
+		return
+	}
+
+	user, err := store.UserByID(stored.UserID)
+	if err != nil {
+		log.Errorf("[ResetPassword] Could not load user %d: %v", stored.UserID, err)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid reset token"))
+		return
+	}
+
+	if err := validator.ValidatePassword(user, password); isValidationError(err) {
+		log.Errorf("[ResetPassword] Validation error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	} else if err != nil {
+		log.Errorf("[ResetPassword] Error validating the password: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the token is only consumed together with the new password, a failed update keeps it valid
+	used := false
+	user.Password = password
+	err = store.WithTx(func(tx storage.Store) error {
+		var err error
+		used, err = tx.UsePasswordResetToken(stored.ID)
+		if err != nil || !used {
+			return err
+		}
+		return tx.UpdateUser(user)
+	})
+	if err != nil {
+		log.Errorf("[ResetPassword] Error resetting the password in the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !used {
+		log.Error("[ResetPassword] Reset token was used concurrently")
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Invalid reset token"))
+		return
+	}
+
+	// proving access to the mailbox also lifts a lockout
+	if err := store.DeleteLoginThrottle(auth.UserThrottleSubject(user.Username)); err != nil {
+		log.Errorf("[ResetPassword] Could not reset login throttle: %v", err)
+	}
+
+	log.Infof("[ResetPassword] Password of user with id %d reset", user.ID)
+	h.audit.recordUser(r, user, http.StatusNoContent, "password reset")
+	renderResult(w, r, http.StatusNoContent, nil)
+}
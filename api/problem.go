@@ -0,0 +1,186 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"bookstore/storage"
+	"bookstore/validator"
+
+	"github.com/unrolled/render"
+)
+
+// problemTypePrefix starts the type of problems with a code of their own. Problems,
+// which are described by their status alone, have the type about:blank as defined by RFC 7807.
+const problemTypePrefix = "urn:bookstore:problem:"
+
+// validationFailed is the code of validation errors with violations of different rules.
+const validationFailed = "validation_failed"
+
+// problem is an error response with the problem details of RFC 7807. Code is a machine-readable
+// code of the problem and InvalidParams lists the fields of the request, which failed the validation.
+type problem struct {
+	XMLName       xml.Name      `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type          string        `json:"type" xml:"type"`
+	Title         string        `json:"title" xml:"title"`
+	Status        int           `json:"status" xml:"status"`
+	Detail        string        `json:"detail,omitempty" xml:"detail,omitempty"`
+	Instance      string        `json:"instance,omitempty" xml:"instance,omitempty"`
+	Code          string        `json:"code" xml:"code"`
+	InvalidParams invalidParams `json:"invalid_params,omitempty" xml:"invalid_params,omitempty"`
+}
+
+// invalidParam is a field of the request, which failed the validation, the reason as code
+// and the params of the failed rule.
+type invalidParam struct {
+	Name   string       `json:"name" xml:"name"`
+	Reason string       `json:"reason" xml:"reason"`
+	Params invalidRules `json:"params,omitempty" xml:"params,omitempty"`
+}
+
+type invalidParams []invalidParam
+
+// MarshalXML encodes the params as <i> elements, like arrays in Appendix A of RFC 7807.
+func (p invalidParams) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Params []invalidParam `xml:"i"`
+	}{p}, start)
+}
+
+type invalidRules map[string]string
+
+// MarshalXML encodes the params of a rule as elements named like the params, sorted by name.
+func (p invalidRules) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := e.EncodeElement(p[name], xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// errToObjectError returns the problem of an error. Validation errors list every invalid
+// field in the invalid params, their code becomes the code of the problem, if they share one.
+func errToObjectError(err error) *problem {
+	p := &problem{Detail: err.Error()}
+	var errs validator.ValidationErrors
+	var single *validator.ValidationError
+	switch {
+	case errors.As(err, &errs):
+	case errors.As(err, &single):
+		errs = validator.ValidationErrors{single}
+	default:
+		return p
+	}
+
+	p.Code = errs[0].Code
+	for _, e := range errs {
+		if e.Code != p.Code {
+			p.Code = validationFailed
+		}
+		p.InvalidParams = append(p.InvalidParams, invalidParam{Name: e.Field, Reason: e.Code, Params: e.Params})
+	}
+	return p
+}
+
+// isValidationError reports whether err holds violations of rules by the request. Validators
+// also return errors of the storage or the breached password check, which are rendered by errorResult.
+func isValidationError(err error) bool {
+	var errs validator.ValidationErrors
+	var single *validator.ValidationError
+	return errors.As(err, &errs) || errors.As(err, &single)
+}
+
+func strToObjectError(err string) *problem {
+	return &problem{Detail: err}
+}
+
+// storageErrors are the statuses of the kinds of storage errors.
+var storageErrors = []struct {
+	kind    error
+	status  int
+	message string
+}{
+	{storage.ErrNotFound, http.StatusNotFound, "Resource Not Found"},
+	{storage.ErrConflict, http.StatusConflict, "Resource Conflict"},
+	{storage.ErrInvalid, http.StatusUnprocessableEntity, "Unprocessable Entity"},
+}
+
+// errorResult returns the status and the problem of an error passed to renderResult. The kind of
+// a storage error decides the status, other errors keep it, but server errors hide their details.
+func errorResult(status int, err error) (int, *problem) {
+	for _, e := range storageErrors {
+		if errors.Is(err, e.kind) {
+			return e.status, strToObjectError(e.message)
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		return status, strToObjectError("Server Error")
+	}
+	return status, errToObjectError(err)
+}
+
+// statusCode returns the code of problems without a code of their own, e.g. not_found.
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// renderProblem renders the problem as application/problem+xml, if the request accepts XML,
+// and as application/problem+json otherwise, also if the Accept header could not be parsed.
+func renderProblem(w http.ResponseWriter, r *http.Request, status int, p *problem) {
+	p.Status = status
+	p.Title = http.StatusText(status)
+	p.Instance = r.URL.Path
+	if p.Code == "" {
+		p.Code = statusCode(status)
+		p.Type = "about:blank"
+	} else {
+		p.Type = problemTypePrefix + p.Code
+	}
+
+	render := render.New(render.Options{
+		JSONContentType: ApplicationProblemJSON,
+		XMLContentType:  ApplicationProblemXML,
+	})
+	if accept, err := requestAccept(r); err == nil {
+		switch accept.Type + "/" + accept.Subtype {
+		case AppicationXML, TextXML, ApplicationProblemXML:
+			render.XML(w, status, p)
+			return
+		}
+	}
+	render.JSON(w, status, p)
+}
+
+// problemHandler answers every request with a problem of the status, e.g. for unknown routes.
+func problemHandler(status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renderProblem(w, r, status, &problem{})
+	})
+}
@@ -0,0 +1,39 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (h *handler) listRoles(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	_, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[ListRoles] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	roles, err := store.Roles()
+	if err != nil {
+		log.Errorf("[ListRoles] Error in listing roles from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	renderResult(w, r, http.StatusOK, roles)
+}
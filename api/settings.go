@@ -0,0 +1,96 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"bookstore/model"
+	"bookstore/policy"
+	"bookstore/validator"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (h *handler) getSettings(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[GetSettings] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if !policy.CanManageSettings(ru) {
+		log.Errorf("[GetSettings] User with id %d tried to view the settings", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	settings, err := store.Settings()
+	if err != nil {
+		log.Errorf("[GetSettings] Error loading the settings from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, settings)
+}
+
+func (h *handler) updateSettings(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[UpdateSettings] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if !policy.CanManageSettings(ru) {
+		log.Errorf("[UpdateSettings] User with id %d tried to change the settings", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	var modificationRequest model.SettingsModificationRequest
+	if err := unmarshalRequestObject(w, r, &modificationRequest); err != nil {
+		log.Errorf("[UpdateSettings] JSON decoding error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	if err := validator.ValidateSettingsModification(&modificationRequest); err != nil {
+		log.Errorf("[UpdateSettings] Validation error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	settings, err := store.Settings()
+	if err != nil {
+		log.Errorf("[UpdateSettings] Error loading the settings from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	modificationRequest.Patch(settings)
+
+	if err := store.UpdateSettings(settings); err != nil {
+		log.Errorf("[UpdateSettings] Error storing the settings: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, settings)
+}
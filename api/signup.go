@@ -0,0 +1,179 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"bookstore/model"
+	"bookstore/policy"
+	"bookstore/storage"
+	"bookstore/validator"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (h *handler) signup(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	var userCreationRequest model.UserCreationRequest
+	if err := unmarshalRequestObject(w, r, &userCreationRequest); err != nil {
+		log.Errorf("[Signup] JSON decoding error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	// users signing up themselves never choose their permissions
+	userCreationRequest.IsAdmin = false
+	userCreationRequest.Role = model.DefaultRole
+
+	var validationErr error
+	var u *model.User
+	err := store.WithTx(func(tx storage.Store) error {
+		if validationErr = validator.ValidateUserCreation(tx, &userCreationRequest); validationErr != nil {
+			return validationErr
+		}
+
+		settings, err := tx.Settings()
+		if err != nil {
+			return err
+		}
+
+		userCreationRequest.Status = model.UserStatusPending
+		if settings.SignupApproval == model.SignupApprovalAuto {
+			userCreationRequest.Status = model.UserStatusActive
+		}
+
+		u, err = tx.CreateUser(&userCreationRequest)
+		return err
+	})
+	if isValidationError(validationErr) {
+		log.Errorf("[Signup] Validation error: %v", validationErr)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(validationErr))
+		return
+	}
+	if err != nil {
+		log.Errorf("[Signup] Error in user creation from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Infof("[Signup] User %s signed up with status %s", u.Username, u.Status)
+	h.sendEmailConfirmation(r.Context(), u)
+	renderResult(w, r, http.StatusCreated, u)
+}
+
+func (h *handler) listPendingUsers(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[ListPendingUsers] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if !policy.CanManageUsers(ru) {
+		log.Errorf("[ListPendingUsers] User with id %d is not allowed to list pending users", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	users, err := store.PendingUsers()
+	if err != nil {
+		log.Errorf("[ListPendingUsers] Error in listing users from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, users)
+}
+
+func (h *handler) approveUser(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[ApproveUser] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if !policy.CanManageUsers(ru) {
+		log.Errorf("[ApproveUser] User with id %d tried to approve a user", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+	user, err := store.UserByID(userID)
+	if err != nil {
+		log.Errorf("[ApproveUser] Error in loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if user.Status != model.UserStatusPending {
+		log.Errorf("[ApproveUser] No pending user with id %d found", userID)
+		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		return
+	}
+
+	if err := store.SetUserStatus(user.ID, model.UserStatusActive); err != nil {
+		log.Errorf("[ApproveUser] Error in approving the user in the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	user.Status = model.UserStatusActive
+
+	log.Infof("[ApproveUser] User with id %d approved by user with id %d", user.ID, ru.ID)
+	renderResult(w, r, http.StatusOK, user)
+}
+
+func (h *handler) rejectUser(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[RejectUser] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	if !policy.CanManageUsers(ru) {
+		log.Errorf("[RejectUser] User with id %d tried to reject a user", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+	user, err := store.UserByID(userID)
+	if err != nil {
+		log.Errorf("[RejectUser] Error in loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if user.Status != model.UserStatusPending {
+		log.Errorf("[RejectUser] No pending user with id %d found", userID)
+		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		return
+	}
+
+	if err := store.DeleteUser(user.ID); err != nil {
+		log.Errorf("[RejectUser] Error in deleting the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Infof("[RejectUser] User with id %d rejected by user with id %d", user.ID, ru.ID)
+	renderResult(w, r, http.StatusNoContent, nil)
+}
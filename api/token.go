@@ -0,0 +1,158 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/policy"
+	"bookstore/storage"
+	"bookstore/validator"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (h *handler) listUserTokens(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[ListUserTokens] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+
+	if !policy.CanManageTokens(ru, userID) {
+		log.Errorf("[ListUserTokens] User with id %d tried to list tokens of another user", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	tokens, err := store.PersonalAccessTokens(userID)
+	if err != nil {
+		log.Errorf("[ListUserTokens] Error in loading the tokens from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, tokens)
+}
+
+func (h *handler) createUserToken(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[CreateUserToken] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+
+	user, err := store.UserByID(userID)
+	if err != nil {
+		log.Errorf("[CreateUserToken] Error loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !policy.CanCreateToken(ru, user.ID) {
+		log.Errorf("[CreateUserToken] User with id %d tried to create a token for another user", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	// a personal access token would outlive the impersonation
+	if actor := requestActor(r); actor != nil {
+		log.Errorf("[CreateUserToken] User %s acting as %s tried to create a token", actor.Username, ru.Username)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	var tokenCreationRequest model.PersonalAccessTokenCreationRequest
+	if err := unmarshalRequestObject(w, r, &tokenCreationRequest); err != nil {
+		log.Errorf("[CreateUserToken] JSON decoding error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	// a token can not create another token with more scopes than it has itself
+	granted := requestScopes(r)
+	if tokenCreationRequest.Scope == "" {
+		tokenCreationRequest.Scope = model.FormatScope(granted)
+	}
+
+	token, tokenHash := auth.PersonalAccessToken()
+	var validationErr error
+	var t *model.PersonalAccessToken
+	err = store.WithTx(func(tx storage.Store) error {
+		if validationErr = validator.ValidatePersonalAccessTokenCreation(tx, userID, &tokenCreationRequest, granted); validationErr != nil {
+			return validationErr
+		}
+		t, err = tx.CreatePersonalAccessToken(userID, tokenCreationRequest.Name, tokenHash, tokenCreationRequest.Scope)
+		return err
+	})
+	if isValidationError(validationErr) {
+		log.Errorf("[CreateUserToken] Validation error: %v", validationErr)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(validationErr))
+		return
+	}
+	if err != nil {
+		log.Errorf("[CreateUserToken] Error in token creation from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the token is only shown once, afterwards just its hash is known
+	t.Token = token
+	renderResult(w, r, http.StatusCreated, t)
+}
+
+func (h *handler) deleteUserToken(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[DeleteUserToken] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+	tokenID := routeInt64Param(r, "tokenID")
+
+	token, err := store.PersonalAccessTokenByIDAndUserID(userID, tokenID)
+	if err != nil {
+		log.Errorf("[DeleteUserToken] Error loading the token from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !policy.CanManageTokens(ru, token.UserID) {
+		log.Errorf("[DeleteUserToken] User with id %d tried to delete another user's token", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	err = store.DeletePersonalAccessToken(tokenID)
+	if err != nil {
+		log.Errorf("[DeleteUserToken] Error in token deletion from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	renderResult(w, r, http.StatusNoContent, nil)
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+	"bookstore/policy"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func (h *handler) enrolTOTP(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[EnrolTOTP] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+
+	if !policy.CanEnrolTOTP(ru, userID) {
+		log.Errorf("[EnrolTOTP] User with id %d tried to enrol TOTP for user %d", ru.ID, userID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	if ru.TOTPEnabled {
+		log.Errorf("[EnrolTOTP] User with id %d already enrolled TOTP", ru.ID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("TOTP already enabled"))
+		return
+	}
+
+	secret := auth.TOTPSecret()
+	if err := store.SetTOTPSecret(ru.ID, secret); err != nil {
+		log.Errorf("[EnrolTOTP] Error storing the TOTP secret: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusCreated, &model.TOTPEnrolment{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(secret, ru.Username),
+	})
+}
+
+func (h *handler) verifyTOTP(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[VerifyTOTP] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+
+	if !policy.CanEnrolTOTP(ru, userID) {
+		log.Errorf("[VerifyTOTP] User with id %d tried to verify TOTP of user %d", ru.ID, userID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	var verificationRequest model.TOTPVerificationRequest
+	if err := unmarshalRequestObject(w, r, &verificationRequest); err != nil {
+		log.Errorf("[VerifyTOTP] JSON decoding error: %v", err)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+		return
+	}
+
+	totp, err := store.UserTOTP(ru.ID)
+	if err != nil || totp == nil {
+		log.Errorf("[VerifyTOTP] Error loading the TOTP state from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if totp.Enabled {
+		log.Errorf("[VerifyTOTP] User with id %d already enrolled TOTP", ru.ID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("TOTP already enabled"))
+		return
+	}
+
+	if totp.Secret == "" {
+		log.Errorf("[VerifyTOTP] User with id %d did not start the TOTP enrolment", ru.ID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("TOTP enrolment not started"))
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, verificationRequest.Code, time.Now())
+	if !ok {
+		log.Errorf("[VerifyTOTP] Wrong TOTP code of user with id %d", ru.ID)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Code incorrect"))
+		return
+	}
+
+	codes, hashes := auth.RecoveryCodes()
+	if err := store.EnableTOTP(ru.ID, step, hashes); err != nil {
+		log.Errorf("[VerifyTOTP] Error enabling TOTP: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, &model.RecoveryCodes{Codes: codes})
+}
+
+func (h *handler) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[DisableTOTP] No user in context: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+
+	if !policy.CanDisableTOTP(ru, userID) {
+		log.Errorf("[DisableTOTP] User with id %d tried to disable TOTP of user %d", ru.ID, userID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	user, err := store.UserByID(userID)
+	if err != nil {
+		log.Errorf("[DisableTOTP] Error loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// only users managing users reset the enrolment of others without a code, e.g. after a lost device.
+	// Everybody else confirms with the second factor, so a stolen token can not remove it.
+	if user.TOTPEnabled && (ru.ID == user.ID || !policy.CanManageUsers(ru)) {
+		var confirmation model.TOTPVerificationRequest
+		if err := unmarshalRequestObject(w, r, &confirmation); err != nil {
+			log.Errorf("[DisableTOTP] JSON decoding error: %v", err)
+			renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+			return
+		}
+
+		attempt := h.beginLogin(w, r, user.Username)
+		if attempt == nil {
+			return
+		}
+
+		valid, err := h.checkSecondFactor(r.Context(), user.ID, confirmation.Code)
+		if err != nil {
+			log.Errorf("[DisableTOTP] Error checking the code: %v", err)
+			renderResult(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !valid {
+			log.Errorf("[DisableTOTP] Code of user %s not correct", user.Username)
+			h.failLogin(r.Context(), attempt)
+			h.audit.recordUser(r, user, http.StatusBadRequest, "code incorrect")
+			renderResult(w, r, http.StatusBadRequest, strToObjectError("Code incorrect"))
+			return
+		}
+	}
+
+	if err := store.DisableTOTP(user.ID); err != nil {
+		log.Errorf("[DisableTOTP] Error disabling TOTP: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderResult(w, r, http.StatusNoContent, nil)
+}
@@ -17,14 +17,18 @@ package api
 import (
 	"net/http"
 
+	"bookstore/auth"
 	"bookstore/model"
+	"bookstore/policy"
+	"bookstore/storage"
 	"bookstore/validator"
 
 	log "github.com/sirupsen/logrus"
 )
 
 func (h *handler) getUser(w http.ResponseWriter, r *http.Request) {
-	_, err := requestUser(r)
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[GetUser] No User in context: %v", err)
 		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
@@ -32,49 +36,69 @@ func (h *handler) getUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !policy.CanReadUsers(ru) {
+		log.Errorf("[GetUser] User with id %d is not allowed to read users", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
 	userID := routeInt64Param(r, "userID")
 
-	user, err := h.store.UserByID(userID)
+	user, err := store.UserByID(userID)
 	if err != nil {
 		log.Errorf("[GetUser] Error in loading the user from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
-		return
-	}
-
-	if user == nil {
-		log.Errorf("[GetUser] User with id %d not found", userID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
+	hideEmail(ru, user)
 	renderResult(w, r, http.StatusOK, user)
 }
 
+// hideEmail removes the email of the user, unless the actor may read it.
+func hideEmail(actor *model.User, user *model.User) {
+	if !policy.CanReadEmail(actor, user.ID) {
+		user.Email = ""
+		user.EmailVerified = false
+	}
+}
+
 func (h *handler) listUsers(w http.ResponseWriter, r *http.Request) {
-	_, err := requestUser(r)
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[ListUsers] No user in context: %v", err)
 		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
 		return
 	}
-	users, err := h.store.Users()
+
+	if !policy.CanReadUsers(ru) {
+		log.Errorf("[ListUsers] User with id %d is not allowed to read users", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+	users, err := store.Users()
 	if err != nil {
 		log.Errorf("[ListUsers] Error in listing users from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	for i := range users.Users {
+		hideEmail(ru, &users.Users[i])
+	}
 	renderResult(w, r, http.StatusOK, users)
 }
 
 func (h *handler) createUser(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[CreateUser] No user in context: %v", err)
 		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
 		return
 	}
-	if !ru.IsAdmin {
-		log.Errorf("[CreateUser] User %s is not admin", ru.Username)
+	if !policy.CanManageUsers(ru) {
+		log.Errorf("[CreateUser] User %s is not allowed to manage users", ru.Username)
 		renderResult(w, r, http.StatusUnauthorized, strToObjectError("Unauthorized"))
 		return
 	}
@@ -86,20 +110,32 @@ func (h *handler) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := validator.ValidateUserCreation(h.store, &userCreationRequest); err != nil {
-		log.Errorf("[CreateUser] Validation error: %v", err)
-		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+	var validationErr error
+	var u *model.User
+	err = store.WithTx(func(tx storage.Store) error {
+		if validationErr = validator.ValidateUserCreation(tx, &userCreationRequest); validationErr != nil {
+			return validationErr
+		}
+		u, err = tx.CreateUser(&userCreationRequest)
+		return err
+	})
+	if isValidationError(validationErr) {
+		log.Errorf("[CreateUser] Validation error: %v", validationErr)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(validationErr))
 		return
 	}
-	u, err := h.store.CreateUser(&userCreationRequest)
 	if err != nil {
 		log.Errorf("[CreateUser] Error in user creation from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
 	}
+	auditDetail(r, "created user %s with role %s", u.Username, u.Role)
+	h.sendEmailConfirmation(r.Context(), u)
 	renderResult(w, r, http.StatusCreated, u)
 }
 
 func (h *handler) updateUser(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[UpdateUser] No user in context: %v", err)
@@ -109,16 +145,10 @@ func (h *handler) updateUser(w http.ResponseWriter, r *http.Request) {
 
 	userID := routeInt64Param(r, "userID")
 
-	originalUser, err := h.store.UserByID(userID)
+	originalUser, err := store.UserByID(userID)
 	if err != nil {
 		log.Errorf("[UpdateUser] Error loading the user from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
-		return
-	}
-
-	if originalUser == nil {
-		log.Errorf("[UpdateUser] User with id %d not found", userID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -129,37 +159,50 @@ func (h *handler) updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !ru.IsAdmin {
-		if originalUser.ID != ru.ID {
-			log.Errorf("[UpdateUser] User with id %d tried to change another user", ru.ID)
-			renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
-			return
-		}
-
-		if userModificationRequest.IsAdmin != nil && *userModificationRequest.IsAdmin {
-			log.Errorf("[UpdateUser] User with id %d tried to become an admin", ru.ID)
-			renderResult(w, r, http.StatusBadRequest, strToObjectError("Normal users could not change their permissions"))
-			return
-		}
+	if !policy.CanEditUser(ru, originalUser.ID) {
+		log.Errorf("[UpdateUser] User with id %d tried to change another user", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
 	}
 
-	if validationErr := validator.ValidateUserModification(h.store, originalUser.ID, &userModificationRequest); validationErr != nil {
-		log.Errorf("[CreateUser] Validation error: %v", err)
-		renderResult(w, r, http.StatusBadRequest, errToObjectError(err))
+	originalRole := originalUser.Role
+	originalEmail := originalUser.Email
+	userModificationRequest.Patch(originalUser)
+	if originalUser.Role != originalRole && !policy.CanManageUsers(ru) {
+		log.Errorf("[UpdateUser] User with id %d tried to change the role to %s", ru.ID, originalUser.Role)
+		renderResult(w, r, http.StatusBadRequest, strToObjectError("Normal users could not change their permissions"))
 		return
 	}
 
-	userModificationRequest.Patch(originalUser)
-	if err = h.store.UpdateUser(originalUser); err != nil {
-		log.Errorf("[CreateUser] Error in user creation from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
+	var validationErr error
+	err = store.WithTx(func(tx storage.Store) error {
+		if validationErr = validator.ValidateUserModification(tx, originalUser.ID, &userModificationRequest); validationErr != nil {
+			return validationErr
+		}
+		return tx.UpdateUser(originalUser)
+	})
+	if isValidationError(validationErr) {
+		log.Errorf("[UpdateUser] Validation error: %v", validationErr)
+		renderResult(w, r, http.StatusBadRequest, errToObjectError(validationErr))
 		return
 	}
+	if err != nil {
+		log.Errorf("[UpdateUser] Error in user update from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if originalUser.Email != originalEmail {
+		// the storage resets the confirmation of a changed email
+		originalUser.EmailVerified = false
+		h.sendEmailConfirmation(r.Context(), originalUser)
+	}
 
+	auditDetail(r, "updated user %s, role %s, password changed: %t", originalUser.Username, originalUser.Role, userModificationRequest.Password != nil)
 	renderResult(w, r, http.StatusOK, originalUser)
 }
 
 func (h *handler) deleteUser(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
 	ru, err := requestUser(r)
 	if err != nil {
 		log.Errorf("[DeleteUser] No user in context: %v", err)
@@ -167,23 +210,17 @@ func (h *handler) deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !ru.IsAdmin {
+	if !policy.CanManageUsers(ru) {
 		log.Errorf("[DeleteUser] User with id %d tried to delete another user", ru.ID)
 		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
 		return
 	}
 
 	userID := routeInt64Param(r, "userID")
-	userDelete, err := h.store.UserByID(userID)
+	userDelete, err := store.UserByID(userID)
 	if err != nil {
 		log.Errorf("[DeleteUser] Error in loading the user from the database: %v", err)
-		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
-		return
-	}
-
-	if userDelete == nil {
-		log.Errorf("[DeleteUser] User with id %d not found", userID)
-		renderResult(w, r, http.StatusNotFound, strToObjectError("Resource Not Found"))
+		renderResult(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -193,12 +230,48 @@ func (h *handler) deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.store.DeleteUser(userID)
+	err = store.DeleteUser(userID)
 	if err != nil {
 		log.Errorf("[DeleteUser] Error in deleting the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	auditDetail(r, "deleted user %s", userDelete.Username)
+
+	renderResult(w, r, http.StatusNoContent, nil)
+}
+
+func (h *handler) unlockUser(w http.ResponseWriter, r *http.Request) {
+	store := h.store.WithContext(r.Context())
+	ru, err := requestUser(r)
+	if err != nil {
+		log.Errorf("[UnlockUser] No user in context: %v", err)
 		renderResult(w, r, http.StatusInternalServerError, strToObjectError("Server Error"))
 		return
 	}
 
+	if !policy.CanManageUsers(ru) {
+		log.Errorf("[UnlockUser] User with id %d tried to unlock another user", ru.ID)
+		renderResult(w, r, http.StatusForbidden, strToObjectError("Access Forbidden"))
+		return
+	}
+
+	userID := routeInt64Param(r, "userID")
+	user, err := store.UserByID(userID)
+	if err != nil {
+		log.Errorf("[UnlockUser] Error in loading the user from the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := store.DeleteLoginThrottle(auth.UserThrottleSubject(user.Username)); err != nil {
+		log.Errorf("[UnlockUser] Error in unlocking the user in the database: %v", err)
+		renderResult(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Infof("[UnlockUser] User with id %d unlocked by user with id %d", user.ID, ru.ID)
+	auditDetail(r, "unlocked user %s", user.Username)
 	renderResult(w, r, http.StatusNoContent, nil)
 }
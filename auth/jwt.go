@@ -16,17 +16,23 @@ package auth
 
 import (
 	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/form3tech-oss/jwt-go"
 )
 
-var hmacKey []byte
-var signingMethod *jwt.SigningMethodHMAC
+var (
+	keyringMu sync.RWMutex
+	keyring   *Keyring
+)
 
 func init() {
-	hmacKey = generateRandomBytes(64)
-	signingMethod = jwt.SigningMethodHS512
+	// without a configured keyring tokens are signed with an ephemeral key,
+	// which is only valid until the process restarts
+	keyring, _ = NewKeyring(Key{ID: "ephemeral", Secret: generateRandomBytes(64)})
 }
 
 func generateRandomBytes(size int) []byte {
@@ -38,24 +44,107 @@ func generateRandomBytes(size int) []byte {
 	return b
 }
 
-func JWTToken(username string, validity time.Time) (string, error) {
-	claims := &jwt.StandardClaims{
-		ExpiresAt: validity.Unix(),
-		Issuer:    "bookstore",
-		IssuedAt:  time.Now().Unix(),
-		NotBefore: time.Now().Unix(),
-		Subject:   username,
+// SetKeyring replaces the keys used to sign and verify tokens.
+func SetKeyring(k *Keyring) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keyring = k
+}
+
+func currentKeyring() *Keyring {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	return keyring
+}
+
+// Claims are the claims of the issued tokens.
+type Claims struct {
+	jwt.StandardClaims
+	// UserID must match the id of the user with the subject as user name, so the token
+	// does not pass to a later user, who got the user name of a deleted one.
+	UserID int64 `json:"uid"`
+	// TokenVersion must match the version of the user, raising it invalidates all issued tokens.
+	TokenVersion int64 `json:"ver"`
+	// Scope is the space separated list of scopes, the token may be used for.
+	Scope string `json:"scope,omitempty"`
+	// Actor is set, if the token was issued to another user acting as the subject (RFC 8693).
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Actor identifies the user, who acts on behalf of the subject of a token.
+type Actor struct {
+	Subject string `json:"sub"`
+	UserID  int64  `json:"uid"`
+}
+
+func JWTToken(userID int64, username string, tokenVersion int64, scope string, validity time.Time) (string, error) {
+	return signClaims(newClaims(userID, username, tokenVersion, scope, validity))
+}
+
+// ImpersonationToken returns a token of the user, which carries the acting user in the act claim.
+func ImpersonationToken(userID int64, username string, tokenVersion int64, scope string, actorID int64, actor string, validity time.Time) (string, error) {
+	claims := newClaims(userID, username, tokenVersion, scope, validity)
+	claims.Actor = &Actor{Subject: actor, UserID: actorID}
+	return signClaims(claims)
+}
+
+func newClaims(userID int64, username string, tokenVersion int64, scope string, validity time.Time) *Claims {
+	return &Claims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: validity.Unix(),
+			Id:        hex.EncodeToString(generateRandomBytes(16)),
+			Issuer:    "bookstore",
+			IssuedAt:  time.Now().Unix(),
+			NotBefore: time.Now().Unix(),
+			Subject:   username,
+		},
+		UserID:       userID,
+		TokenVersion: tokenVersion,
+		Scope:        scope,
 	}
+}
 
-	token := jwt.NewWithClaims(signingMethod, claims)
+func signClaims(claims *Claims) (string, error) {
+	key := currentKeyring().SigningKey()
+	token := jwt.NewWithClaims(key.Method(), claims)
+	token.Header["kid"] = key.ID
 
-	return token.SignedString(hmacKey)
+	return token.SignedString(key.signingKey())
 }
 
-func HMACKey() []byte {
-	return hmacKey
+// ValidationKey returns the verification key for the kid header of the token.
+// It is meant to be used as ValidationKeyGetter of the jwt middleware.
+// As the keyring may mix algorithms, the algorithm of the token has to match
+// the one of the key, otherwise e.g. an RSA public key could be used as HMAC secret.
+func ValidationKey(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("token without kid header")
+	}
+
+	key, ok := currentKeyring().Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if token.Method.Alg() != key.Method().Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+	}
+
+	return key.verificationKey(), nil
 }
 
-func SigningMethod() *jwt.SigningMethodHMAC {
-	return signingMethod
+// ParseToken verifies the signature and the time claims of a token and returns its claims.
+func ParseToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, ValidationKey)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	return claims, nil
 }
@@ -0,0 +1,220 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/form3tech-oss/jwt-go"
+)
+
+// KeysEnvVar is the environment variable holding the signing keys, if no key file is given.
+const KeysEnvVar = "BOOKSTORE_JWT_KEYS"
+
+const (
+	minKeySize    = 32
+	minRSAKeyBits = 2048
+	pemFilePrefix = "file:"
+)
+
+// Key is a named signing key. Either Secret is set for HMAC signatures,
+// or Private holds an *rsa.PrivateKey or ed25519.PrivateKey.
+type Key struct {
+	ID      string
+	Secret  []byte
+	Private crypto.Signer
+}
+
+// Method returns the signing method matching the type of the key.
+func (k Key) Method() jwt.SigningMethod {
+	switch k.Private.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		return SigningMethodEdDSA
+	}
+	return jwt.SigningMethodHS512
+}
+
+func (k Key) signingKey() interface{} {
+	if k.Private != nil {
+		return k.Private
+	}
+	return k.Secret
+}
+
+func (k Key) verificationKey() interface{} {
+	if k.Private != nil {
+		return k.Private.Public()
+	}
+	return k.Secret
+}
+
+func (k Key) validate() error {
+	switch p := k.Private.(type) {
+	case nil:
+		if len(k.Secret) < minKeySize {
+			return fmt.Errorf("keyring: key %q is shorter than %d bytes", k.ID, minKeySize)
+		}
+	case *rsa.PrivateKey:
+		if p.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("keyring: RSA key %q is shorter than %d bits", k.ID, minRSAKeyBits)
+		}
+	case ed25519.PrivateKey:
+	default:
+		return fmt.Errorf("keyring: key %q has unsupported type %T", k.ID, k.Private)
+	}
+
+	return nil
+}
+
+// Keyring holds the keys used to sign and verify tokens.
+// The first key signs new tokens, all keys are accepted for verification,
+// so retired keys can stay in the ring until the tokens signed with them expire.
+type Keyring struct {
+	keys []Key
+}
+
+// NewKeyring returns a keyring, the first key is the signing key.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring: no keys given")
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if k.ID == "" {
+			return nil, fmt.Errorf("keyring: key without id")
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("keyring: duplicate key id %q", k.ID)
+		}
+		if err := k.validate(); err != nil {
+			return nil, err
+		}
+		seen[k.ID] = true
+	}
+
+	return &Keyring{keys: keys}, nil
+}
+
+// ParseKeyring reads keys separated by new lines or commas. An entry is either
+// "kid:base64-secret" for HMAC or "kid:file:/path/key.pem" for a PEM encoded
+// RSA or Ed25519 private key. Empty lines and lines starting with # are ignored.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var keys []Key
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		for _, entry := range strings.Split(scanner.Text(), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+
+			parts := strings.SplitN(entry, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("keyring: invalid entry, expected kid:secret")
+			}
+			kid, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+			if strings.HasPrefix(value, pemFilePrefix) {
+				private, err := loadPrivateKey(strings.TrimPrefix(value, pemFilePrefix))
+				if err != nil {
+					return nil, fmt.Errorf("keyring: key %q: %v", kid, err)
+				}
+				keys = append(keys, Key{ID: kid, Private: private})
+				continue
+			}
+
+			secret, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("keyring: key %q is not valid base64: %v", kid, err)
+			}
+
+			keys = append(keys, Key{ID: kid, Secret: secret})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("keyring: %v", err)
+	}
+
+	return NewKeyring(keys...)
+}
+
+// LoadKeyringFile reads a keyring from a file, see ParseKeyring for the format.
+func LoadKeyringFile(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: %v", err)
+	}
+
+	return ParseKeyring(data)
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// SigningKey returns the key used for new tokens.
+func (k *Keyring) SigningKey() Key {
+	return k.keys[0]
+}
+
+// Lookup returns the key with the given key id.
+func (k *Keyring) Lookup(kid string) (Key, bool) {
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+
+	return Key{}, false
+}
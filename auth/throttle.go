@@ -0,0 +1,94 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"strings"
+	"time"
+
+	"bookstore/model"
+)
+
+// ThrottlePolicy describes how failed logins delay further attempts.
+type ThrottlePolicy struct {
+	// FreeAttempts is the number of failures, which are not delayed
+	FreeAttempts int
+	// BaseDelay is doubled with every failure after the free attempts, up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter failures the subject is locked for LockoutDuration, 0 disables the lockout
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// ResetAfter without failures the counter starts again
+	ResetAfter time.Duration
+}
+
+// UserThrottle is applied per user name. It locks the account after repeated failures.
+var UserThrottle = ThrottlePolicy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Minute,
+	LockoutAfter:    10,
+	LockoutDuration: 30 * time.Minute,
+	ResetAfter:      24 * time.Hour,
+}
+
+// IPThrottle is applied per client address. It only delays, as many users may share an address.
+var IPThrottle = ThrottlePolicy{
+	FreeAttempts: 20,
+	BaseDelay:    time.Second,
+	MaxDelay:     15 * time.Minute,
+	ResetAfter:   time.Hour,
+}
+
+// UserThrottleSubject returns the throttle subject of the user name.
+func UserThrottleSubject(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// IPThrottleSubject returns the throttle subject of the client address.
+func IPThrottleSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// Fail records a failed login at the given time and returns the updated throttle.
+// The throttle may be nil, if the subject had no failures yet.
+func (p ThrottlePolicy) Fail(throttle *model.LoginThrottle, subject string, now time.Time) *model.LoginThrottle {
+	if throttle == nil || now.Sub(throttle.LastFailureAt) > p.ResetAfter {
+		throttle = &model.LoginThrottle{Subject: subject}
+	}
+
+	throttle.Failures++
+	throttle.LastFailureAt = now
+
+	if p.LockoutAfter > 0 && throttle.Failures >= p.LockoutAfter {
+		throttle.Locked = true
+		throttle.BlockedUntil = now.Add(p.LockoutDuration)
+		return throttle
+	}
+
+	if throttle.Failures > p.FreeAttempts {
+		delay := p.BaseDelay
+		for i := p.FreeAttempts + 1; i < throttle.Failures && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+		throttle.BlockedUntil = now.Add(delay)
+	}
+
+	return throttle
+}
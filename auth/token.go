@@ -0,0 +1,55 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// OpaqueToken returns a new random token, which is handed out to the client,
+// and its hash, which is stored.
+func OpaqueToken() (string, string) {
+	token := base64.RawURLEncoding.EncodeToString(generateRandomBytes(32))
+	return token, HashToken(token)
+}
+
+// HashToken returns the hash under which an opaque token is stored.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenFamily returns a new random id for a family of refresh tokens.
+func TokenFamily() string {
+	return hex.EncodeToString(generateRandomBytes(16))
+}
+
+// PersonalAccessTokenPrefix marks personal access tokens, so they can be told apart from JWTs.
+const PersonalAccessTokenPrefix = "bspat_"
+
+// PersonalAccessToken returns a new personal access token and its hash.
+func PersonalAccessToken() (string, string) {
+	token, _ := OpaqueToken()
+	token = PersonalAccessTokenPrefix + token
+	return token, HashToken(token)
+}
+
+// IsPersonalAccessToken reports whether the bearer token is a personal access token.
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
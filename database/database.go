@@ -15,16 +15,48 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 
 	// sqlite driver import
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// NewDatabaseConnection connects to the sqlite database.
+// Driver names the database system behind a connection.
+type Driver string
+
+// List of supported database drivers.
+const (
+	DriverSQLite   Driver = "sqlite3"
+	DriverPostgres Driver = "postgres"
+)
+
+// DSNEnvVar is the environment variable holding the data source name, if none is given on the command line.
+// It keeps the database password out of the process list.
+const DSNEnvVar = "BOOKSTORE_DATABASE"
+
+// migrationLockID is the PostgreSQL advisory lock held while migrating,
+// so replicas started at the same time do not run the migrations twice.
+const migrationLockID = 0x626f6f6b
+
+// Open connects to the database of the data source name. postgres:// and postgresql:// URLs
+// connect to PostgreSQL, everything else is the path of a SQLite file, optionally prefixed with sqlite://.
+func Open(dsn string) (*sql.DB, Driver, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		db, err := NewPostgresConnection(dsn)
+		return db, DriverPostgres, err
+	}
+
+	db, err := NewDatabaseConnection(strings.TrimPrefix(dsn, "sqlite://"))
+	return db, DriverSQLite, err
+}
+
+// NewDatabaseConnection connects to the sqlite database. Transactions take the write lock
+// when they begin, so concurrent units of work wait for each other instead of failing as busy.
 func NewDatabaseConnection(dfn string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "file:"+dfn+"?_fk=1")
+	db, err := sql.Open("sqlite3", "file:"+dfn+"?_fk=1&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
@@ -32,20 +64,63 @@ func NewDatabaseConnection(dfn string) (*sql.DB, error) {
 	return db, nil
 }
 
+// NewPostgresConnection connects to the PostgreSQL database.
+// The driver is only linked into binaries built with the postgres build tag.
+func NewPostgresConnection(dsn string) (*sql.DB, error) {
+	if !driverRegistered(DriverPostgres) {
+		return nil, fmt.Errorf("PostgreSQL support is not compiled in, build with -tags postgres")
+	}
+
+	return sql.Open(string(DriverPostgres), dsn)
+}
+
+func driverRegistered(driver Driver) bool {
+	for _, name := range sql.Drivers() {
+		if name == string(driver) {
+			return true
+		}
+	}
+	return false
+}
+
+func driverMigrations(driver Driver) []func(tx *sql.Tx) error {
+	if driver == DriverPostgres {
+		return postgresMigrations
+	}
+	return migrations
+}
+
 // CurrentDBSchema checks if the database schema is up to date.
-func CurrentDBSchema(db *sql.DB) error {
+func CurrentDBSchema(db *sql.DB, driver Driver) error {
 	var currentVersion int
 	db.QueryRow(`SELECT version FROM schema_version`).Scan(&currentVersion)
-	if currentVersion < schemaVersion {
+	if schemaVersion := len(driverMigrations(driver)); currentVersion < schemaVersion {
 		return fmt.Errorf(`the database schema is not up to date: current=v%d expected=v%d`, currentVersion, schemaVersion)
 	}
 	return nil
 }
 
 // Migrate executes database migrations.
-func Migrate(db *sql.DB) error {
+func Migrate(db *sql.DB, driver Driver) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("[Migration] %v", err)
+	}
+	defer conn.Close()
+
+	if driver == DriverPostgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return fmt.Errorf("[Migration] %v", err)
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+	}
+
+	migrations := driverMigrations(driver)
+	schemaVersion := len(migrations)
+
 	var currentVersion int
-	db.QueryRow(`SELECT version FROM schema_version`).Scan(&currentVersion)
+	conn.QueryRowContext(ctx, `SELECT version FROM schema_version`).Scan(&currentVersion)
 
 	fmt.Println("-> Current schema version:", currentVersion)
 	fmt.Println("-> Latest schema version:", schemaVersion)
@@ -54,7 +129,7 @@ func Migrate(db *sql.DB) error {
 		newVersion := version + 1
 		fmt.Println("* Migrating to version:", newVersion)
 
-		tx, err := db.Begin()
+		tx, err := conn.BeginTx(ctx, nil)
 		if err != nil {
 			return fmt.Errorf("[Migration v%d] %v", newVersion, err)
 		}
@@ -18,8 +18,6 @@ import (
 	"database/sql"
 )
 
-var schemaVersion = len(migrations)
-
 // Order is important. Add new migrations at the end of the list.
 var migrations = []func(tx *sql.Tx) error {
 	func(tx *sql.Tx) (err error) {
@@ -50,4 +48,228 @@ var migrations = []func(tx *sql.Tx) error {
 		_, err = tx.Exec(sql)
 		return err
 	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			CREATE TABLE refresh_tokens (
+				refresh_token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				family_id TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL,
+				used INTEGER NOT NULL DEFAULT '0',
+				revoked INTEGER NOT NULL DEFAULT '0'
+			);
+
+			CREATE INDEX refresh_tokens_family_idx ON refresh_tokens(family_id);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT '0';
+
+			CREATE TABLE denied_tokens (
+				jti TEXT PRIMARY KEY,
+				expires_at DATETIME NOT NULL
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			CREATE TABLE personal_access_tokens (
+				token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				name TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				created_at DATETIME NOT NULL,
+				last_used_at DATETIME,
+				UNIQUE (user_id, name)
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			CREATE TABLE roles (
+				role_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE
+			);
+
+			CREATE TABLE role_permissions (
+				role_id INTEGER NOT NULL REFERENCES roles(role_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				permission TEXT NOT NULL,
+				PRIMARY KEY (role_id, permission)
+			);
+
+			INSERT INTO roles (name) VALUES ('admin'), ('editor'), ('author'), ('reader');
+
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'users:read' FROM roles;
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'users:manage' FROM roles WHERE name = 'admin';
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'books:write:any' FROM roles WHERE name IN ('admin', 'editor');
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'books:write:own' FROM roles WHERE name IN ('admin', 'editor', 'author');
+
+			ALTER TABLE users ADD COLUMN role_id INTEGER REFERENCES roles(role_id);
+
+			UPDATE users SET role_id = (
+				SELECT role_id FROM roles WHERE name = CASE WHEN users.is_admin THEN 'admin' ELSE 'author' END
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			CREATE TABLE login_throttles (
+				subject TEXT PRIMARY KEY,
+				failures INTEGER NOT NULL DEFAULT '0',
+				last_failure_at DATETIME NOT NULL,
+				blocked_until DATETIME NOT NULL,
+				locked INTEGER NOT NULL DEFAULT '0'
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';
+
+			CREATE TABLE password_reset_tokens (
+				reset_token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL,
+				used INTEGER NOT NULL DEFAULT '0'
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+			ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT '0';
+			ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT '0';
+
+			CREATE TABLE recovery_codes (
+				recovery_code_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				code_hash TEXT NOT NULL,
+				used INTEGER NOT NULL DEFAULT '0',
+				UNIQUE (user_id, code_hash)
+			);
+
+			CREATE TABLE mfa_challenges (
+				challenge_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL
+			);
+
+			CREATE TABLE settings (
+				name TEXT PRIMARY KEY,
+				value TEXT NOT NULL
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			CREATE TABLE user_identities (
+				identity_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				issuer TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				UNIQUE (issuer, subject)
+			);
+
+			CREATE TABLE oidc_logins (
+				login_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				state_hash TEXT NOT NULL UNIQUE,
+				nonce TEXT NOT NULL,
+				code_verifier TEXT NOT NULL,
+				expires_at DATETIME NOT NULL
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE users ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE refresh_tokens ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+			ALTER TABLE mfa_challenges ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+			ALTER TABLE personal_access_tokens ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			CREATE TABLE audit_events (
+				event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				created_at DATETIME NOT NULL,
+				actor_id INTEGER,
+				actor TEXT NOT NULL,
+				impersonator TEXT NOT NULL DEFAULT '',
+				action TEXT NOT NULL,
+				target TEXT NOT NULL,
+				ip TEXT NOT NULL,
+				outcome TEXT NOT NULL,
+				status INTEGER NOT NULL DEFAULT '0',
+				detail TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX audit_events_created_at ON audit_events (created_at);
+
+			CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+			BEGIN
+				SELECT RAISE(ABORT, 'audit_events is append-only');
+			END;
+
+			CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+			BEGIN
+				SELECT RAISE(ABORT, 'audit_events is append-only');
+			END;
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE oidc_logins ADD COLUMN user_id INTEGER REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE;
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT '0';
+
+			CREATE TABLE email_confirmation_tokens (
+				confirmation_token_id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				email TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at DATETIME NOT NULL,
+				used INTEGER NOT NULL DEFAULT '0'
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
 }
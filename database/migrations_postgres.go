@@ -0,0 +1,212 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+)
+
+// postgresMigrations create the same schema as the SQLite migrations, starting at its version 12.
+// Order is important. Add new migrations at the end of the list, together with the SQLite migration.
+var postgresMigrations = []func(tx *sql.Tx) error{
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			CREATE TABLE schema_version (
+				version INTEGER NOT NULL
+			);
+
+			CREATE TABLE roles (
+				role_id BIGSERIAL PRIMARY KEY,
+				name TEXT NOT NULL UNIQUE
+			);
+
+			CREATE TABLE role_permissions (
+				role_id BIGINT NOT NULL REFERENCES roles(role_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				permission TEXT NOT NULL,
+				PRIMARY KEY (role_id, permission)
+			);
+
+			INSERT INTO roles (name) VALUES ('admin'), ('editor'), ('author'), ('reader');
+
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'users:read' FROM roles;
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'users:manage' FROM roles WHERE name = 'admin';
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'books:write:any' FROM roles WHERE name IN ('admin', 'editor');
+			INSERT INTO role_permissions (role_id, permission)
+				SELECT role_id, 'books:write:own' FROM roles WHERE name IN ('admin', 'editor', 'author');
+
+			CREATE TABLE users (
+				user_id BIGSERIAL PRIMARY KEY,
+				username TEXT NOT NULL UNIQUE,
+				password TEXT NOT NULL,
+				pseudonym TEXT NOT NULL UNIQUE,
+				is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+				token_version BIGINT NOT NULL DEFAULT 0,
+				role_id BIGINT REFERENCES roles(role_id),
+				email TEXT NOT NULL DEFAULT '',
+				totp_secret TEXT NOT NULL DEFAULT '',
+				totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+				totp_last_step BIGINT NOT NULL DEFAULT 0,
+				status TEXT NOT NULL DEFAULT 'active'
+			);
+
+			CREATE TABLE books (
+				book_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				image_url TEXT NOT NULL,
+				title TEXT NOT NULL,
+				description TEXT NOT NULL,
+				price BIGINT NOT NULL,
+				UNIQUE (user_id, title)
+			);
+
+			CREATE TABLE refresh_tokens (
+				refresh_token_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				family_id TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at TIMESTAMPTZ NOT NULL,
+				used BOOLEAN NOT NULL DEFAULT FALSE,
+				revoked BOOLEAN NOT NULL DEFAULT FALSE,
+				scope TEXT NOT NULL DEFAULT ''
+			);
+
+			CREATE INDEX refresh_tokens_family_idx ON refresh_tokens(family_id);
+
+			CREATE TABLE denied_tokens (
+				jti TEXT PRIMARY KEY,
+				expires_at TIMESTAMPTZ NOT NULL
+			);
+
+			CREATE TABLE personal_access_tokens (
+				token_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				name TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				created_at TIMESTAMPTZ NOT NULL,
+				last_used_at TIMESTAMPTZ,
+				scope TEXT NOT NULL DEFAULT '',
+				UNIQUE (user_id, name)
+			);
+
+			CREATE TABLE login_throttles (
+				subject TEXT PRIMARY KEY,
+				failures BIGINT NOT NULL DEFAULT 0,
+				last_failure_at TIMESTAMPTZ NOT NULL,
+				blocked_until TIMESTAMPTZ NOT NULL,
+				locked BOOLEAN NOT NULL DEFAULT FALSE
+			);
+
+			CREATE TABLE password_reset_tokens (
+				reset_token_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at TIMESTAMPTZ NOT NULL,
+				used BOOLEAN NOT NULL DEFAULT FALSE
+			);
+
+			CREATE TABLE recovery_codes (
+				recovery_code_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				code_hash TEXT NOT NULL,
+				used BOOLEAN NOT NULL DEFAULT FALSE,
+				UNIQUE (user_id, code_hash)
+			);
+
+			CREATE TABLE mfa_challenges (
+				challenge_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at TIMESTAMPTZ NOT NULL,
+				scope TEXT NOT NULL DEFAULT ''
+			);
+
+			CREATE TABLE settings (
+				name TEXT PRIMARY KEY,
+				value TEXT NOT NULL
+			);
+
+			CREATE TABLE user_identities (
+				identity_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				issuer TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				UNIQUE (issuer, subject)
+			);
+
+			CREATE TABLE oidc_logins (
+				login_id BIGSERIAL PRIMARY KEY,
+				state_hash TEXT NOT NULL UNIQUE,
+				nonce TEXT NOT NULL,
+				code_verifier TEXT NOT NULL,
+				expires_at TIMESTAMPTZ NOT NULL
+			);
+
+			CREATE TABLE audit_events (
+				event_id BIGSERIAL PRIMARY KEY,
+				created_at TIMESTAMPTZ NOT NULL,
+				actor_id BIGINT,
+				actor TEXT NOT NULL,
+				impersonator TEXT NOT NULL DEFAULT '',
+				action TEXT NOT NULL,
+				target TEXT NOT NULL,
+				ip TEXT NOT NULL,
+				outcome TEXT NOT NULL,
+				status INTEGER NOT NULL DEFAULT 0,
+				detail TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX audit_events_created_at ON audit_events (created_at);
+
+			CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION 'audit_events is append-only';
+			END;
+			$$ LANGUAGE plpgsql;
+
+			CREATE TRIGGER audit_events_no_change BEFORE UPDATE OR DELETE ON audit_events
+				FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only();
+
+			CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+				FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE oidc_logins ADD COLUMN user_id BIGINT REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE;
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+	func(tx *sql.Tx) (err error) {
+		sql := `
+			ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+
+			CREATE TABLE email_confirmation_tokens (
+				confirmation_token_id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL REFERENCES users(user_id) ON DELETE CASCADE ON UPDATE CASCADE,
+				email TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at TIMESTAMPTZ NOT NULL,
+				used BOOLEAN NOT NULL DEFAULT FALSE
+			);
+			`
+		_, err = tx.Exec(sql)
+		return err
+	},
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hasher hashes passwords. Hashes are stored in an encoded form, which
+// identifies the algorithm and its parameters, so the algorithm can be changed
+// and old hashes are upgraded on the next successful login.
+package hasher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMismatch is returned if the password does not match the hash.
+var ErrMismatch = errors.New("hasher: password does not match")
+
+// Hasher is a password hashing algorithm.
+type Hasher interface {
+	// Hash returns the encoded hash of the password.
+	Hash(password string) (string, error)
+	// Identify reports whether the encoded hash was created by the algorithm of the hasher.
+	Identify(encoded string) bool
+	// Verify compares the password with an encoded hash of the algorithm.
+	Verify(encoded, password string) error
+	// NeedsRehash reports whether the encoded hash is weaker than the hashes
+	// the hasher creates, because of its algorithm or its parameters.
+	NeedsRehash(encoded string) bool
+}
+
+// Policy hashes new passwords with the preferred hasher and verifies the hashes of all known algorithms.
+type Policy struct {
+	preferred Hasher
+	known     []Hasher
+}
+
+// NewPolicy returns a policy, which hashes with the preferred hasher.
+// Hashes of the built-in algorithms are always verified.
+func NewPolicy(preferred Hasher) *Policy {
+	return &Policy{
+		preferred: preferred,
+		known:     []Hasher{preferred, NewArgon2id(DefaultArgon2idParams), NewBcrypt(DefaultBcryptCost)},
+	}
+}
+
+// DefaultPolicy hashes with argon2id and the default parameters.
+func DefaultPolicy() *Policy {
+	return NewPolicy(NewArgon2id(DefaultArgon2idParams))
+}
+
+// Hash returns the encoded hash of the password with the preferred hasher.
+func (p *Policy) Hash(password string) (string, error) {
+	return p.preferred.Hash(password)
+}
+
+// Verify compares the password with the encoded hash. If the password matches,
+// rehash reports whether the hash should be replaced by one of the preferred hasher.
+func (p *Policy) Verify(encoded, password string) (rehash bool, err error) {
+	for _, h := range p.known {
+		if !h.Identify(encoded) {
+			continue
+		}
+		if err := h.Verify(encoded, password); err != nil {
+			return false, err
+		}
+		return p.preferred.NeedsRehash(encoded), nil
+	}
+
+	return false, fmt.Errorf("hasher: unknown hash format")
+}
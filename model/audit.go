@@ -0,0 +1,86 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// List of audit event outcomes.
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	// AuditOutcomeDenied is recorded for requests, which were refused for missing authentication or permissions.
+	AuditOutcomeDenied = "denied"
+)
+
+// AuditEvent is an entry of the append-only audit log. The action is the name of the route,
+// the target the path of the request. The actor is the authenticated user or, e.g. for failed
+// logins, the claimed user name; ActorID is only set for authenticated users.
+type AuditEvent struct {
+	XMLName      xml.Name  `json:"-" xml:"event"`
+	ID           int64     `json:"id" xml:"id,attr"`
+	CreatedAt    time.Time `json:"created_at" xml:"created_at"`
+	ActorID      *int64    `json:"actor_id,omitempty" xml:"actor_id,omitempty"`
+	Actor        string    `json:"actor" xml:"actor"`
+	Impersonator string    `json:"impersonator,omitempty" xml:"impersonator,omitempty"`
+	Action       string    `json:"action" xml:"action"`
+	Target       string    `json:"target" xml:"target"`
+	IP           string    `json:"ip" xml:"ip"`
+	Outcome      string    `json:"outcome" xml:"outcome"`
+	Status       int       `json:"status,omitempty" xml:"status,omitempty"`
+	Detail       string    `json:"detail,omitempty" xml:"detail,omitempty"`
+}
+
+// AuditEvents represents a list of audit events.
+type AuditEvents struct {
+	XMLName xml.Name     `json:"-" xml:"events"`
+	Events  []AuditEvent `json:"-" xml:"event"`
+}
+
+// NewAuditEvents returns new AuditEvents struct
+func NewAuditEvents(events []AuditEvent) *AuditEvents {
+	return &AuditEvents{Events: events}
+}
+
+func (a *AuditEvents) List() []interface{} {
+	b := make([]interface{}, len(a.Events))
+	for i := range a.Events {
+		b[i] = a.Events[i]
+	}
+	return b
+}
+
+func (a *AuditEvents) InternalList() interface{} {
+	return &a.Events
+}
+
+// DefaultAuditEventLimit is the number of events returned, if no limit is requested.
+const DefaultAuditEventLimit = 100
+
+// MaxAuditEventLimit is the highest number of events returned at once.
+const MaxAuditEventLimit = 1000
+
+// AuditEventListingRequest filters the audit log, events are returned newest first.
+type AuditEventListingRequest struct {
+	Actor   *string
+	Action  *string
+	Target  *string
+	Outcome *string
+	Since   *time.Time
+	Until   *time.Time
+	Limit   *int64
+}
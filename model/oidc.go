@@ -0,0 +1,28 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "time"
+
+// OIDCLogin is a login at the identity provider, which waits for the callback.
+// It is found by the hash of the state parameter.
+type OIDCLogin struct {
+	ID           int64
+	Nonce        string
+	CodeVerifier string
+	// UserID is set, if the login links the identity to the user instead of logging in
+	UserID    int64
+	ExpiresAt time.Time
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "encoding/xml"
+
+// Permission is a single right, which is granted to users through their role.
+type Permission string
+
+// List of permissions.
+const (
+	// PermissionManageUsers allows to create, change and delete every user.
+	PermissionManageUsers Permission = "users:manage"
+	// PermissionReadUsers allows to list and view users.
+	PermissionReadUsers Permission = "users:read"
+	// PermissionWriteAnyBook allows to create, change and delete the books of every user.
+	PermissionWriteAnyBook Permission = "books:write:any"
+	// PermissionWriteOwnBook allows to create, change and delete the own books.
+	PermissionWriteOwnBook Permission = "books:write:own"
+)
+
+// List of the roles created by the migrations.
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleAuthor = "author"
+	RoleReader = "reader"
+)
+
+// DefaultRole is assigned to users, which are created without role.
+const DefaultRole = RoleAuthor
+
+// Role is a named set of permissions.
+type Role struct {
+	XMLName     xml.Name     `json:"-" xml:"role"`
+	Name        string       `json:"name" xml:"name,attr"`
+	Permissions []Permission `json:"permissions" xml:"permission"`
+}
+
+// Roles represents a list of roles.
+type Roles struct {
+	XMLName xml.Name `json:"-" xml:"roles"`
+	Roles   []Role   `json:"-" xml:"role"`
+}
+
+// NewRoles returns new Roles struct
+func NewRoles(roles []Role) *Roles {
+	return &Roles{Roles: roles}
+}
+
+func (r *Roles) List() []interface{} {
+	b := make([]interface{}, len(r.Roles))
+	for i := range r.Roles {
+		b[i] = r.Roles[i]
+	}
+	return b
+}
+
+func (r *Roles) InternalList() interface{} {
+	return &r.Roles
+}
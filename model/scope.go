@@ -0,0 +1,61 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "strings"
+
+// List of scopes. A scope restricts what a token may be used for,
+// it never grants more than the permissions of the user.
+const (
+	// ScopeBooksRead allows to list the books of users.
+	ScopeBooksRead = "books:read"
+	// ScopeBooksWrite allows to create, change and delete books.
+	ScopeBooksWrite = "books:write"
+	// ScopeUsersRead allows to list and view users and roles.
+	ScopeUsersRead = "users:read"
+	// ScopeUsersWrite allows to change the own account and its credentials.
+	ScopeUsersWrite = "users:write"
+	// ScopeUsersAdmin allows to manage users and the settings.
+	ScopeUsersAdmin = "users:admin"
+)
+
+// Scopes lists all scopes. Tokens without scope, e.g. those issued
+// before scopes were introduced, are granted all of them.
+var Scopes = []string{ScopeBooksRead, ScopeBooksWrite, ScopeUsersRead, ScopeUsersWrite, ScopeUsersAdmin}
+
+// ParseScope splits a space separated scope as used by OAuth 2.0.
+// An empty scope grants all scopes.
+func ParseScope(scope string) []string {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return append([]string{}, Scopes...)
+	}
+	return scopes
+}
+
+// FormatScope joins the scopes space separated.
+func FormatScope(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// HasScope reports whether the scope is in the list of scopes.
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
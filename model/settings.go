@@ -0,0 +1,52 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "encoding/xml"
+
+// Settings holds the options, which admins can change at runtime.
+type Settings struct {
+	XMLName xml.Name `json:"-" xml:"settings"`
+	// RequireAdminTOTP forces every admin to enrol TOTP before using the API
+	RequireAdminTOTP bool `json:"require_admin_totp" xml:"require_admin_totp"`
+	// SignupApproval decides whether users, who sign up themselves, are active right away
+	SignupApproval string `json:"signup_approval" xml:"signup_approval"`
+}
+
+// List of signup approval modes.
+const (
+	// SignupApprovalAdmin keeps new users pending until an admin approves them.
+	SignupApprovalAdmin = "admin"
+	// SignupApprovalAuto activates new users right away.
+	SignupApprovalAuto = "auto"
+)
+
+// SettingsModificationRequest represents the request to change the settings.
+type SettingsModificationRequest struct {
+	XMLName          xml.Name `json:"-" xml:"settings"`
+	RequireAdminTOTP *bool    `json:"require_admin_totp" xml:"require_admin_totp"`
+	SignupApproval   *string  `json:"signup_approval" xml:"signup_approval"`
+}
+
+// Patch updates the Settings object with the modification request.
+func (s *SettingsModificationRequest) Patch(settings *Settings) {
+	if s.RequireAdminTOTP != nil {
+		settings.RequireAdminTOTP = *s.RequireAdminTOTP
+	}
+
+	if s.SignupApproval != nil {
+		settings.SignupApproval = *s.SignupApproval
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import "time"
+
+// LoginThrottle tracks the failed logins for a subject, which is either a user name or an IP address.
+type LoginThrottle struct {
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	BlockedUntil  time.Time
+	// Locked is set, if the account was locked and not only delayed
+	Locked bool
+}
+
+// Blocked reports whether logins for the subject are refused at the given time.
+func (t *LoginThrottle) Blocked(now time.Time) bool {
+	return now.Before(t.BlockedUntil)
+}
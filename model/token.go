@@ -0,0 +1,149 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// RefreshToken represents a stored refresh token. Only the hash of the token is kept.
+// All tokens issued by rotating the same initial token share a family.
+type RefreshToken struct {
+	ID        int64
+	UserID    int64
+	FamilyID  string
+	Scope     string
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
+
+// PasswordResetToken represents a stored, single-use password reset token.
+type PasswordResetToken struct {
+	ID        int64
+	UserID    int64
+	ExpiresAt time.Time
+	Used      bool
+}
+
+// EmailConfirmationToken represents a stored, single-use token, which confirms the email address
+// it was sent to.
+type EmailConfirmationToken struct {
+	ID        int64
+	UserID    int64
+	Email     string
+	ExpiresAt time.Time
+	Used      bool
+}
+
+// PersonalAccessToken is a named, long-lived token of a user.
+// The token itself is only returned once on creation.
+type PersonalAccessToken struct {
+	XMLName    xml.Name   `json:"-" xml:"token"`
+	ID         int64      `json:"id" xml:"id,attr"`
+	UserID     int64      `json:"user_id" xml:"user_id"`
+	Name       string     `json:"name" xml:"name"`
+	Scope      string     `json:"scope" xml:"scope"`
+	Token      string     `json:"token,omitempty" xml:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" xml:"last_used_at,omitempty"`
+}
+
+// PersonalAccessTokens represents a list of personal access tokens.
+type PersonalAccessTokens struct {
+	XMLName xml.Name              `json:"-" xml:"tokens"`
+	Tokens  []PersonalAccessToken `json:"-" xml:"token"`
+}
+
+// NewPersonalAccessTokens returns new PersonalAccessTokens struct
+func NewPersonalAccessTokens(tokens []PersonalAccessToken) *PersonalAccessTokens {
+	return &PersonalAccessTokens{Tokens: tokens}
+}
+
+func (p *PersonalAccessTokens) List() []interface{} {
+	b := make([]interface{}, len(p.Tokens))
+	for i := range p.Tokens {
+		b[i] = p.Tokens[i]
+	}
+	return b
+}
+
+func (p *PersonalAccessTokens) InternalList() interface{} {
+	return &p.Tokens
+}
+
+// PersonalAccessTokenCreationRequest represents the request to create a personal access token.
+// Without scope the token gets the scopes of the token, which creates it.
+type PersonalAccessTokenCreationRequest struct {
+	XMLName xml.Name `json:"-" xml:"token"`
+	Name    string   `json:"name" xml:"name"`
+	Scope   string   `json:"scope" xml:"scope"`
+}
+
+// List of token types.
+const (
+	TokenTypeJWT                 = "jwt"
+	TokenTypePersonalAccessToken = "personal_access_token"
+	TokenTypeClientCertificate   = "client_certificate"
+)
+
+// TokenInfo describes the token, which authenticated the request.
+type TokenInfo struct {
+	Type      string     `json:"type" xml:"type"`
+	ID        string     `json:"id,omitempty" xml:"id,omitempty"`
+	IssuedAt  *time.Time `json:"issued_at,omitempty" xml:"issued_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+	Scopes    []string   `json:"scopes" xml:"scopes>scope"`
+}
+
+// CurrentUser is the authenticated user together with the metadata of the token.
+// Actor is the user, who impersonates the user, if any.
+type CurrentUser struct {
+	XMLName xml.Name  `json:"-" xml:"me"`
+	User    *User     `json:"user" xml:"user"`
+	Actor   *User     `json:"actor,omitempty" xml:"actor,omitempty"`
+	Token   TokenInfo `json:"token" xml:"token"`
+}
+
+// TokenActor identifies the acting user of an impersonation token, as in RFC 8693.
+type TokenActor struct {
+	Subject string `json:"sub" xml:"sub"`
+}
+
+// ImpersonationRequest represents the request of an impersonation token.
+// Without scope the token is restricted to reading.
+type ImpersonationRequest struct {
+	XMLName xml.Name `json:"-" xml:"impersonation"`
+	Scope   string   `json:"scope" xml:"scope"`
+}
+
+// TokenIntrospection is the response of the token introspection as described in RFC 7662.
+// Inactive tokens only carry active=false.
+type TokenIntrospection struct {
+	XMLName   xml.Name    `json:"-" xml:"introspection"`
+	Active    bool        `json:"active" xml:"active"`
+	Scope     string      `json:"scope,omitempty" xml:"scope,omitempty"`
+	TokenType string      `json:"token_type,omitempty" xml:"token_type,omitempty"`
+	Username  string      `json:"username,omitempty" xml:"username,omitempty"`
+	UserID    int64       `json:"user_id,omitempty" xml:"user_id,omitempty"`
+	Subject   string      `json:"sub,omitempty" xml:"sub,omitempty"`
+	Issuer    string      `json:"iss,omitempty" xml:"iss,omitempty"`
+	ID        string      `json:"jti,omitempty" xml:"jti,omitempty"`
+	Actor     *TokenActor `json:"act,omitempty" xml:"act,omitempty"`
+	ExpiresAt int64       `json:"exp,omitempty" xml:"exp,omitempty"`
+	IssuedAt  int64       `json:"iat,omitempty" xml:"iat,omitempty"`
+	NotBefore int64       `json:"nbf,omitempty" xml:"nbf,omitempty"`
+}
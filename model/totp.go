@@ -0,0 +1,57 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// TOTPEnrolment is returned when a user starts the TOTP enrolment.
+// The secret becomes active after a code was verified.
+type TOTPEnrolment struct {
+	XMLName         xml.Name `json:"-" xml:"totp"`
+	Secret          string   `json:"secret" xml:"secret"`
+	ProvisioningURI string   `json:"provisioning_uri" xml:"provisioning_uri"`
+}
+
+// TOTPVerificationRequest represents the request to confirm the TOTP enrolment or its removal.
+type TOTPVerificationRequest struct {
+	XMLName xml.Name `json:"-" xml:"totp"`
+	Code    string   `json:"code" xml:"code"`
+}
+
+// RecoveryCodes are the one-time codes, which replace a TOTP code if the device is lost.
+// They are only returned once after the enrolment.
+type RecoveryCodes struct {
+	XMLName xml.Name `json:"-" xml:"recovery_codes"`
+	Codes   []string `json:"recovery_codes" xml:"code"`
+}
+
+// TOTP holds the TOTP state of a user.
+type TOTP struct {
+	Secret  string
+	Enabled bool
+	// LastStep is the last accepted time step, codes of older steps are refused
+	LastStep int64
+}
+
+// MFAChallenge represents a password login, which waits for the second factor.
+type MFAChallenge struct {
+	ID        int64
+	UserID    int64
+	Scope     string
+	ExpiresAt time.Time
+}
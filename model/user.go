@@ -23,7 +23,37 @@ type User struct {
 	Username  string   `json:"username" xml:"username"`
 	Password  string   `json:"-" xml:"-"`
 	Pseudonym string   `json:"pseudonym" xml:"pseudonym"`
-	IsAdmin   bool     `json:"is_admin" xml:"is_admin"`
+	Email     string   `json:"email,omitempty" xml:"email,omitempty"`
+	// EmailVerified is set, once the user confirmed the email address, and reset when it changes
+	EmailVerified bool `json:"email_verified" xml:"email_verified"`
+	// IsAdmin is derived from the role and kept for compatibility
+	IsAdmin bool   `json:"is_admin" xml:"is_admin"`
+	Role    string `json:"role" xml:"role"`
+	// Permissions are granted through the role
+	Permissions []Permission `json:"-" xml:"-"`
+	Status  string `json:"status" xml:"status"`
+	// TOTPEnabled is set, if the user completed the TOTP enrolment
+	TOTPEnabled bool `json:"totp_enabled" xml:"totp_enabled"`
+	// TokenVersion is raised to invalidate all issued tokens of the user
+	TokenVersion int64 `json:"-" xml:"-"`
+}
+
+// List of user states.
+const (
+	// UserStatusActive users can log in.
+	UserStatusActive = "active"
+	// UserStatusPending users signed up themselves and wait for the approval of an admin.
+	UserStatusPending = "pending"
+)
+
+// HasPermission reports whether the role of the user grants the permission.
+func (u *User) HasPermission(permission Permission) bool {
+	for _, p := range u.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
 }
 
 // Users represents a list of users.
@@ -55,7 +85,25 @@ type UserCreationRequest struct {
 	Username  string   `json:"username" xml:"username"`
 	Password  string   `json:"password" xml:"password"`
 	Pseudonym string   `json:"pseudonym" xml:"pseudonym"`
+	Email     string   `json:"email" xml:"email"`
 	IsAdmin   bool     `json:"is_admin" xml:"is_admin"`
+	Role      string   `json:"role" xml:"role"`
+	// Status of the new user, users are active if empty
+	Status string `json:"-" xml:"-"`
+	// EmailVerified is only set for emails, which were confirmed elsewhere, e.g. by the OIDC provider
+	EmailVerified bool `json:"-" xml:"-"`
+}
+
+// RoleName returns the role of the new user. Without explicit role
+// is_admin selects between the admin and the default role.
+func (u *UserCreationRequest) RoleName() string {
+	switch {
+	case u.Role != "":
+		return u.Role
+	case u.IsAdmin:
+		return RoleAdmin
+	}
+	return DefaultRole
 }
 
 // UserModificationRequest represents the request to modify a user.
@@ -64,7 +112,9 @@ type UserModificationRequest struct {
 	Username  *string  `json:"username" xml:"username"`
 	Password  *string  `json:"password" xml:"password"`
 	Pseudonym *string  `json:"pseudonym" xml:"pseudonym"`
+	Email     *string  `json:"email" xml:"email"`
 	IsAdmin   *bool    `json:"is_admin" xml:"is_admin"`
+	Role      *string  `json:"role" xml:"role"`
 }
 
 // Patch updates the User object with the modification request.
@@ -78,10 +128,23 @@ func (u *UserModificationRequest) Patch(user *User) {
 	}
 
 	if u.IsAdmin != nil {
-		user.IsAdmin = *u.IsAdmin
+		if *u.IsAdmin {
+			user.Role = RoleAdmin
+		} else if user.Role == RoleAdmin {
+			user.Role = DefaultRole
+		}
+	}
+
+	if u.Role != nil {
+		user.Role = *u.Role
 	}
+	user.IsAdmin = user.Role == RoleAdmin
 
 	if u.Pseudonym != nil {
 		user.Pseudonym = *u.Pseudonym
 	}
+
+	if u.Email != nil {
+		user.Email = *u.Email
+	}
 }
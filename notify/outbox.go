@@ -0,0 +1,75 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// OutboxNotifier appends messages as JSON lines to a file instead of delivering them.
+// It is meant for development and tests, which read the messages with ReadOutbox.
+type OutboxNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewOutboxNotifier returns a notifier writing to the file at path.
+func NewOutboxNotifier(path string) *OutboxNotifier {
+	return &OutboxNotifier{path: path}
+}
+
+func (n *OutboxNotifier) Send(msg *Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("notify: unable to open outbox: %v", err)
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(msg); err != nil {
+		return fmt.Errorf("notify: unable to write outbox: %v", err)
+	}
+
+	return nil
+}
+
+// ReadOutbox returns all messages in the outbox file.
+func ReadOutbox(path string) ([]Message, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("notify: unable to open outbox: %v", err)
+	}
+	defer f.Close()
+
+	var messages []Message
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("notify: invalid outbox entry: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, scanner.Err()
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/subtle"
+	"fmt"
+
+	"bookstore/auth"
+
+	"github.com/form3tech-oss/jwt-go"
+)
+
+// verify checks the signature and the claims of the ID token, see OpenID Connect Core section 3.1.3.7.
+func (p *Provider) verify(rawIDToken, nonce string) (*Identity, error) {
+	token, err := jwt.Parse(rawIDToken, p.verificationKey)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid id token: %v", err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("oidc: invalid id token claims")
+	}
+	if !claims.VerifyIssuer(p.metadata.Issuer, true) {
+		return nil, fmt.Errorf("oidc: id token issued by %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, fmt.Errorf("oidc: id token issued for %v", claims["aud"])
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("oidc: id token without expiry")
+	}
+	tokenNonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("oidc: id token nonce does not match")
+	}
+
+	identity := &Identity{Issuer: p.metadata.Issuer}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("oidc: id token without subject")
+	}
+
+	return identity, nil
+}
+
+// verificationKey looks up the key of the token in the key set of the provider.
+// Unknown key ids reload the key set once, so keys rotated by the provider are picked up.
+func (p *Provider) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	jwk, ok := p.lookupKey(kid)
+	if !ok {
+		if err := p.loadKeys(); err != nil {
+			return nil, err
+		}
+		if jwk, ok = p.lookupKey(kid); !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+	}
+
+	key, err := jwk.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	// the algorithm has to fit the key, e.g. HS256 with the public key as secret is refused
+	switch key.(type) {
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		ok = token.Method == jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		ok = token.Method == auth.SigningMethodEdDSA
+	}
+	if !ok {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+	}
+
+	return key, nil
+}
+
+// lookupKey returns the key with the id, without id the only key of the set is used.
+func (p *Provider) lookupKey(kid string) (auth.JWK, bool) {
+	p.keysMu.RLock()
+	defer p.keysMu.RUnlock()
+
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *Provider) loadKeys() error {
+	var set auth.JWKSet
+	if err := p.getJSON(p.metadata.JWKSURI, &set); err != nil {
+		return fmt.Errorf("unable to load the key set: %v", err)
+	}
+
+	keys := make(map[string]auth.JWK)
+	for _, key := range set.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			keys[key.KeyID] = key
+		}
+	}
+
+	p.keysMu.Lock()
+	p.keys = keys
+	p.keysMu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy decides which user may do what. Handlers ask the policy
+// instead of checking roles themselves, so the rules are kept in one place.
+package policy
+
+import "bookstore/model"
+
+// CanReadUsers reports whether the user may list and view users.
+func CanReadUsers(actor *model.User) bool {
+	return actor.HasPermission(model.PermissionReadUsers)
+}
+
+// CanManageUsers reports whether the user may create and delete users and change their roles.
+func CanManageUsers(actor *model.User) bool {
+	return actor.HasPermission(model.PermissionManageUsers)
+}
+
+// CanEditUser reports whether the user may change the account of the target user.
+func CanEditUser(actor *model.User, targetUserID int64) bool {
+	return actor.ID == targetUserID || CanManageUsers(actor)
+}
+
+// CanReadEmail reports whether the user may see the email of the target user.
+// Every user may read users, so the emails are kept to the user and those managing users.
+func CanReadEmail(actor *model.User, targetUserID int64) bool {
+	return actor.ID == targetUserID || CanManageUsers(actor)
+}
+
+// CanWriteBooks reports whether the user may create, change and delete books of the owner.
+func CanWriteBooks(actor *model.User, ownerID int64) bool {
+	if actor.HasPermission(model.PermissionWriteAnyBook) {
+		return true
+	}
+	return actor.ID == ownerID && actor.HasPermission(model.PermissionWriteOwnBook)
+}
+
+// CanManageTokens reports whether the user may manage the personal access tokens of the owner.
+func CanManageTokens(actor *model.User, ownerID int64) bool {
+	return CanEditUser(actor, ownerID)
+}
+
+// CanCreateToken reports whether the user may create a personal access token for the owner.
+// The token acts as the owner without an actor, so even managers can not create one for others.
+func CanCreateToken(actor *model.User, ownerID int64) bool {
+	return actor.ID == ownerID
+}
+
+// CanEnrolTOTP reports whether the user may enrol TOTP for the target user.
+// The secret ends up on the device of the user, so nobody can enrol for others.
+func CanEnrolTOTP(actor *model.User, targetUserID int64) bool {
+	return actor.ID == targetUserID
+}
+
+// CanDisableTOTP reports whether the user may remove the TOTP enrolment of the target user,
+// e.g. after the target user lost the device.
+func CanDisableTOTP(actor *model.User, targetUserID int64) bool {
+	return CanEditUser(actor, targetUserID)
+}
+
+// CanManageSettings reports whether the user may view and change the runtime settings.
+func CanManageSettings(actor *model.User) bool {
+	return CanManageUsers(actor)
+}
+
+// CanIntrospectTokens reports whether the user may look up the owner and state of other tokens.
+// Any leaked token can be checked and the response reveals its owner and scopes,
+// so it needs the permission to manage users.
+func CanIntrospectTokens(actor *model.User) bool {
+	return CanManageUsers(actor)
+}
+
+// CanImpersonate reports whether the user may act as the target user.
+// Users, who manage users themselves, can not be impersonated, so impersonation
+// can neither hide the actions of an admin nor lead to more permissions.
+func CanImpersonate(actor *model.User, target *model.User) bool {
+	return actor.ID != target.ID && CanManageUsers(actor) && !CanManageUsers(target)
+}
+
+// CanLinkIdentityByEmail reports whether an identity of the OIDC provider may be linked to the user
+// because of a matching email alone. Logins through the provider skip the second factor, so users
+// with TOTP or the permission to manage users have to link it with their password and second factor.
+func CanLinkIdentityByEmail(target *model.User) bool {
+	return !target.TOTPEnabled && !CanManageUsers(target)
+}
+
+// CanReadAuditLog reports whether the user may read the audit log of all users.
+func CanReadAuditLog(actor *model.User) bool {
+	return CanManageUsers(actor)
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"bookstore/model"
+)
+
+// CreateAuditEvent appends the event to the audit log.
+// actor_id has no foreign key, so the events of deleted users are kept.
+func (s *Storage) CreateAuditEvent(event *model.AuditEvent) error {
+	query := `
+		INSERT INTO audit_events
+			(created_at, actor_id, actor, impersonator, action, target, ip, outcome, status, detail)
+		VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING
+			event_id
+	`
+
+	err := s.queryRow(
+		query,
+		event.CreatedAt.UTC(),
+		event.ActorID,
+		event.Actor,
+		event.Impersonator,
+		event.Action,
+		event.Target,
+		event.IP,
+		event.Outcome,
+		event.Status,
+		event.Detail,
+	).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to create audit event: %w`, err)
+	}
+
+	return nil
+}
+
+// AuditEvents returns the events matching the filter, newest first.
+func (s *Storage) AuditEvents(search model.AuditEventListingRequest) (*model.AuditEvents, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if search.Actor != nil {
+		where("actor = $%d", *search.Actor)
+	}
+	if search.Action != nil {
+		where("action = $%d", *search.Action)
+	}
+	if search.Target != nil {
+		where("target = $%d", *search.Target)
+	}
+	if search.Outcome != nil {
+		where("outcome = $%d", *search.Outcome)
+	}
+	if search.Since != nil {
+		where("created_at >= $%d", search.Since.UTC())
+	}
+	if search.Until != nil {
+		where("created_at < $%d", search.Until.UTC())
+	}
+
+	condition := "true"
+	if len(conditions) > 0 {
+		condition = strings.Join(conditions, " AND ")
+	}
+
+	limit := int64(model.DefaultAuditEventLimit)
+	if search.Limit != nil {
+		limit = *search.Limit
+	}
+
+	query := fmt.Sprintf(`
+		SELECT
+			event_id,
+			created_at,
+			actor_id,
+			actor,
+			impersonator,
+			action,
+			target,
+			ip,
+			outcome,
+			status,
+			detail
+		FROM
+			audit_events
+		WHERE %s
+		ORDER BY event_id DESC
+		LIMIT %d
+	`, condition, limit)
+
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch audit events: %w`, err)
+	}
+	defer rows.Close()
+
+	events := make([]model.AuditEvent, 0)
+	for rows.Next() {
+		var event model.AuditEvent
+		var actorID sql.NullInt64
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&actorID,
+			&event.Actor,
+			&event.Impersonator,
+			&event.Action,
+			&event.Target,
+			&event.IP,
+			&event.Outcome,
+			&event.Status,
+			&event.Detail,
+		)
+		if err != nil {
+			return nil, fmt.Errorf(`store: unable to fetch audit events row: %w`, err)
+		}
+		if actorID.Valid {
+			event.ActorID = &actorID.Int64
+		}
+
+		events = append(events, event)
+	}
+
+	return model.NewAuditEvents(events), nil
+}
@@ -15,8 +15,6 @@
 package storage
 
 import (
-	"database/sql"
-	"errors"
 	"fmt"
 	"strings"
 
@@ -102,7 +100,7 @@ func (b *BookQueryBuilder) WithMaxPrice(price int64) *BookQueryBuilder {
 // SearchTitle filter by title.
 func (b *BookQueryBuilder) SearchTitle(title string) *BookQueryBuilder {
 	if title != "" {
-		b.conditions = append(b.conditions, fmt.Sprintf("b.title like $%d", len(b.args)+1))
+		b.conditions = append(b.conditions, fmt.Sprintf("LOWER(b.title) LIKE LOWER($%d)", len(b.args)+1))
 		b.args = append(b.args, "%"+title+"%")
 	}
 	return b
@@ -111,7 +109,7 @@ func (b *BookQueryBuilder) SearchTitle(title string) *BookQueryBuilder {
 // SearchDescription filter by description.
 func (b *BookQueryBuilder) SearchDescription(description string) *BookQueryBuilder {
 	if description != "" {
-		b.conditions = append(b.conditions, fmt.Sprintf("b.description like $%d", len(b.args)+1))
+		b.conditions = append(b.conditions, fmt.Sprintf("LOWER(b.description) LIKE LOWER($%d)", len(b.args)+1))
 		b.args = append(b.args, "%"+description+"%")
 	}
 	return b
@@ -127,7 +125,7 @@ func (b *BookQueryBuilder) WithOffset(offset int) *BookQueryBuilder {
 
 func (b *BookQueryBuilder) buildCondition() string {
 	if len(b.conditions) == 0 {
-		return "1"
+		return "true"
 	}
 	return strings.Join(b.conditions, " AND ")
 }
@@ -165,12 +163,14 @@ func (e *BookQueryBuilder) GetBooks() (*model.Books, error) {
 			b.price,
 			b.image_url,
 			u.username,
-			u.is_admin,
+			COALESCE(r.name, ''),
 			u.pseudonym
 		FROM
 			books b
 		LEFT JOIN
 			users u ON u.user_id=b.user_id
+		LEFT JOIN
+			roles r ON r.role_id=u.role_id
 		WHERE %s %s
 	`
 
@@ -178,9 +178,9 @@ func (e *BookQueryBuilder) GetBooks() (*model.Books, error) {
 	sorting := e.buildSorting()
 	query = fmt.Sprintf(query, condition, sorting)
 
-	rows, err := e.store.db.Query(query, e.args...)
+	rows, err := e.store.query(query, e.args...)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get entries: %v", err)
+		return nil, fmt.Errorf("unable to get entries: %w", err)
 	}
 	defer rows.Close()
 
@@ -200,15 +200,16 @@ func (e *BookQueryBuilder) GetBooks() (*model.Books, error) {
 			&book.Price,
 			&book.ImageURL,
 			&book.User.Username,
-			&book.User.IsAdmin,
+			&book.User.Role,
 			&book.User.Pseudonym,
 		)
 
 		if err != nil {
-			return nil, fmt.Errorf("unable to fetch entry row: %v", err)
+			return nil, fmt.Errorf("unable to fetch entry row: %w", err)
 		}
 
 		book.User.ID = book.UserID
+		book.User.IsAdmin = book.User.Role == model.RoleAdmin
 		entries = append(entries, book)
 	}
 
@@ -270,10 +271,10 @@ func (s *Storage) BookByID(bookID int64) (*model.Book, error) {
 	book, err := builder.GetBook()
 
 	switch {
-	case errors.Is(err, sql.ErrNoRows):
-		return nil, nil
 	case err != nil:
-		return nil, fmt.Errorf(`store: unable to fetch book #%d: %v`, bookID, err)
+		return nil, fmt.Errorf(`store: unable to fetch book #%d: %w`, bookID, err)
+	case book == nil:
+		return nil, notFound(`store: book #%d not found`, bookID)
 	}
 
 	return book, nil
@@ -287,10 +288,10 @@ func (s *Storage) BookByIDAndUserID(userID, bookID int64) (*model.Book, error) {
 	book, err := builder.GetBook()
 
 	switch {
-	case errors.Is(err, sql.ErrNoRows):
-		return nil, nil
 	case err != nil:
-		return nil, fmt.Errorf(`store: unable to fetch book #%d: %v`, bookID, err)
+		return nil, fmt.Errorf(`store: unable to fetch book #%d: %w`, bookID, err)
+	case book == nil:
+		return nil, notFound(`store: book #%d not found`, bookID)
 	}
 
 	return book, nil
@@ -307,14 +308,14 @@ func (s *Storage) UserBooks(userID int64) (*model.Books, error) {
 // BookWithSameTitle checks if another book with a given title for the user exists
 func (s *Storage) BookWithSameTitle(userID int64, bookID int64, title string) bool {
 	var result bool
-	s.db.QueryRow(`SELECT true FROM books WHERE book_id = $1 AND user_id = $2 AND title = $3`, userID, bookID, title).Scan(&result)
+	s.queryRow(`SELECT true FROM books WHERE user_id = $1 AND book_id != $2 AND title = $3`, userID, bookID, title).Scan(&result)
 	return result
 }
 
 // BookForUserExists checks if another book with a given title for the user exists
 func (s *Storage) BookForUserExists(userID int64, title string) bool {
 	var result bool
-	s.db.QueryRow(`SELECT true FROM books WHERE user_id = $1 AND title = $2`, userID, title).Scan(&result)
+	s.queryRow(`SELECT true FROM books WHERE user_id = $1 AND title = $2`, userID, title).Scan(&result)
 	return result
 }
 
@@ -341,7 +342,7 @@ func (s *Storage) CreateBook(userID int64, bookCreationRequest *model.BookCreati
 	`
 
 	var book model.Book
-	err = s.db.QueryRow(
+	err = s.queryRow(
 		query,
 		userID,
 		bookCreationRequest.Title,
@@ -357,7 +358,7 @@ func (s *Storage) CreateBook(userID int64, bookCreationRequest *model.BookCreati
 		&book.ImageURL,
 	)
 	if err != nil {
-		return nil, fmt.Errorf(`store: unable to create book %s: %v`, book.Title, err)
+		return nil, fmt.Errorf(`store: unable to create book %s: %w`, book.Title, err)
 	}
 	book.User = user
 	return &book, nil
@@ -375,7 +376,7 @@ func (s *Storage) UpdateBook(book *model.Book) error {
 				book_id=$5
 		`
 
-	_, err := s.db.Exec(
+	result, err := s.exec(
 		query,
 		book.Title,
 		book.Description,
@@ -384,13 +385,17 @@ func (s *Storage) UpdateBook(book *model.Book) error {
 		book.ID,
 	)
 	if err != nil {
-		return fmt.Errorf(`store: unable to update book: %v`, err)
+		return fmt.Errorf(`store: unable to update book: %w`, err)
 	}
 
-	return nil
+	return changedRow(result, "book", book.ID)
 }
 
 func (s *Storage) DeleteBook(bookID int64) error {
-	_, err := s.db.Exec(`DELETE FROM books WHERE book_id=$1`, bookID)
-	return err
+	result, err := s.exec(`DELETE FROM books WHERE book_id=$1`, bookID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to delete book: %w`, err)
+	}
+
+	return changedRow(result, "book", bookID)
 }
@@ -0,0 +1,92 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The kinds of errors returned by the Store, test for them with errors.Is.
+var (
+	// ErrNotFound is returned, if the entity addressed by its id does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned, if a write violates a unique or foreign key constraint,
+	// e.g. because a concurrent request created the same username after it was validated.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalid is returned, if the database refuses a value, e.g. a missing or malformed one.
+	ErrInvalid = errors.New("invalid")
+)
+
+// SQLSTATE codes of PostgreSQL, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	postgresNotNullViolation    = "23502"
+	postgresForeignKeyViolation = "23503"
+	postgresUniqueViolation     = "23505"
+	postgresCheckViolation      = "23514"
+	postgresDataExceptionClass  = "22"
+)
+
+// Error is an error of one of the kinds above, which keeps its cause, e.g. the error of the driver.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is match the kind of the error.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &Error{ErrNotFound, fmt.Errorf(format, args...)}
+}
+
+// driverError turns the constraint violations of the drivers into an Error of the matching kind.
+func driverError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey, sqlite3.ErrConstraintForeignKey:
+			return &Error{ErrConflict, err}
+		case sqlite3.ErrConstraintNotNull, sqlite3.ErrConstraintCheck:
+			return &Error{ErrInvalid, err}
+		}
+		return err
+	}
+
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		switch state := stateErr.SQLState(); {
+		case state == postgresUniqueViolation, state == postgresForeignKeyViolation:
+			return &Error{ErrConflict, err}
+		case state == postgresNotNullViolation, state == postgresCheckViolation,
+			len(state) == 5 && state[:2] == postgresDataExceptionClass:
+			return &Error{ErrInvalid, err}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,346 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"bookstore/hasher"
+	"bookstore/model"
+)
+
+// memoryRoles mirrors the roles and permissions created by the migrations.
+var memoryRoles = map[string][]model.Permission{
+	model.RoleAdmin: {
+		model.PermissionWriteAnyBook,
+		model.PermissionWriteOwnBook,
+		model.PermissionManageUsers,
+		model.PermissionReadUsers,
+	},
+	model.RoleEditor: {
+		model.PermissionWriteAnyBook,
+		model.PermissionWriteOwnBook,
+		model.PermissionReadUsers,
+	},
+	model.RoleAuthor: {
+		model.PermissionWriteOwnBook,
+		model.PermissionReadUsers,
+	},
+	model.RoleReader: {
+		model.PermissionReadUsers,
+	},
+}
+
+type memoryUser struct {
+	user     model.User
+	password string
+	totp     model.TOTP
+}
+
+type memoryRefreshToken struct {
+	token model.RefreshToken
+	hash  string
+}
+
+type memoryResetToken struct {
+	token model.PasswordResetToken
+	hash  string
+}
+
+type memoryConfirmationToken struct {
+	token model.EmailConfirmationToken
+	hash  string
+}
+
+type memoryAccessToken struct {
+	token model.PersonalAccessToken
+	hash  string
+}
+
+type memoryRecoveryCode struct {
+	userID int64
+	hash   string
+	used   bool
+}
+
+type memoryMFAChallenge struct {
+	challenge model.MFAChallenge
+	hash      string
+}
+
+type memoryOIDCLogin struct {
+	login model.OIDCLogin
+	hash  string
+}
+
+type memoryIdentity struct {
+	userID  int64
+	issuer  string
+	subject string
+}
+
+// MemoryStorage implements the Store in memory, with the same uniqueness rules,
+// cascading deletes and ordering as the SQL databases. It is meant for tests.
+type MemoryStorage struct {
+	*memoryData
+	// inTx is set on the MemoryStorage that WithTx hands to fn, which already holds txMu.
+	inTx bool
+}
+
+// memoryData is shared by a MemoryStorage and its transactions.
+type memoryData struct {
+	mu sync.RWMutex
+	// txMu is held by a running transaction, operations outside of it wait until it finished.
+	txMu      sync.RWMutex
+	passwords *hasher.Policy
+	memoryState
+}
+
+// memoryState is the data of a MemoryStorage, which a failed transaction restores.
+type memoryState struct {
+	sequences map[string]int64
+
+	users         map[int64]*memoryUser
+	books         map[int64]*model.Book
+	refreshTokens map[int64]*memoryRefreshToken
+	deniedTokens  map[string]time.Time
+	resetTokens   map[int64]*memoryResetToken
+	confirmations map[int64]*memoryConfirmationToken
+	accessTokens  map[int64]*memoryAccessToken
+	recoveryCodes []*memoryRecoveryCode
+	mfaChallenges map[int64]*memoryMFAChallenge
+	oidcLogins    map[int64]*memoryOIDCLogin
+	identities    map[int64]*memoryIdentity
+	settings      *model.Settings
+	throttles     map[string]model.LoginThrottle
+	auditEvents   []model.AuditEvent
+}
+
+// clone returns a deep copy of the state, entities are changed in place by the storage.
+func (s *memoryState) clone() memoryState {
+	c := memoryState{
+		sequences:     make(map[string]int64, len(s.sequences)),
+		users:         make(map[int64]*memoryUser, len(s.users)),
+		books:         make(map[int64]*model.Book, len(s.books)),
+		refreshTokens: make(map[int64]*memoryRefreshToken, len(s.refreshTokens)),
+		deniedTokens:  make(map[string]time.Time, len(s.deniedTokens)),
+		resetTokens:   make(map[int64]*memoryResetToken, len(s.resetTokens)),
+		confirmations: make(map[int64]*memoryConfirmationToken, len(s.confirmations)),
+		accessTokens:  make(map[int64]*memoryAccessToken, len(s.accessTokens)),
+		mfaChallenges: make(map[int64]*memoryMFAChallenge, len(s.mfaChallenges)),
+		oidcLogins:    make(map[int64]*memoryOIDCLogin, len(s.oidcLogins)),
+		identities:    make(map[int64]*memoryIdentity, len(s.identities)),
+		throttles:     make(map[string]model.LoginThrottle, len(s.throttles)),
+		auditEvents:   append([]model.AuditEvent(nil), s.auditEvents...),
+	}
+	for k, v := range s.sequences {
+		c.sequences[k] = v
+	}
+	for k, v := range s.users {
+		copied := *v
+		c.users[k] = &copied
+	}
+	for k, v := range s.books {
+		copied := *v
+		c.books[k] = &copied
+	}
+	for k, v := range s.refreshTokens {
+		copied := *v
+		c.refreshTokens[k] = &copied
+	}
+	for k, v := range s.resetTokens {
+		copied := *v
+		c.resetTokens[k] = &copied
+	}
+	for k, v := range s.confirmations {
+		copied := *v
+		c.confirmations[k] = &copied
+	}
+	for k, v := range s.accessTokens {
+		copied := *v
+		c.accessTokens[k] = &copied
+	}
+	for k, v := range s.mfaChallenges {
+		copied := *v
+		c.mfaChallenges[k] = &copied
+	}
+	for k, v := range s.oidcLogins {
+		copied := *v
+		c.oidcLogins[k] = &copied
+	}
+	for k, v := range s.identities {
+		copied := *v
+		c.identities[k] = &copied
+	}
+	for k, v := range s.deniedTokens {
+		c.deniedTokens[k] = v
+	}
+	for k, v := range s.throttles {
+		c.throttles[k] = v
+	}
+	for _, code := range s.recoveryCodes {
+		copied := *code
+		c.recoveryCodes = append(c.recoveryCodes, &copied)
+	}
+	if s.settings != nil {
+		settings := *s.settings
+		c.settings = &settings
+	}
+	return c
+}
+
+var _ Store = (*MemoryStorage)(nil)
+
+// NewMemoryStorage returns an empty MemoryStorage, which hashes passwords with the default policy.
+func NewMemoryStorage() *MemoryStorage {
+	m := &MemoryStorage{memoryData: &memoryData{passwords: hasher.DefaultPolicy()}}
+	m.Reset()
+	return m
+}
+
+// SetPasswordPolicy replaces the policy used to hash and verify passwords.
+func (m *MemoryStorage) SetPasswordPolicy(passwords *hasher.Policy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passwords = passwords
+}
+
+func (m *MemoryStorage) passwordPolicy() *hasher.Policy {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.passwords
+}
+
+// lock takes the write lock, outside of a transaction it waits for a running one first.
+func (m *MemoryStorage) lock() {
+	if !m.inTx {
+		m.txMu.RLock()
+	}
+	m.mu.Lock()
+}
+
+func (m *MemoryStorage) unlock() {
+	m.mu.Unlock()
+	if !m.inTx {
+		m.txMu.RUnlock()
+	}
+}
+
+// rlock takes the read lock, outside of a transaction it waits for a running one first.
+func (m *MemoryStorage) rlock() {
+	if !m.inTx {
+		m.txMu.RLock()
+	}
+	m.mu.RLock()
+}
+
+func (m *MemoryStorage) runlock() {
+	m.mu.RUnlock()
+	if !m.inTx {
+		m.txMu.RUnlock()
+	}
+}
+
+// Reset removes all data, the storage is afterwards like a freshly migrated database.
+func (m *MemoryStorage) Reset() {
+	m.lock()
+	defer m.unlock()
+
+	m.memoryState = memoryState{
+		sequences:     make(map[string]int64),
+		users:         make(map[int64]*memoryUser),
+		books:         make(map[int64]*model.Book),
+		refreshTokens: make(map[int64]*memoryRefreshToken),
+		deniedTokens:  make(map[string]time.Time),
+		resetTokens:   make(map[int64]*memoryResetToken),
+		confirmations: make(map[int64]*memoryConfirmationToken),
+		accessTokens:  make(map[int64]*memoryAccessToken),
+		mfaChallenges: make(map[int64]*memoryMFAChallenge),
+		oidcLogins:    make(map[int64]*memoryOIDCLogin),
+		identities:    make(map[int64]*memoryIdentity),
+		throttles:     make(map[string]model.LoginThrottle),
+	}
+}
+
+// WithContext returns the storage itself, operations in memory finish right away.
+func (m *MemoryStorage) WithContext(ctx context.Context) Store {
+	return m
+}
+
+// WithTx runs fn as a transaction, which restores the data on error.
+// Transactions run one at a time and all other operations wait for them,
+// so a rollback only discards the writes of the transaction.
+func (m *MemoryStorage) WithTx(fn func(tx Store) error) error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	m.mu.RLock()
+	saved := m.memoryState.clone()
+	m.mu.RUnlock()
+
+	committed := false
+	defer func() {
+		if !committed {
+			m.mu.Lock()
+			m.memoryState = saved
+			m.mu.Unlock()
+		}
+	}()
+
+	if err := fn(memoryTx{&MemoryStorage{memoryData: m.memoryData, inTx: true}}); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// memoryTx is the MemoryStorage inside WithTx, nested transactions join it.
+type memoryTx struct {
+	*MemoryStorage
+}
+
+func (t memoryTx) WithContext(ctx context.Context) Store {
+	return t
+}
+
+func (t memoryTx) WithTx(fn func(tx Store) error) error {
+	return fn(t)
+}
+
+// Ping always succeeds, there is no connection.
+func (m *MemoryStorage) Ping() error {
+	return nil
+}
+
+// nextID returns the next id of the table, ids are never reused like with AUTOINCREMENT.
+func (m *MemoryStorage) nextID(table string) int64 {
+	m.sequences[table]++
+	return m.sequences[table]
+}
+
+// checkUser enforces the foreign key of rows referencing a user.
+func (m *MemoryStorage) checkUser(userID int64) error {
+	if _, ok := m.users[userID]; !ok {
+		return &Error{ErrConflict, fmt.Errorf("FOREIGN KEY constraint failed")}
+	}
+	return nil
+}
+
+func uniqueViolation(constraint string) error {
+	return &Error{ErrConflict, fmt.Errorf("UNIQUE constraint failed: %s", constraint)}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bookstore/model"
+)
+
+// CreateAuditEvent appends the event to the audit log.
+// The events of deleted users are kept like in the SQL databases.
+func (m *MemoryStorage) CreateAuditEvent(event *model.AuditEvent) error {
+	m.lock()
+	defer m.unlock()
+
+	event.ID = m.nextID("audit_events")
+	stored := *event
+	stored.CreatedAt = stored.CreatedAt.UTC()
+	if event.ActorID != nil {
+		actorID := *event.ActorID
+		stored.ActorID = &actorID
+	}
+	m.auditEvents = append(m.auditEvents, stored)
+
+	return nil
+}
+
+// AuditEvents returns the events matching the filter, newest first.
+func (m *MemoryStorage) AuditEvents(search model.AuditEventListingRequest) (*model.AuditEvents, error) {
+	m.rlock()
+	defer m.runlock()
+
+	limit := int64(model.DefaultAuditEventLimit)
+	if search.Limit != nil {
+		limit = *search.Limit
+	}
+
+	events := make([]model.AuditEvent, 0)
+	for i := len(m.auditEvents) - 1; i >= 0 && int64(len(events)) < limit; i-- {
+		event := m.auditEvents[i]
+		switch {
+		case search.Actor != nil && event.Actor != *search.Actor,
+			search.Action != nil && event.Action != *search.Action,
+			search.Target != nil && event.Target != *search.Target,
+			search.Outcome != nil && event.Outcome != *search.Outcome,
+			search.Since != nil && event.CreatedAt.Before(*search.Since),
+			search.Until != nil && !event.CreatedAt.Before(*search.Until):
+			continue
+		}
+
+		if event.ActorID != nil {
+			actorID := *event.ActorID
+			event.ActorID = &actorID
+		}
+		events = append(events, event)
+	}
+
+	return model.NewAuditEvents(events), nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"bookstore/model"
+)
+
+// bookFilter matches books like the conditions of the BookQueryBuilder.
+type bookFilter func(book *model.Book) bool
+
+func (m *MemoryStorage) queryBooks(filters ...bookFilter) *model.Books {
+	m.rlock()
+	defer m.runlock()
+
+	books := make([]model.Book, 0)
+	for _, book := range m.books {
+		matches := true
+		for _, filter := range filters {
+			matches = matches && filter(book)
+		}
+		if !matches {
+			continue
+		}
+
+		b := *book
+		if u, ok := m.users[book.UserID]; ok {
+			b.User = &model.User{
+				ID:        u.user.ID,
+				Username:  u.user.Username,
+				Role:      u.user.Role,
+				Pseudonym: u.user.Pseudonym,
+				IsAdmin:   u.user.Role == model.RoleAdmin,
+			}
+		}
+		books = append(books, b)
+	}
+
+	// model.DefaultBookSorting and model.DefaultBookSortingDirection
+	sort.Slice(books, func(i, j int) bool {
+		if books[i].Title != books[j].Title {
+			return books[i].Title > books[j].Title
+		}
+		return books[i].ID < books[j].ID
+	})
+
+	return model.NewBooks(books)
+}
+
+func (m *MemoryStorage) queryBook(filters ...bookFilter) *model.Book {
+	books := m.queryBooks(filters...)
+	if len(books.Books) != 1 {
+		return nil
+	}
+	return &books.Books[0]
+}
+
+func withUserID(userID int64) bookFilter {
+	return func(book *model.Book) bool { return userID <= 0 || book.UserID == userID }
+}
+
+func withBookID(bookID int64) bookFilter {
+	return func(book *model.Book) bool { return bookID <= 0 || book.ID == bookID }
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Books returns all books.
+func (m *MemoryStorage) Books() (*model.Books, error) {
+	return m.queryBooks(), nil
+}
+
+// Search Books search books.
+func (m *MemoryStorage) SearchBooks(search model.BookListingRequest) (*model.Books, error) {
+	var filters []bookFilter
+	if search.AutorID != nil {
+		filters = append(filters, withUserID(*search.AutorID))
+	}
+	if search.Title != nil {
+		title := *search.Title
+		filters = append(filters, func(book *model.Book) bool { return containsFold(book.Title, title) })
+	}
+	if search.Description != nil {
+		description := *search.Description
+		filters = append(filters, func(book *model.Book) bool { return containsFold(book.Description, description) })
+	}
+	if search.MinPrice != nil {
+		price := *search.MinPrice
+		filters = append(filters, func(book *model.Book) bool { return price < 0 || book.Price >= price })
+	}
+	if search.MaxPrice != nil {
+		price := *search.MaxPrice
+		filters = append(filters, func(book *model.Book) bool { return price < 0 || book.Price <= price })
+	}
+
+	return m.queryBooks(filters...), nil
+}
+
+// BookByID returns a book by the ID.
+func (m *MemoryStorage) BookByID(bookID int64) (*model.Book, error) {
+	if book := m.queryBook(withBookID(bookID)); book != nil {
+		return book, nil
+	}
+	return nil, notFound(`store: book #%d not found`, bookID)
+}
+
+// BookByIDAndUserID returns a book by the ID and User ID.
+func (m *MemoryStorage) BookByIDAndUserID(userID, bookID int64) (*model.Book, error) {
+	if book := m.queryBook(withUserID(userID), withBookID(bookID)); book != nil {
+		return book, nil
+	}
+	return nil, notFound(`store: book #%d not found`, bookID)
+}
+
+func (m *MemoryStorage) UserBooks(userID int64) (*model.Books, error) {
+	return m.queryBooks(withUserID(userID)), nil
+}
+
+// BookWithSameTitle checks if another book with a given title for the user exists
+func (m *MemoryStorage) BookWithSameTitle(userID int64, bookID int64, title string) bool {
+	m.rlock()
+	defer m.runlock()
+
+	return m.checkBookUniqueness(bookID, userID, title) != nil
+}
+
+// BookForUserExists checks if another book with a given title for the user exists
+func (m *MemoryStorage) BookForUserExists(userID int64, title string) bool {
+	return m.BookWithSameTitle(userID, 0, title)
+}
+
+// checkBookUniqueness enforces the unique title per user.
+func (m *MemoryStorage) checkBookUniqueness(bookID, userID int64, title string) error {
+	for _, book := range m.books {
+		if book.ID != bookID && book.UserID == userID && book.Title == title {
+			return uniqueViolation("books.user_id, books.title")
+		}
+	}
+	return nil
+}
+
+// CreateBook creates a new book.
+func (m *MemoryStorage) CreateBook(userID int64, bookCreationRequest *model.BookCreationRequest) (*model.Book, error) {
+	user, err := m.UserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	err = m.checkUser(userID)
+	if err == nil {
+		err = m.checkBookUniqueness(0, userID, bookCreationRequest.Title)
+	}
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to create book %s: %w`, bookCreationRequest.Title, err)
+	}
+
+	book := &model.Book{
+		ID:          m.nextID("books"),
+		UserID:      userID,
+		Title:       bookCreationRequest.Title,
+		Description: bookCreationRequest.Description,
+		Price:       bookCreationRequest.Price,
+		ImageURL:    bookCreationRequest.ImageURL,
+	}
+	m.books[book.ID] = book
+
+	created := *book
+	created.User = user
+	return &created, nil
+}
+
+// UpdateBook updates a book.
+func (m *MemoryStorage) UpdateBook(book *model.Book) error {
+	m.lock()
+	defer m.unlock()
+
+	stored, ok := m.books[book.ID]
+	if !ok {
+		return notFound(`store: book #%d not found`, book.ID)
+	}
+	if err := m.checkBookUniqueness(book.ID, stored.UserID, book.Title); err != nil {
+		return fmt.Errorf(`store: unable to update book: %w`, err)
+	}
+
+	stored.Title = book.Title
+	stored.Description = book.Description
+	stored.Price = book.Price
+	stored.ImageURL = book.ImageURL
+
+	return nil
+}
+
+func (m *MemoryStorage) DeleteBook(bookID int64) error {
+	m.lock()
+	defer m.unlock()
+
+	if _, ok := m.books[bookID]; !ok {
+		return notFound(`store: book #%d not found`, bookID)
+	}
+	delete(m.books, bookID)
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"bookstore/model"
+)
+
+// CreateOIDCLogin stores a started login until the identity provider redirects back.
+// With a userID other than 0 the login links the identity to the user.
+func (m *MemoryStorage) CreateOIDCLogin(stateHash, nonce, codeVerifier string, userID int64, expiresAt time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	now := time.Now()
+	for id, login := range m.oidcLogins {
+		if login.login.ExpiresAt.Before(now) {
+			delete(m.oidcLogins, id)
+		}
+	}
+
+	if userID != 0 {
+		if err := m.checkUser(userID); err != nil {
+			return fmt.Errorf(`store: unable to create oidc login: %w`, err)
+		}
+	}
+	for _, login := range m.oidcLogins {
+		if login.hash == stateHash {
+			return fmt.Errorf(`store: unable to create oidc login: %w`, uniqueViolation("oidc_logins.state_hash"))
+		}
+	}
+
+	id := m.nextID("oidc_logins")
+	m.oidcLogins[id] = &memoryOIDCLogin{
+		login: model.OIDCLogin{
+			ID:           id,
+			Nonce:        nonce,
+			CodeVerifier: codeVerifier,
+			UserID:       userID,
+			ExpiresAt:    expiresAt.UTC(),
+		},
+		hash: stateHash,
+	}
+
+	return nil
+}
+
+// UseOIDCLogin removes the login with the state and returns it. It returns nil,
+// if the state is unknown or was already used, so every state is only accepted once.
+func (m *MemoryStorage) UseOIDCLogin(stateHash string) (*model.OIDCLogin, error) {
+	m.lock()
+	defer m.unlock()
+
+	for id, login := range m.oidcLogins {
+		if login.hash == stateHash {
+			delete(m.oidcLogins, id)
+			l := login.login
+			return &l, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// UserByIdentity finds the user linked to the subject of the identity provider.
+func (m *MemoryStorage) UserByIdentity(issuer, subject string) (*model.User, error) {
+	m.rlock()
+	defer m.runlock()
+
+	for _, identity := range m.identities {
+		if identity.issuer == issuer && identity.subject == subject {
+			if u, ok := m.users[identity.userID]; ok {
+				return m.fetchUser(u), nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// LinkIdentity links the subject of the identity provider to the user.
+func (m *MemoryStorage) LinkIdentity(userID int64, issuer, subject string) error {
+	m.lock()
+	defer m.unlock()
+
+	if err := m.checkUser(userID); err != nil {
+		return fmt.Errorf(`store: unable to link identity: %w`, err)
+	}
+	for _, identity := range m.identities {
+		if identity.issuer == issuer && identity.subject == subject {
+			return fmt.Errorf(`store: unable to link identity: %w`, uniqueViolation("user_identities.issuer, user_identities.subject"))
+		}
+	}
+
+	id := m.nextID("user_identities")
+	m.identities[id] = &memoryIdentity{userID: userID, issuer: issuer, subject: subject}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bookstore/model"
+)
+
+// Settings returns the runtime settings, missing settings keep their default value.
+func (m *MemoryStorage) Settings() (*model.Settings, error) {
+	m.rlock()
+	defer m.runlock()
+
+	if m.settings == nil {
+		return &model.Settings{SignupApproval: model.SignupApprovalAdmin}, nil
+	}
+
+	settings := *m.settings
+	return &settings, nil
+}
+
+func (m *MemoryStorage) UpdateSettings(settings *model.Settings) error {
+	m.lock()
+	defer m.unlock()
+
+	m.settings = &model.Settings{
+		RequireAdminTOTP: settings.RequireAdminTOTP,
+		SignupApproval:   settings.SignupApproval,
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) LoginThrottle(subject string) (*model.LoginThrottle, error) {
+	m.rlock()
+	defer m.runlock()
+
+	if throttle, ok := m.throttles[subject]; ok {
+		return &throttle, nil
+	}
+
+	return nil, nil
+}
+
+func (m *MemoryStorage) LockLoginThrottle(subject string) (*model.LoginThrottle, error) {
+	m.lock()
+	defer m.unlock()
+
+	throttle, ok := m.throttles[subject]
+	if !ok {
+		throttle = model.LoginThrottle{Subject: subject}
+		m.throttles[subject] = throttle
+	}
+
+	return &throttle, nil
+}
+
+func (m *MemoryStorage) SaveLoginThrottle(throttle *model.LoginThrottle) error {
+	m.lock()
+	defer m.unlock()
+
+	saved := *throttle
+	saved.LastFailureAt = saved.LastFailureAt.UTC()
+	saved.BlockedUntil = saved.BlockedUntil.UTC()
+	m.throttles[throttle.Subject] = saved
+
+	return nil
+}
+
+func (m *MemoryStorage) DeleteLoginThrottle(subject string) error {
+	m.lock()
+	defer m.unlock()
+
+	delete(m.throttles, subject)
+	return nil
+}
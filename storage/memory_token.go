@@ -0,0 +1,387 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"bookstore/model"
+)
+
+func (m *MemoryStorage) CreateRefreshToken(userID int64, familyID, tokenHash, scope string, expiresAt time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	if err := m.checkUser(userID); err != nil {
+		return fmt.Errorf(`store: unable to create refresh token: %w`, err)
+	}
+	for _, token := range m.refreshTokens {
+		if token.hash == tokenHash {
+			return fmt.Errorf(`store: unable to create refresh token: %w`, uniqueViolation("refresh_tokens.token_hash"))
+		}
+	}
+
+	id := m.nextID("refresh_tokens")
+	m.refreshTokens[id] = &memoryRefreshToken{
+		token: model.RefreshToken{
+			ID:        id,
+			UserID:    userID,
+			FamilyID:  familyID,
+			Scope:     scope,
+			ExpiresAt: expiresAt.UTC(),
+		},
+		hash: tokenHash,
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) RefreshTokenByHash(tokenHash string) (*model.RefreshToken, error) {
+	m.rlock()
+	defer m.runlock()
+
+	for _, token := range m.refreshTokens {
+		if token.hash == tokenHash {
+			t := token.token
+			return &t, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// UseRefreshToken marks the token as used. It returns false, if the token
+// was already used or revoked, so only one of concurrent requests can rotate it.
+func (m *MemoryStorage) UseRefreshToken(refreshTokenID int64) (bool, error) {
+	m.lock()
+	defer m.unlock()
+
+	token, ok := m.refreshTokens[refreshTokenID]
+	if !ok || token.token.Used || token.token.Revoked {
+		return false, nil
+	}
+	token.token.Used = true
+
+	return true, nil
+}
+
+func (m *MemoryStorage) RevokeRefreshTokenFamily(familyID string) error {
+	m.lock()
+	defer m.unlock()
+
+	for _, token := range m.refreshTokens {
+		if token.token.FamilyID == familyID {
+			token.token.Revoked = true
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) RevokeUserRefreshTokens(userID int64) error {
+	m.lock()
+	defer m.unlock()
+
+	m.revokeUserRefreshTokens(userID)
+	return nil
+}
+
+func (m *MemoryStorage) revokeUserRefreshTokens(userID int64) {
+	for _, token := range m.refreshTokens {
+		if token.token.UserID == userID {
+			token.token.Revoked = true
+		}
+	}
+}
+
+// DenyToken puts the token id on the denylist until the token expires.
+func (m *MemoryStorage) DenyToken(jti string, expiresAt time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	now := time.Now()
+	for denied, until := range m.deniedTokens {
+		if until.Before(now) {
+			delete(m.deniedTokens, denied)
+		}
+	}
+
+	if _, ok := m.deniedTokens[jti]; !ok {
+		m.deniedTokens[jti] = expiresAt.UTC()
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) TokenDenied(jti string) (bool, error) {
+	m.rlock()
+	defer m.runlock()
+
+	_, ok := m.deniedTokens[jti]
+	return ok, nil
+}
+
+// CreatePasswordResetToken stores a new reset token and discards the older ones of the user.
+func (m *MemoryStorage) CreatePasswordResetToken(userID int64, tokenHash string, expiresAt time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	for id, token := range m.resetTokens {
+		if token.token.UserID == userID {
+			delete(m.resetTokens, id)
+		}
+	}
+
+	if err := m.checkUser(userID); err != nil {
+		return fmt.Errorf(`store: unable to create password reset token: %w`, err)
+	}
+	for _, token := range m.resetTokens {
+		if token.hash == tokenHash {
+			return fmt.Errorf(`store: unable to create password reset token: %w`, uniqueViolation("password_reset_tokens.token_hash"))
+		}
+	}
+
+	id := m.nextID("password_reset_tokens")
+	m.resetTokens[id] = &memoryResetToken{
+		token: model.PasswordResetToken{
+			ID:        id,
+			UserID:    userID,
+			ExpiresAt: expiresAt.UTC(),
+		},
+		hash: tokenHash,
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) PasswordResetTokenByHash(tokenHash string) (*model.PasswordResetToken, error) {
+	m.rlock()
+	defer m.runlock()
+
+	for _, token := range m.resetTokens {
+		if token.hash == tokenHash {
+			t := token.token
+			return &t, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// UsePasswordResetToken marks the token as used. It returns false, if the token was already used.
+func (m *MemoryStorage) UsePasswordResetToken(resetTokenID int64) (bool, error) {
+	m.lock()
+	defer m.unlock()
+
+	token, ok := m.resetTokens[resetTokenID]
+	if !ok || token.token.Used {
+		return false, nil
+	}
+	token.token.Used = true
+
+	return true, nil
+}
+
+// CreateEmailConfirmationToken stores a new confirmation token for the email and discards the older ones of the user.
+func (m *MemoryStorage) CreateEmailConfirmationToken(userID int64, email, tokenHash string, expiresAt time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	for id, token := range m.confirmations {
+		if token.token.UserID == userID {
+			delete(m.confirmations, id)
+		}
+	}
+
+	if err := m.checkUser(userID); err != nil {
+		return fmt.Errorf(`store: unable to create email confirmation token: %w`, err)
+	}
+	for _, token := range m.confirmations {
+		if token.hash == tokenHash {
+			return fmt.Errorf(`store: unable to create email confirmation token: %w`, uniqueViolation("email_confirmation_tokens.token_hash"))
+		}
+	}
+
+	id := m.nextID("email_confirmation_tokens")
+	m.confirmations[id] = &memoryConfirmationToken{
+		token: model.EmailConfirmationToken{
+			ID:        id,
+			UserID:    userID,
+			Email:     email,
+			ExpiresAt: expiresAt.UTC(),
+		},
+		hash: tokenHash,
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) EmailConfirmationTokenByHash(tokenHash string) (*model.EmailConfirmationToken, error) {
+	m.rlock()
+	defer m.runlock()
+
+	for _, token := range m.confirmations {
+		if token.hash == tokenHash {
+			t := token.token
+			return &t, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ConfirmEmail marks the token as used and the email of its user as verified. It returns false,
+// if the token was already used or the user changed the email since the token was sent.
+func (m *MemoryStorage) ConfirmEmail(confirmationTokenID int64) (bool, error) {
+	m.lock()
+	defer m.unlock()
+
+	token, ok := m.confirmations[confirmationTokenID]
+	if !ok || token.token.Used {
+		return false, nil
+	}
+	token.token.Used = true
+
+	u, ok := m.users[token.token.UserID]
+	if !ok || u.user.Email != token.token.Email {
+		return false, nil
+	}
+	u.user.EmailVerified = true
+
+	return true, nil
+}
+
+func (m *MemoryStorage) CreatePersonalAccessToken(userID int64, name, tokenHash, scope string) (*model.PersonalAccessToken, error) {
+	m.lock()
+	defer m.unlock()
+
+	err := m.checkUser(userID)
+	for _, token := range m.accessTokens {
+		if err != nil {
+			break
+		}
+		if token.token.UserID == userID && token.token.Name == name {
+			err = uniqueViolation("personal_access_tokens.user_id, personal_access_tokens.name")
+		} else if token.hash == tokenHash {
+			err = uniqueViolation("personal_access_tokens.token_hash")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to create personal access token %q: %w`, name, err)
+	}
+
+	token := &memoryAccessToken{
+		token: model.PersonalAccessToken{
+			ID:        m.nextID("personal_access_tokens"),
+			UserID:    userID,
+			Name:      name,
+			Scope:     scope,
+			CreatedAt: time.Now().UTC(),
+		},
+		hash: tokenHash,
+	}
+	m.accessTokens[token.token.ID] = token
+
+	t := token.token
+	return &t, nil
+}
+
+func (m *MemoryStorage) PersonalAccessTokens(userID int64) (*model.PersonalAccessTokens, error) {
+	m.rlock()
+	defer m.runlock()
+
+	tokens := make([]model.PersonalAccessToken, 0)
+	for _, token := range m.accessTokens {
+		if token.token.UserID == userID {
+			tokens = append(tokens, copyPersonalAccessToken(token))
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+
+	return model.NewPersonalAccessTokens(tokens), nil
+}
+
+func (m *MemoryStorage) PersonalAccessTokenByIDAndUserID(userID, tokenID int64) (*model.PersonalAccessToken, error) {
+	m.rlock()
+	defer m.runlock()
+
+	if token, ok := m.accessTokens[tokenID]; ok && token.token.UserID == userID {
+		t := copyPersonalAccessToken(token)
+		return &t, nil
+	}
+
+	return nil, notFound(`store: personal access token #%d not found`, tokenID)
+}
+
+func (m *MemoryStorage) PersonalAccessTokenByHash(tokenHash string) (*model.PersonalAccessToken, error) {
+	m.rlock()
+	defer m.runlock()
+
+	for _, token := range m.accessTokens {
+		if token.hash == tokenHash {
+			t := copyPersonalAccessToken(token)
+			return &t, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func copyPersonalAccessToken(token *memoryAccessToken) model.PersonalAccessToken {
+	t := token.token
+	if t.LastUsedAt != nil {
+		lastUsedAt := *t.LastUsedAt
+		t.LastUsedAt = &lastUsedAt
+	}
+	return t
+}
+
+func (m *MemoryStorage) PersonalAccessTokenExists(userID int64, name string) bool {
+	m.rlock()
+	defer m.runlock()
+
+	for _, token := range m.accessTokens {
+		if token.token.UserID == userID && token.token.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MemoryStorage) TouchPersonalAccessToken(tokenID int64) error {
+	m.lock()
+	defer m.unlock()
+
+	if token, ok := m.accessTokens[tokenID]; ok {
+		now := time.Now().UTC()
+		token.token.LastUsedAt = &now
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) DeletePersonalAccessToken(tokenID int64) error {
+	m.lock()
+	defer m.unlock()
+
+	if _, ok := m.accessTokens[tokenID]; !ok {
+		return notFound(`store: personal access token #%d not found`, tokenID)
+	}
+	delete(m.accessTokens, tokenID)
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"bookstore/model"
+)
+
+func (m *MemoryStorage) UserTOTP(userID int64) (*model.TOTP, error) {
+	m.rlock()
+	defer m.runlock()
+
+	if u, ok := m.users[userID]; ok {
+		totp := u.totp
+		return &totp, nil
+	}
+
+	return nil, nil
+}
+
+// SetTOTPSecret stores a new secret, which is not active until EnableTOTP is called.
+func (m *MemoryStorage) SetTOTPSecret(userID int64, secret string) error {
+	m.lock()
+	defer m.unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.totp = model.TOTP{Secret: secret}
+	}
+
+	return nil
+}
+
+// EnableTOTP activates the stored secret and replaces the recovery codes of the user.
+func (m *MemoryStorage) EnableTOTP(userID int64, step int64, recoveryCodeHashes []string) error {
+	m.lock()
+	defer m.unlock()
+
+	if err := m.checkUser(userID); err != nil && len(recoveryCodeHashes) > 0 {
+		return fmt.Errorf(`store: unable to create recovery code: %w`, err)
+	}
+	seen := make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		if seen[hash] {
+			return fmt.Errorf(`store: unable to create recovery code: %w`, uniqueViolation("recovery_codes.user_id, recovery_codes.code_hash"))
+		}
+		seen[hash] = true
+	}
+
+	if u, ok := m.users[userID]; ok {
+		u.totp.Enabled = true
+		u.totp.LastStep = step
+	}
+
+	m.deleteRecoveryCodes(userID)
+	for _, hash := range recoveryCodeHashes {
+		m.recoveryCodes = append(m.recoveryCodes, &memoryRecoveryCode{userID: userID, hash: hash})
+	}
+
+	return nil
+}
+
+// DisableTOTP removes the secret and the recovery codes of the user.
+func (m *MemoryStorage) DisableTOTP(userID int64) error {
+	m.lock()
+	defer m.unlock()
+
+	if u, ok := m.users[userID]; ok {
+		u.totp = model.TOTP{}
+	}
+	m.deleteRecoveryCodes(userID)
+
+	return nil
+}
+
+func (m *MemoryStorage) deleteRecoveryCodes(userID int64) {
+	codes := m.recoveryCodes[:0]
+	for _, code := range m.recoveryCodes {
+		if code.userID != userID {
+			codes = append(codes, code)
+		}
+	}
+	m.recoveryCodes = codes
+}
+
+// UseTOTPStep remembers the time step of an accepted code. It returns false,
+// if a code of the same or a later step was already used, so codes cannot be replayed.
+func (m *MemoryStorage) UseTOTPStep(userID int64, step int64) (bool, error) {
+	m.lock()
+	defer m.unlock()
+
+	u, ok := m.users[userID]
+	if !ok || u.totp.LastStep >= step {
+		return false, nil
+	}
+	u.totp.LastStep = step
+
+	return true, nil
+}
+
+// UseRecoveryCode marks the recovery code as used. It returns false, if the code is unknown or was already used.
+func (m *MemoryStorage) UseRecoveryCode(userID int64, codeHash string) (bool, error) {
+	m.lock()
+	defer m.unlock()
+
+	for _, code := range m.recoveryCodes {
+		if code.userID == userID && code.hash == codeHash && !code.used {
+			code.used = true
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// CreateMFAChallenge stores a challenge, which is answered with the second factor.
+func (m *MemoryStorage) CreateMFAChallenge(userID int64, tokenHash, scope string, expiresAt time.Time) error {
+	m.lock()
+	defer m.unlock()
+
+	now := time.Now()
+	for id, challenge := range m.mfaChallenges {
+		if challenge.challenge.ExpiresAt.Before(now) {
+			delete(m.mfaChallenges, id)
+		}
+	}
+
+	if err := m.checkUser(userID); err != nil {
+		return fmt.Errorf(`store: unable to create mfa challenge: %w`, err)
+	}
+	for _, challenge := range m.mfaChallenges {
+		if challenge.hash == tokenHash {
+			return fmt.Errorf(`store: unable to create mfa challenge: %w`, uniqueViolation("mfa_challenges.token_hash"))
+		}
+	}
+
+	id := m.nextID("mfa_challenges")
+	m.mfaChallenges[id] = &memoryMFAChallenge{
+		challenge: model.MFAChallenge{
+			ID:        id,
+			UserID:    userID,
+			Scope:     scope,
+			ExpiresAt: expiresAt.UTC(),
+		},
+		hash: tokenHash,
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) MFAChallengeByHash(tokenHash string) (*model.MFAChallenge, error) {
+	m.rlock()
+	defer m.runlock()
+
+	for _, challenge := range m.mfaChallenges {
+		if challenge.hash == tokenHash {
+			c := challenge.challenge
+			return &c, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// DeleteMFAChallenge removes the answered challenge. It returns false, if it was already removed.
+func (m *MemoryStorage) DeleteMFAChallenge(challengeID int64) (bool, error) {
+	m.lock()
+	defer m.unlock()
+
+	if _, ok := m.mfaChallenges[challengeID]; !ok {
+		return false, nil
+	}
+	delete(m.mfaChallenges, challengeID)
+
+	return true, nil
+}
@@ -0,0 +1,392 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"bookstore/model"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UserByUsername finds a user by the username.
+func (m *MemoryStorage) UserByUsername(username string) (*model.User, error) {
+	m.rlock()
+	defer m.runlock()
+
+	return m.findUser(func(u *memoryUser) bool {
+		return u.user.Username == strings.ToLower(username)
+	}), nil
+}
+
+func (m *MemoryStorage) UserByID(userID int64) (*model.User, error) {
+	m.rlock()
+	defer m.runlock()
+
+	if u, ok := m.users[userID]; ok {
+		return m.fetchUser(u), nil
+	}
+	return nil, notFound(`store: user #%d not found`, userID)
+}
+
+// UserByEmail finds the user with the confirmed email address. If several users
+// confirmed the address, none of them is returned.
+func (m *MemoryStorage) UserByEmail(email string) (*model.User, error) {
+	m.rlock()
+	defer m.runlock()
+
+	var found *memoryUser
+	for _, u := range m.users {
+		if u.user.EmailVerified && strings.EqualFold(u.user.Email, email) {
+			if found != nil {
+				return nil, nil
+			}
+			found = u
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	return m.fetchUser(found), nil
+}
+
+func (m *MemoryStorage) findUser(match func(u *memoryUser) bool) *model.User {
+	for _, u := range m.users {
+		if match(u) {
+			return m.fetchUser(u)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) fetchUser(u *memoryUser) *model.User {
+	user := m.listUser(u)
+	user.TokenVersion = u.user.TokenVersion
+	user.Permissions = rolePermissions(user.Role)
+	return &user
+}
+
+// listUser returns the fields included in user listings.
+func (m *MemoryStorage) listUser(u *memoryUser) model.User {
+	return model.User{
+		ID:            u.user.ID,
+		Username:      u.user.Username,
+		Role:          u.user.Role,
+		Pseudonym:     u.user.Pseudonym,
+		Email:         u.user.Email,
+		EmailVerified: u.user.EmailVerified,
+		Status:        u.user.Status,
+		IsAdmin:       u.user.Role == model.RoleAdmin,
+		TOTPEnabled:   u.totp.Enabled,
+	}
+}
+
+// Users returns all users.
+func (m *MemoryStorage) Users() (*model.Users, error) {
+	return m.fetchUsers(func(u *memoryUser) bool { return true }), nil
+}
+
+// PendingUsers returns the users, who wait for approval.
+func (m *MemoryStorage) PendingUsers() (*model.Users, error) {
+	return m.fetchUsers(func(u *memoryUser) bool { return u.user.Status == model.UserStatusPending }), nil
+}
+
+func (m *MemoryStorage) fetchUsers(match func(u *memoryUser) bool) *model.Users {
+	m.rlock()
+	defer m.runlock()
+
+	users := make([]model.User, 0)
+	for _, u := range m.users {
+		if match(u) {
+			users = append(users, m.listUser(u))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	return model.NewUsers(users)
+}
+
+// CheckPassword validate the hashed password. Hashes of a weaker algorithm or cost
+// than the configured one are replaced after the password was verified.
+func (m *MemoryStorage) CheckPassword(username, password string) error {
+	username = strings.ToLower(username)
+
+	// the hash is verified without holding the lock, as it is slow on purpose
+	m.rlock()
+	var userID int64
+	var hash string
+	for _, u := range m.users {
+		if u.user.Username == username {
+			userID, hash = u.user.ID, u.password
+		}
+	}
+	m.runlock()
+
+	if userID == 0 {
+		return fmt.Errorf(`store: unable to find this user: %s`, username)
+	}
+
+	rehash, err := m.passwordPolicy().Verify(hash, password)
+	if err != nil {
+		return fmt.Errorf(`store: invalid password for "%s" (%w)`, username, err)
+	}
+
+	if rehash {
+		// the password was correct, a failed upgrade is repeated on the next login
+		if err := m.rehashPassword(userID, hash, password); err != nil {
+			log.Errorf("[CheckPassword] Could not rehash the password of user %d: %v", userID, err)
+		}
+	}
+
+	return nil
+}
+
+// rehashPassword replaces the hash, unless the password was changed in the meantime.
+func (m *MemoryStorage) rehashPassword(userID int64, oldHash, password string) error {
+	hashedPassword, err := m.passwordPolicy().Hash(password)
+	if err != nil {
+		return err
+	}
+
+	m.lock()
+	defer m.unlock()
+	if u, ok := m.users[userID]; ok && u.password == oldHash {
+		u.password = hashedPassword
+	}
+
+	return nil
+}
+
+// checkUserUniqueness enforces the unique username and pseudonym.
+func (m *MemoryStorage) checkUserUniqueness(userID int64, username, pseudonym string) error {
+	for _, u := range m.users {
+		if u.user.ID == userID {
+			continue
+		}
+		if u.user.Username == username {
+			return uniqueViolation("users.username")
+		}
+		if u.user.Pseudonym == pseudonym {
+			return uniqueViolation("users.pseudonym")
+		}
+	}
+	return nil
+}
+
+// CreateUser creates a new user.
+func (m *MemoryStorage) CreateUser(userCreationRequest *model.UserCreationRequest) (*model.User, error) {
+	var hashedPassword string
+	var err error
+	if userCreationRequest.Password != "" {
+		hashedPassword, err = m.passwordPolicy().Hash(userCreationRequest.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status := userCreationRequest.Status
+	if status == "" {
+		status = model.UserStatusActive
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	username := strings.ToLower(userCreationRequest.Username)
+	if err := m.checkUserUniqueness(0, username, userCreationRequest.Pseudonym); err != nil {
+		return nil, fmt.Errorf(`store: unable to create user %q: %w`, userCreationRequest.Username, err)
+	}
+
+	u := &memoryUser{
+		user: model.User{
+			ID:            m.nextID("users"),
+			Username:      username,
+			Pseudonym:     userCreationRequest.Pseudonym,
+			Email:         userCreationRequest.Email,
+			EmailVerified: userCreationRequest.EmailVerified && userCreationRequest.Email != "",
+			Role:          roleName(userCreationRequest.RoleName()),
+			Status:        status,
+		},
+		password: hashedPassword,
+	}
+	m.users[u.user.ID] = u
+
+	return m.fetchUser(u), nil
+}
+
+// UpdateUser updates a user.
+func (m *MemoryStorage) UpdateUser(user *model.User) error {
+	var hashedPassword string
+	var err error
+	if user.Password != "" {
+		hashedPassword, err = m.passwordPolicy().Hash(user.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.lock()
+	defer m.unlock()
+
+	username := strings.ToLower(user.Username)
+	u, ok := m.users[user.ID]
+	if !ok {
+		return notFound(`store: user #%d not found`, user.ID)
+	}
+	if err := m.checkUserUniqueness(user.ID, username, user.Pseudonym); err != nil {
+		return fmt.Errorf(`store: unable to update user: %w`, err)
+	}
+
+	u.user.Username = username
+	u.user.Pseudonym = user.Pseudonym
+	if u.user.Email != user.Email {
+		// a new email has to be confirmed again
+		u.user.EmailVerified = false
+	}
+	u.user.Email = user.Email
+	u.user.Role = roleName(user.Role)
+	if hashedPassword != "" {
+		// a new password invalidates all tokens issued so far
+		u.password = hashedPassword
+		u.user.TokenVersion++
+		m.revokeUserRefreshTokens(user.ID)
+		user.TokenVersion++
+	}
+
+	return nil
+}
+
+// SetUserStatus changes the status of the user, e.g. to approve a pending user.
+func (m *MemoryStorage) SetUserStatus(userID int64, status string) error {
+	m.lock()
+	defer m.unlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return notFound(`store: user #%d not found`, userID)
+	}
+	u.user.Status = status
+
+	return nil
+}
+
+// DeleteUser deletes the user and everything referencing it, except the audit events.
+func (m *MemoryStorage) DeleteUser(userID int64) error {
+	m.lock()
+	defer m.unlock()
+
+	if _, ok := m.users[userID]; !ok {
+		return notFound(`store: user #%d not found`, userID)
+	}
+	delete(m.users, userID)
+	for id, book := range m.books {
+		if book.UserID == userID {
+			delete(m.books, id)
+		}
+	}
+	for id, token := range m.refreshTokens {
+		if token.token.UserID == userID {
+			delete(m.refreshTokens, id)
+		}
+	}
+	for id, token := range m.resetTokens {
+		if token.token.UserID == userID {
+			delete(m.resetTokens, id)
+		}
+	}
+	for id, token := range m.confirmations {
+		if token.token.UserID == userID {
+			delete(m.confirmations, id)
+		}
+	}
+	for id, token := range m.accessTokens {
+		if token.token.UserID == userID {
+			delete(m.accessTokens, id)
+		}
+	}
+	for id, challenge := range m.mfaChallenges {
+		if challenge.challenge.UserID == userID {
+			delete(m.mfaChallenges, id)
+		}
+	}
+	for id, identity := range m.identities {
+		if identity.userID == userID {
+			delete(m.identities, id)
+		}
+	}
+	for id, login := range m.oidcLogins {
+		if login.login.UserID == userID {
+			delete(m.oidcLogins, id)
+		}
+	}
+	m.deleteRecoveryCodes(userID)
+
+	return nil
+}
+
+// UserExists checks if a user exists by using the given username.
+func (m *MemoryStorage) UserExists(username string) bool {
+	return m.AnotherUserExists(0, username)
+}
+
+func (m *MemoryStorage) UserWithPseudonymExists(pseudonym string) bool {
+	m.rlock()
+	defer m.runlock()
+
+	return m.findUser(func(u *memoryUser) bool { return u.user.Pseudonym == pseudonym }) != nil
+}
+
+// AnotherUserExists checks if another user exists with the given username.
+func (m *MemoryStorage) AnotherUserExists(userID int64, username string) bool {
+	m.rlock()
+	defer m.runlock()
+
+	return m.findUser(func(u *memoryUser) bool {
+		return u.user.ID != userID && u.user.Username == strings.ToLower(username)
+	}) != nil
+}
+
+func (m *MemoryStorage) Roles() (*model.Roles, error) {
+	roles := make([]model.Role, 0, len(memoryRoles))
+	for name := range memoryRoles {
+		roles = append(roles, model.Role{Name: name, Permissions: rolePermissions(name)})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+
+	return model.NewRoles(roles), nil
+}
+
+func (m *MemoryStorage) RoleExists(name string) bool {
+	_, ok := memoryRoles[name]
+	return ok
+}
+
+// roleName returns the name of an existing role, users of an unknown role have none.
+func roleName(name string) string {
+	if _, ok := memoryRoles[name]; ok {
+		return name
+	}
+	return ""
+}
+
+func rolePermissions(name string) []model.Permission {
+	permissions := append([]model.Permission{}, memoryRoles[name]...)
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i] < permissions[j] })
+	return permissions
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"bookstore/model"
+)
+
+// CreateOIDCLogin stores a started login until the identity provider redirects back.
+// With a userID other than 0 the login links the identity to the user.
+func (s *Storage) CreateOIDCLogin(stateHash, nonce, codeVerifier string, userID int64, expiresAt time.Time) error {
+	_, err := s.exec(`DELETE FROM oidc_logins WHERE expires_at < $1`, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf(`store: unable to clean up oidc logins: %w`, err)
+	}
+
+	query := `
+		INSERT INTO oidc_logins
+			(state_hash, nonce, code_verifier, user_id, expires_at)
+		VALUES
+			($1, $2, $3, $4, $5)
+	`
+
+	var linkUserID sql.NullInt64
+	if userID != 0 {
+		linkUserID = sql.NullInt64{Int64: userID, Valid: true}
+	}
+
+	_, err = s.exec(query, stateHash, nonce, codeVerifier, linkUserID, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf(`store: unable to create oidc login: %w`, err)
+	}
+
+	return nil
+}
+
+// UseOIDCLogin removes the login with the state and returns it. It returns nil,
+// if the state is unknown or was already used, so every state is only accepted once.
+func (s *Storage) UseOIDCLogin(stateHash string) (*model.OIDCLogin, error) {
+	query := `
+		SELECT
+			login_id,
+			nonce,
+			code_verifier,
+			user_id,
+			expires_at
+		FROM
+			oidc_logins
+		WHERE
+			state_hash = $1
+	`
+
+	var login model.OIDCLogin
+	var linkUserID sql.NullInt64
+	err := s.queryRow(query, stateHash).Scan(
+		&login.ID,
+		&login.Nonce,
+		&login.CodeVerifier,
+		&linkUserID,
+		&login.ExpiresAt,
+	)
+	login.UserID = linkUserID.Int64
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch oidc login: %w`, err)
+	}
+
+	result, err := s.exec(`DELETE FROM oidc_logins WHERE login_id = $1`, login.ID)
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to delete oidc login: %w`, err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to delete oidc login: %w`, err)
+	}
+	if count != 1 {
+		return nil, nil
+	}
+
+	return &login, nil
+}
+
+// UserByIdentity finds the user linked to the subject of the identity provider.
+func (s *Storage) UserByIdentity(issuer, subject string) (*model.User, error) {
+	query := `
+		SELECT
+			u.user_id,
+			u.username,
+			COALESCE(r.name, ''),
+			u.pseudonym,
+			u.email,
+			u.email_verified,
+			u.status,
+			u.totp_enabled,
+			u.token_version
+		FROM
+			users u
+		JOIN
+			user_identities i ON i.user_id=u.user_id
+		LEFT JOIN
+			roles r ON r.role_id=u.role_id
+		WHERE
+			i.issuer = $1 AND i.subject = $2
+	`
+	return s.fetchUser(query, issuer, subject)
+}
+
+// LinkIdentity links the subject of the identity provider to the user.
+func (s *Storage) LinkIdentity(userID int64, issuer, subject string) error {
+	query := `
+		INSERT INTO user_identities
+			(user_id, issuer, subject)
+		VALUES
+			($1, $2, $3)
+	`
+
+	_, err := s.exec(query, userID, issuer, subject)
+	if err != nil {
+		return fmt.Errorf(`store: unable to link identity: %w`, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"bookstore/model"
+)
+
+func (s *Storage) CreatePersonalAccessToken(userID int64, name, tokenHash, scope string) (*model.PersonalAccessToken, error) {
+	query := `
+		INSERT INTO personal_access_tokens
+			(user_id, name, token_hash, scope, created_at)
+		VALUES
+			($1, $2, $3, $4, $5)
+		RETURNING
+			token_id,
+			user_id,
+			name,
+			scope
+	`
+
+	token := model.PersonalAccessToken{CreatedAt: time.Now().UTC()}
+	err := s.queryRow(query, userID, name, tokenHash, scope, token.CreatedAt).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.Scope,
+	)
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to create personal access token %q: %w`, name, err)
+	}
+
+	return &token, nil
+}
+
+func (s *Storage) PersonalAccessTokens(userID int64) (*model.PersonalAccessTokens, error) {
+	query := `
+		SELECT
+			token_id,
+			user_id,
+			name,
+			scope,
+			created_at,
+			last_used_at
+		FROM
+			personal_access_tokens
+		WHERE
+			user_id = $1
+		ORDER BY name ASC
+	`
+	rows, err := s.query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch personal access tokens: %w`, err)
+	}
+	defer rows.Close()
+
+	tokens := make([]model.PersonalAccessToken, 0)
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf(`store: unable to fetch personal access tokens row: %w`, err)
+		}
+
+		tokens = append(tokens, *token)
+	}
+
+	return model.NewPersonalAccessTokens(tokens), nil
+}
+
+func (s *Storage) PersonalAccessTokenByIDAndUserID(userID, tokenID int64) (*model.PersonalAccessToken, error) {
+	query := `
+		SELECT
+			token_id,
+			user_id,
+			name,
+			scope,
+			created_at,
+			last_used_at
+		FROM
+			personal_access_tokens
+		WHERE
+			user_id = $1 AND token_id = $2
+	`
+	token, err := s.fetchPersonalAccessToken(query, userID, tokenID)
+	if err == nil && token == nil {
+		return nil, notFound(`store: personal access token #%d not found`, tokenID)
+	}
+	return token, err
+}
+
+func (s *Storage) PersonalAccessTokenByHash(tokenHash string) (*model.PersonalAccessToken, error) {
+	query := `
+		SELECT
+			token_id,
+			user_id,
+			name,
+			scope,
+			created_at,
+			last_used_at
+		FROM
+			personal_access_tokens
+		WHERE
+			token_hash = $1
+	`
+	return s.fetchPersonalAccessToken(query, tokenHash)
+}
+
+func (s *Storage) fetchPersonalAccessToken(query string, args ...interface{}) (*model.PersonalAccessToken, error) {
+	token, err := scanPersonalAccessToken(s.queryRow(query, args...))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch personal access token: %w`, err)
+	}
+
+	return token, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPersonalAccessToken(row rowScanner) (*model.PersonalAccessToken, error) {
+	var token model.PersonalAccessToken
+	var lastUsedAt sql.NullTime
+
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.Scope,
+		&token.CreatedAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return &token, nil
+}
+
+func (s *Storage) PersonalAccessTokenExists(userID int64, name string) bool {
+	var result bool
+	s.queryRow(`SELECT true FROM personal_access_tokens WHERE user_id = $1 AND name = $2`, userID, name).Scan(&result)
+	return result
+}
+
+func (s *Storage) TouchPersonalAccessToken(tokenID int64) error {
+	_, err := s.exec(`UPDATE personal_access_tokens SET last_used_at = $1 WHERE token_id = $2`, time.Now().UTC(), tokenID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to update personal access token: %w`, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) DeletePersonalAccessToken(tokenID int64) error {
+	result, err := s.exec(`DELETE FROM personal_access_tokens WHERE token_id = $1`, tokenID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to delete personal access token: %w`, err)
+	}
+
+	return changedRow(result, "personal access token", tokenID)
+}
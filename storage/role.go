@@ -0,0 +1,94 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+
+	"bookstore/model"
+)
+
+func (s *Storage) Roles() (*model.Roles, error) {
+	query := `
+		SELECT
+			r.name,
+			p.permission
+		FROM
+			roles r
+		LEFT JOIN
+			role_permissions p ON p.role_id=r.role_id
+		ORDER BY r.name ASC, p.permission ASC
+	`
+	rows, err := s.query(query)
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch roles: %w`, err)
+	}
+	defer rows.Close()
+
+	roles := make([]model.Role, 0)
+	for rows.Next() {
+		var name string
+		var permission *string
+		if err := rows.Scan(&name, &permission); err != nil {
+			return nil, fmt.Errorf(`store: unable to fetch roles row: %w`, err)
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].Name != name {
+			roles = append(roles, model.Role{Name: name, Permissions: []model.Permission{}})
+		}
+		if permission != nil {
+			role := &roles[len(roles)-1]
+			role.Permissions = append(role.Permissions, model.Permission(*permission))
+		}
+	}
+
+	return model.NewRoles(roles), nil
+}
+
+func (s *Storage) RoleExists(name string) bool {
+	var result bool
+	s.queryRow(`SELECT true FROM roles WHERE name=$1`, name).Scan(&result)
+	return result
+}
+
+func (s *Storage) rolePermissions(name string) ([]model.Permission, error) {
+	query := `
+		SELECT
+			p.permission
+		FROM
+			role_permissions p
+		INNER JOIN
+			roles r ON r.role_id=p.role_id
+		WHERE
+			r.name=$1
+		ORDER BY p.permission ASC
+	`
+	rows, err := s.query(query, name)
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch permissions: %w`, err)
+	}
+	defer rows.Close()
+
+	permissions := make([]model.Permission, 0)
+	for rows.Next() {
+		var permission model.Permission
+		if err := rows.Scan(&permission); err != nil {
+			return nil, fmt.Errorf(`store: unable to fetch permissions row: %w`, err)
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, nil
+}
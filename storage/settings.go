@@ -0,0 +1,72 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"strconv"
+
+	"bookstore/model"
+)
+
+const (
+	settingRequireAdminTOTP = "require_admin_totp"
+	settingSignupApproval   = "signup_approval"
+)
+
+// Settings returns the runtime settings, missing settings keep their default value.
+func (s *Storage) Settings() (*model.Settings, error) {
+	rows, err := s.query(`SELECT name, value FROM settings`)
+	if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch settings: %w`, err)
+	}
+	defer rows.Close()
+
+	settings := model.Settings{SignupApproval: model.SignupApprovalAdmin}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, fmt.Errorf(`store: unable to fetch settings row: %w`, err)
+		}
+
+		switch name {
+		case settingRequireAdminTOTP:
+			settings.RequireAdminTOTP, err = strconv.ParseBool(value)
+		case settingSignupApproval:
+			settings.SignupApproval = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf(`store: invalid value for setting %s: %w`, name, err)
+		}
+	}
+
+	return &settings, nil
+}
+
+func (s *Storage) UpdateSettings(settings *model.Settings) error {
+	values := map[string]string{
+		settingRequireAdminTOTP: strconv.FormatBool(settings.RequireAdminTOTP),
+		settingSignupApproval:   settings.SignupApproval,
+	}
+
+	for name, value := range values {
+		_, err := s.exec(`INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET value = excluded.value`, name, value)
+		if err != nil {
+			return fmt.Errorf(`store: unable to update setting %s: %w`, name, err)
+		}
+	}
+
+	return nil
+}
@@ -15,21 +15,157 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"time"
+
+	"bookstore/hasher"
 )
 
-// Storage handles all operations related to the database.
+// DefaultQueryTimeout is the deadline of a single query, unless SetQueryTimeout changes it.
+const DefaultQueryTimeout = 5 * time.Second
+
+// Storage implements the Store on a SQL database, either SQLite or PostgreSQL.
+// The queries are written in the SQL both understand, with $n placeholders in ascending order.
 type Storage struct {
-	db *sql.DB
+	db           *sql.DB
+	tx           *sql.Tx
+	passwords    *hasher.Policy
+	ctx          context.Context
+	queryTimeout time.Duration
 }
 
-// NewStorage returns a new Storage.
+// NewStorage returns a new Storage, which hashes passwords with the default policy.
 func NewStorage(db *sql.DB) *Storage {
-	return &Storage{db}
+	return &Storage{db, nil, hasher.DefaultPolicy(), context.Background(), DefaultQueryTimeout}
+}
+
+// SetPasswordPolicy replaces the policy used to hash and verify passwords.
+func (s *Storage) SetPasswordPolicy(passwords *hasher.Policy) {
+	s.passwords = passwords
+}
+
+// SetQueryTimeout sets the deadline of every query, 0 disables it.
+func (s *Storage) SetQueryTimeout(timeout time.Duration) {
+	s.queryTimeout = timeout
+}
+
+// WithContext returns a Storage, whose queries are cancelled with the context.
+func (s *Storage) WithContext(ctx context.Context) Store {
+	bound := *s
+	bound.ctx = ctx
+	return &bound
+}
+
+// WithTx runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise.
+// Calls of WithTx inside fn join the running transaction.
+func (s *Storage) WithTx(fn func(tx Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return fmt.Errorf(`store: unable to begin transaction: %w`, err)
+	}
+	// a panic or an error of fn rolls back, after a commit the rollback does nothing
+	defer tx.Rollback()
+
+	bound := *s
+	bound.tx = tx
+	if err := fn(&bound); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf(`store: unable to commit transaction: %w`, driverError(err))
+	}
+
+	return nil
 }
 
 // Ping checks if the database connection works.
 func (s *Storage) Ping() error {
-	_, err := s.db.Exec(`SELECT true`)
+	_, err := s.exec(`SELECT true`)
 	return err
 }
+
+// queryContext returns the context of a single query, which ends with the context
+// of the storage or after the query timeout.
+func (s *Storage) queryContext() (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return context.WithCancel(s.ctx)
+	}
+	return context.WithTimeout(s.ctx, s.queryTimeout)
+}
+
+// changedRow returns ErrNotFound, if the statement did not change the row of the entity.
+func changedRow(result sql.Result, entity string, id int64) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf(`store: unable to count changed rows: %w`, err)
+	}
+	if n == 0 {
+		return notFound(`store: %s #%d not found`, entity, id)
+	}
+	return nil
+}
+
+// queryer is either the database or the transaction of the storage.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *Storage) queryer() queryer {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+func (s *Storage) exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	result, err := s.queryer().ExecContext(ctx, query, args...)
+	return result, driverError(err)
+}
+
+// queryRows are the rows of a query, closing them ends the query context.
+type queryRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *queryRows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+func (s *Storage) query(query string, args ...interface{}) (*queryRows, error) {
+	ctx, cancel := s.queryContext()
+	rows, err := s.queryer().QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, driverError(err)
+	}
+	return &queryRows{rows, cancel}, nil
+}
+
+// queryRow is the row of a query, scanning it ends the query context.
+type queryRow struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+func (r *queryRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return driverError(r.Row.Scan(dest...))
+}
+
+func (s *Storage) queryRow(query string, args ...interface{}) *queryRow {
+	ctx, cancel := s.queryContext()
+	return &queryRow{s.queryer().QueryRowContext(ctx, query, args...), cancel}
+}
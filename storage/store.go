@@ -0,0 +1,115 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"bookstore/model"
+)
+
+// Store is the storage API used by the handlers and validators.
+// Methods addressing an entity by its id return ErrNotFound, if it does not exist, searches by
+// other attributes return nil without error. Writes violating a constraint return ErrConflict
+// or ErrInvalid.
+type Store interface {
+	// WithContext returns the Store, whose operations end with the context,
+	// e.g. when the client of the request goes away.
+	WithContext(ctx context.Context) Store
+	// WithTx runs fn as one unit of work, whose writes are all committed or all rolled back.
+	// Validations done through tx see the state the writes are applied to.
+	WithTx(fn func(tx Store) error) error
+	Ping() error
+
+	Books() (*model.Books, error)
+	SearchBooks(search model.BookListingRequest) (*model.Books, error)
+	BookByID(bookID int64) (*model.Book, error)
+	BookByIDAndUserID(userID, bookID int64) (*model.Book, error)
+	UserBooks(userID int64) (*model.Books, error)
+	BookWithSameTitle(userID int64, bookID int64, title string) bool
+	BookForUserExists(userID int64, title string) bool
+	CreateBook(userID int64, bookCreationRequest *model.BookCreationRequest) (*model.Book, error)
+	UpdateBook(book *model.Book) error
+	DeleteBook(bookID int64) error
+
+	UserByUsername(username string) (*model.User, error)
+	UserByID(userID int64) (*model.User, error)
+	UserByEmail(email string) (*model.User, error)
+	Users() (*model.Users, error)
+	PendingUsers() (*model.Users, error)
+	CheckPassword(username, password string) error
+	CreateUser(userCreationRequest *model.UserCreationRequest) (*model.User, error)
+	UpdateUser(user *model.User) error
+	SetUserStatus(userID int64, status string) error
+	DeleteUser(userID int64) error
+	UserExists(username string) bool
+	UserWithPseudonymExists(pseudonym string) bool
+	AnotherUserExists(userID int64, username string) bool
+
+	Roles() (*model.Roles, error)
+	RoleExists(name string) bool
+
+	Settings() (*model.Settings, error)
+	UpdateSettings(settings *model.Settings) error
+
+	LoginThrottle(subject string) (*model.LoginThrottle, error)
+	// LockLoginThrottle has to be called in a transaction, which holds the lock until it ends.
+	LockLoginThrottle(subject string) (*model.LoginThrottle, error)
+	SaveLoginThrottle(throttle *model.LoginThrottle) error
+	DeleteLoginThrottle(subject string) error
+
+	CreateRefreshToken(userID int64, familyID, tokenHash, scope string, expiresAt time.Time) error
+	RefreshTokenByHash(tokenHash string) (*model.RefreshToken, error)
+	UseRefreshToken(refreshTokenID int64) (bool, error)
+	RevokeRefreshTokenFamily(familyID string) error
+	RevokeUserRefreshTokens(userID int64) error
+	DenyToken(jti string, expiresAt time.Time) error
+	TokenDenied(jti string) (bool, error)
+	CreatePasswordResetToken(userID int64, tokenHash string, expiresAt time.Time) error
+	PasswordResetTokenByHash(tokenHash string) (*model.PasswordResetToken, error)
+	UsePasswordResetToken(resetTokenID int64) (bool, error)
+	CreateEmailConfirmationToken(userID int64, email, tokenHash string, expiresAt time.Time) error
+	EmailConfirmationTokenByHash(tokenHash string) (*model.EmailConfirmationToken, error)
+	ConfirmEmail(confirmationTokenID int64) (bool, error)
+
+	CreatePersonalAccessToken(userID int64, name, tokenHash, scope string) (*model.PersonalAccessToken, error)
+	PersonalAccessTokens(userID int64) (*model.PersonalAccessTokens, error)
+	PersonalAccessTokenByIDAndUserID(userID, tokenID int64) (*model.PersonalAccessToken, error)
+	PersonalAccessTokenByHash(tokenHash string) (*model.PersonalAccessToken, error)
+	PersonalAccessTokenExists(userID int64, name string) bool
+	TouchPersonalAccessToken(tokenID int64) error
+	DeletePersonalAccessToken(tokenID int64) error
+
+	UserTOTP(userID int64) (*model.TOTP, error)
+	SetTOTPSecret(userID int64, secret string) error
+	EnableTOTP(userID int64, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(userID int64) error
+	UseTOTPStep(userID int64, step int64) (bool, error)
+	UseRecoveryCode(userID int64, codeHash string) (bool, error)
+	CreateMFAChallenge(userID int64, tokenHash, scope string, expiresAt time.Time) error
+	MFAChallengeByHash(tokenHash string) (*model.MFAChallenge, error)
+	DeleteMFAChallenge(challengeID int64) (bool, error)
+
+	CreateOIDCLogin(stateHash, nonce, codeVerifier string, userID int64, expiresAt time.Time) error
+	UseOIDCLogin(stateHash string) (*model.OIDCLogin, error)
+	UserByIdentity(issuer, subject string) (*model.User, error)
+	LinkIdentity(userID int64, issuer, subject string) error
+
+	CreateAuditEvent(event *model.AuditEvent) error
+	AuditEvents(search model.AuditEventListingRequest) (*model.AuditEvents, error)
+}
+
+var _ Store = (*Storage)(nil)
@@ -0,0 +1,112 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"bookstore/model"
+)
+
+func (s *Storage) LoginThrottle(subject string) (*model.LoginThrottle, error) {
+	query := `
+		SELECT
+			subject,
+			failures,
+			last_failure_at,
+			blocked_until,
+			locked
+		FROM
+			login_throttles
+		WHERE
+			subject = $1
+	`
+
+	var throttle model.LoginThrottle
+	err := s.queryRow(query, subject).Scan(
+		&throttle.Subject,
+		&throttle.Failures,
+		&throttle.LastFailureAt,
+		&throttle.BlockedUntil,
+		&throttle.Locked,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch login throttle: %w`, err)
+	}
+
+	return &throttle, nil
+}
+
+// LockLoginThrottle returns the throttle of the subject and locks it until the end of the transaction,
+// so concurrent failed logins are counted one after another. A missing throttle is created without failures.
+func (s *Storage) LockLoginThrottle(subject string) (*model.LoginThrottle, error) {
+	query := `
+		INSERT INTO login_throttles
+			(subject, failures, last_failure_at, blocked_until, locked)
+		VALUES
+			($1, 0, $2, $3, false)
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = login_throttles.failures
+	`
+
+	var zero time.Time
+	if _, err := s.exec(query, subject, zero.UTC(), zero.UTC()); err != nil {
+		return nil, fmt.Errorf(`store: unable to lock login throttle: %w`, err)
+	}
+
+	return s.LoginThrottle(subject)
+}
+
+func (s *Storage) SaveLoginThrottle(throttle *model.LoginThrottle) error {
+	query := `
+		INSERT INTO login_throttles
+			(subject, failures, last_failure_at, blocked_until, locked)
+		VALUES
+			($1, $2, $3, $4, $5)
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = excluded.failures,
+			last_failure_at = excluded.last_failure_at,
+			blocked_until = excluded.blocked_until,
+			locked = excluded.locked
+	`
+
+	_, err := s.exec(
+		query,
+		throttle.Subject,
+		throttle.Failures,
+		throttle.LastFailureAt.UTC(),
+		throttle.BlockedUntil.UTC(),
+		throttle.Locked,
+	)
+	if err != nil {
+		return fmt.Errorf(`store: unable to save login throttle: %w`, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) DeleteLoginThrottle(subject string) error {
+	_, err := s.exec(`DELETE FROM login_throttles WHERE subject = $1`, subject)
+	if err != nil {
+		return fmt.Errorf(`store: unable to delete login throttle: %w`, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"bookstore/model"
+)
+
+func (s *Storage) CreateRefreshToken(userID int64, familyID, tokenHash, scope string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO refresh_tokens
+			(user_id, family_id, token_hash, scope, expires_at)
+		VALUES
+			($1, $2, $3, $4, $5)
+	`
+
+	_, err := s.exec(query, userID, familyID, tokenHash, scope, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf(`store: unable to create refresh token: %w`, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) RefreshTokenByHash(tokenHash string) (*model.RefreshToken, error) {
+	query := `
+		SELECT
+			refresh_token_id,
+			user_id,
+			family_id,
+			scope,
+			expires_at,
+			used,
+			revoked
+		FROM
+			refresh_tokens
+		WHERE
+			token_hash = $1
+	`
+
+	var token model.RefreshToken
+	err := s.queryRow(query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.Scope,
+		&token.ExpiresAt,
+		&token.Used,
+		&token.Revoked,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch refresh token: %w`, err)
+	}
+
+	return &token, nil
+}
+
+// UseRefreshToken marks the token as used. It returns false, if the token
+// was already used or revoked, so only one of concurrent requests can rotate it.
+func (s *Storage) UseRefreshToken(refreshTokenID int64) (bool, error) {
+	result, err := s.exec(`UPDATE refresh_tokens SET used = TRUE WHERE refresh_token_id = $1 AND used = FALSE AND revoked = FALSE`, refreshTokenID)
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use refresh token: %w`, err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use refresh token: %w`, err)
+	}
+
+	return count == 1, nil
+}
+
+// CreateEmailConfirmationToken stores a new confirmation token for the email and discards the older ones of the user.
+func (s *Storage) CreateEmailConfirmationToken(userID int64, email, tokenHash string, expiresAt time.Time) error {
+	return s.WithTx(func(tx Store) error {
+		t := tx.(*Storage)
+		_, err := t.exec(`DELETE FROM email_confirmation_tokens WHERE user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to delete email confirmation tokens: %w`, err)
+		}
+
+		query := `
+			INSERT INTO email_confirmation_tokens
+				(user_id, email, token_hash, expires_at)
+			VALUES
+				($1, $2, $3, $4)
+		`
+
+		_, err = t.exec(query, userID, email, tokenHash, expiresAt.UTC())
+		if err != nil {
+			return fmt.Errorf(`store: unable to create email confirmation token: %w`, err)
+		}
+
+		return nil
+	})
+}
+
+func (s *Storage) EmailConfirmationTokenByHash(tokenHash string) (*model.EmailConfirmationToken, error) {
+	query := `
+		SELECT
+			confirmation_token_id,
+			user_id,
+			email,
+			expires_at,
+			used
+		FROM
+			email_confirmation_tokens
+		WHERE
+			token_hash = $1
+	`
+
+	var token model.EmailConfirmationToken
+	err := s.queryRow(query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Email,
+		&token.ExpiresAt,
+		&token.Used,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch email confirmation token: %w`, err)
+	}
+
+	return &token, nil
+}
+
+// ConfirmEmail marks the token as used and the email of its user as verified. It returns false,
+// if the token was already used or the user changed the email since the token was sent.
+func (s *Storage) ConfirmEmail(confirmationTokenID int64) (bool, error) {
+	confirmed := false
+	err := s.WithTx(func(tx Store) error {
+		t := tx.(*Storage)
+		result, err := t.exec(`UPDATE email_confirmation_tokens SET used = TRUE WHERE confirmation_token_id = $1 AND used = FALSE`, confirmationTokenID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to use email confirmation token: %w`, err)
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf(`store: unable to use email confirmation token: %w`, err)
+		}
+		if count != 1 {
+			return nil
+		}
+
+		query := `
+			UPDATE users SET
+				email_verified = TRUE
+			WHERE
+				user_id = (SELECT user_id FROM email_confirmation_tokens WHERE confirmation_token_id = $1)
+				AND email = (SELECT email FROM email_confirmation_tokens WHERE confirmation_token_id = $1)
+		`
+		result, err = t.exec(query, confirmationTokenID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to confirm email: %w`, err)
+		}
+		count, err = result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf(`store: unable to confirm email: %w`, err)
+		}
+		confirmed = count == 1
+		return nil
+	})
+
+	return confirmed, err
+}
+
+func (s *Storage) RevokeRefreshTokenFamily(familyID string) error {
+	_, err := s.exec(`UPDATE refresh_tokens SET revoked = TRUE WHERE family_id = $1`, familyID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to revoke refresh token family: %w`, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) RevokeUserRefreshTokens(userID int64) error {
+	_, err := s.exec(`UPDATE refresh_tokens SET revoked = TRUE WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to revoke refresh tokens: %w`, err)
+	}
+
+	return nil
+}
+
+// DenyToken puts the token id on the denylist until the token expires.
+func (s *Storage) DenyToken(jti string, expiresAt time.Time) error {
+	_, err := s.exec(`DELETE FROM denied_tokens WHERE expires_at < $1`, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf(`store: unable to clean up denied tokens: %w`, err)
+	}
+
+	_, err = s.exec(`INSERT INTO denied_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`, jti, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf(`store: unable to deny token: %w`, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) TokenDenied(jti string) (bool, error) {
+	var result bool
+	err := s.queryRow(`SELECT true FROM denied_tokens WHERE jti = $1`, jti).Scan(&result)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf(`store: unable to check denied token: %w`, err)
+	}
+
+	return result, nil
+}
+
+// CreatePasswordResetToken stores a new reset token and discards the older ones of the user.
+func (s *Storage) CreatePasswordResetToken(userID int64, tokenHash string, expiresAt time.Time) error {
+	return s.WithTx(func(tx Store) error {
+		t := tx.(*Storage)
+		_, err := t.exec(`DELETE FROM password_reset_tokens WHERE user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to delete password reset tokens: %w`, err)
+		}
+
+		query := `
+			INSERT INTO password_reset_tokens
+				(user_id, token_hash, expires_at)
+			VALUES
+				($1, $2, $3)
+		`
+
+		_, err = t.exec(query, userID, tokenHash, expiresAt.UTC())
+		if err != nil {
+			return fmt.Errorf(`store: unable to create password reset token: %w`, err)
+		}
+
+		return nil
+	})
+}
+
+func (s *Storage) PasswordResetTokenByHash(tokenHash string) (*model.PasswordResetToken, error) {
+	query := `
+		SELECT
+			reset_token_id,
+			user_id,
+			expires_at,
+			used
+		FROM
+			password_reset_tokens
+		WHERE
+			token_hash = $1
+	`
+
+	var token model.PasswordResetToken
+	err := s.queryRow(query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.ExpiresAt,
+		&token.Used,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch password reset token: %w`, err)
+	}
+
+	return &token, nil
+}
+
+// UsePasswordResetToken marks the token as used. It returns false, if the token was already used.
+func (s *Storage) UsePasswordResetToken(resetTokenID int64) (bool, error) {
+	result, err := s.exec(`UPDATE password_reset_tokens SET used = TRUE WHERE reset_token_id = $1 AND used = FALSE`, resetTokenID)
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use password reset token: %w`, err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use password reset token: %w`, err)
+	}
+
+	return count == 1, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"bookstore/model"
+)
+
+func (s *Storage) UserTOTP(userID int64) (*model.TOTP, error) {
+	query := `
+		SELECT
+			totp_secret,
+			totp_enabled,
+			totp_last_step
+		FROM
+			users
+		WHERE
+			user_id = $1
+	`
+
+	var totp model.TOTP
+	err := s.queryRow(query, userID).Scan(
+		&totp.Secret,
+		&totp.Enabled,
+		&totp.LastStep,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch totp: %w`, err)
+	}
+
+	return &totp, nil
+}
+
+// SetTOTPSecret stores a new secret, which is not active until EnableTOTP is called.
+func (s *Storage) SetTOTPSecret(userID int64, secret string) error {
+	_, err := s.exec(`UPDATE users SET totp_secret = $1, totp_enabled = FALSE, totp_last_step = 0 WHERE user_id = $2`, secret, userID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to set totp secret: %w`, err)
+	}
+
+	return nil
+}
+
+// EnableTOTP activates the stored secret and replaces the recovery codes of the user.
+func (s *Storage) EnableTOTP(userID int64, step int64, recoveryCodeHashes []string) error {
+	return s.WithTx(func(tx Store) error {
+		t := tx.(*Storage)
+		_, err := t.exec(`UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE user_id = $2`, step, userID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to enable totp: %w`, err)
+		}
+
+		_, err = t.exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to delete recovery codes: %w`, err)
+		}
+
+		for _, hash := range recoveryCodeHashes {
+			_, err = t.exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash)
+			if err != nil {
+				return fmt.Errorf(`store: unable to create recovery code: %w`, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// DisableTOTP removes the secret and the recovery codes of the user.
+func (s *Storage) DisableTOTP(userID int64) error {
+	return s.WithTx(func(tx Store) error {
+		t := tx.(*Storage)
+		_, err := t.exec(`UPDATE users SET totp_secret = '', totp_enabled = FALSE, totp_last_step = 0 WHERE user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to disable totp: %w`, err)
+		}
+
+		_, err = t.exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+		if err != nil {
+			return fmt.Errorf(`store: unable to delete recovery codes: %w`, err)
+		}
+
+		return nil
+	})
+}
+
+// UseTOTPStep remembers the time step of an accepted code. It returns false,
+// if a code of the same or a later step was already used, so codes cannot be replayed.
+func (s *Storage) UseTOTPStep(userID int64, step int64) (bool, error) {
+	result, err := s.exec(`UPDATE users SET totp_last_step = $1 WHERE user_id = $2 AND totp_last_step < $1`, step, userID)
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use totp step: %w`, err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use totp step: %w`, err)
+	}
+
+	return count == 1, nil
+}
+
+// UseRecoveryCode marks the recovery code as used. It returns false, if the code is unknown or was already used.
+func (s *Storage) UseRecoveryCode(userID int64, codeHash string) (bool, error) {
+	result, err := s.exec(`UPDATE recovery_codes SET used = TRUE WHERE user_id = $1 AND code_hash = $2 AND used = FALSE`, userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use recovery code: %w`, err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to use recovery code: %w`, err)
+	}
+
+	return count == 1, nil
+}
+
+// CreateMFAChallenge stores a challenge, which is answered with the second factor.
+func (s *Storage) CreateMFAChallenge(userID int64, tokenHash, scope string, expiresAt time.Time) error {
+	_, err := s.exec(`DELETE FROM mfa_challenges WHERE expires_at < $1`, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf(`store: unable to clean up mfa challenges: %w`, err)
+	}
+
+	query := `
+		INSERT INTO mfa_challenges
+			(user_id, token_hash, scope, expires_at)
+		VALUES
+			($1, $2, $3, $4)
+	`
+
+	_, err = s.exec(query, userID, tokenHash, scope, expiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf(`store: unable to create mfa challenge: %w`, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) MFAChallengeByHash(tokenHash string) (*model.MFAChallenge, error) {
+	query := `
+		SELECT
+			challenge_id,
+			user_id,
+			scope,
+			expires_at
+		FROM
+			mfa_challenges
+		WHERE
+			token_hash = $1
+	`
+
+	var challenge model.MFAChallenge
+	err := s.queryRow(query, tokenHash).Scan(
+		&challenge.ID,
+		&challenge.UserID,
+		&challenge.Scope,
+		&challenge.ExpiresAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf(`store: unable to fetch mfa challenge: %w`, err)
+	}
+
+	return &challenge, nil
+}
+
+// DeleteMFAChallenge removes the answered challenge. It returns false, if it was already removed.
+func (s *Storage) DeleteMFAChallenge(challengeID int64) (bool, error) {
+	result, err := s.exec(`DELETE FROM mfa_challenges WHERE challenge_id = $1`, challengeID)
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to delete mfa challenge: %w`, err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(`store: unable to delete mfa challenge: %w`, err)
+	}
+
+	return count == 1, nil
+}
@@ -21,21 +21,28 @@ import (
 
 	"bookstore/model"
 
-	"golang.org/x/crypto/bcrypt"
+	log "github.com/sirupsen/logrus"
 )
 
 // UserByUsername finds a user by the username.
 func (s *Storage) UserByUsername(username string) (*model.User, error) {
 	query := `
 		SELECT
-			user_id,
-			username,
-			is_admin,
-			pseudonym
+			u.user_id,
+			u.username,
+			COALESCE(r.name, ''),
+			u.pseudonym,
+			u.email,
+			u.email_verified,
+			u.status,
+			u.totp_enabled,
+			u.token_version
 		FROM
-			users
+			users u
+		LEFT JOIN
+			roles r ON r.role_id=u.role_id
 		WHERE
-			username=LOWER($1)
+			u.username=LOWER($1)
 	`
 	return s.fetchUser(query, username)
 }
@@ -43,30 +50,78 @@ func (s *Storage) UserByUsername(username string) (*model.User, error) {
 func (s *Storage) UserByID(userID int64) (*model.User, error) {
 	query := `
 		SELECT
-			user_id,
-			username,
-			is_admin,
-			pseudonym
+			u.user_id,
+			u.username,
+			COALESCE(r.name, ''),
+			u.pseudonym,
+			u.email,
+			u.email_verified,
+			u.status,
+			u.totp_enabled,
+			u.token_version
 		FROM
-			users
+			users u
+		LEFT JOIN
+			roles r ON r.role_id=u.role_id
 		WHERE
-			user_id = $1
+			u.user_id = $1
 	`
-	return s.fetchUser(query, userID)
+	user, err := s.fetchUser(query, userID)
+	if err == nil && user == nil {
+		return nil, notFound(`store: user #%d not found`, userID)
+	}
+	return user, err
+}
+
+// UserByEmail finds the user with the confirmed email address. If several users
+// confirmed the address, none of them is returned.
+func (s *Storage) UserByEmail(email string) (*model.User, error) {
+	query := `
+		SELECT
+			u.user_id,
+			u.username,
+			COALESCE(r.name, ''),
+			u.pseudonym,
+			u.email,
+			u.email_verified,
+			u.status,
+			u.totp_enabled,
+			u.token_version
+		FROM
+			users u
+		LEFT JOIN
+			roles r ON r.role_id=u.role_id
+		WHERE
+			u.email_verified
+			AND LOWER(u.email)=LOWER($1)
+			AND (SELECT COUNT(*) FROM users WHERE email_verified AND LOWER(email)=LOWER($1)) = 1
+	`
+	return s.fetchUser(query, email)
 }
 func (s *Storage) fetchUser(query string, args ...interface{}) (*model.User, error) {
 	var user model.User
-	err := s.db.QueryRow(query, args...).Scan(
+	err := s.queryRow(query, args...).Scan(
 		&user.ID,
 		&user.Username,
-		&user.IsAdmin,
+		&user.Role,
 		&user.Pseudonym,
+		&user.Email,
+		&user.EmailVerified,
+		&user.Status,
+		&user.TOTPEnabled,
+		&user.TokenVersion,
 	)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
 	} else if err != nil {
-		return nil, fmt.Errorf(`store: unable to fetch user: %v`, err)
+		return nil, fmt.Errorf(`store: unable to fetch user: %w`, err)
+	}
+
+	user.IsAdmin = user.Role == model.RoleAdmin
+	user.Permissions, err = s.rolePermissions(user.Role)
+	if err != nil {
+		return nil, err
 	}
 
 	return &user, nil
@@ -74,19 +129,35 @@ func (s *Storage) fetchUser(query string, args ...interface{}) (*model.User, err
 
 // Users returns all users.
 func (s *Storage) Users() (*model.Users, error) {
+	return s.fetchUsers(``)
+}
+
+// PendingUsers returns the users, who wait for approval.
+func (s *Storage) PendingUsers() (*model.Users, error) {
+	return s.fetchUsers(`WHERE u.status = $1`, model.UserStatusPending)
+}
+
+func (s *Storage) fetchUsers(where string, args ...interface{}) (*model.Users, error) {
 	query := `
 		SELECT
-			user_id,
-			username,
-			is_admin,
-			pseudonym
+			u.user_id,
+			u.username,
+			COALESCE(r.name, ''),
+			u.pseudonym,
+			u.email,
+			u.email_verified,
+			u.status,
+			u.totp_enabled
 		FROM
-			users
-		ORDER BY username ASC
+			users u
+		LEFT JOIN
+			roles r ON r.role_id=u.role_id
+		` + where + `
+		ORDER BY u.username ASC
 	`
-	rows, err := s.db.Query(query)
+	rows, err := s.query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf(`store: unable to fetch users: %v`, err)
+		return nil, fmt.Errorf(`store: unable to fetch users: %w`, err)
 	}
 	defer rows.Close()
 
@@ -96,13 +167,18 @@ func (s *Storage) Users() (*model.Users, error) {
 		err := rows.Scan(
 			&user.ID,
 			&user.Username,
-			&user.IsAdmin,
+			&user.Role,
 			&user.Pseudonym,
+			&user.Email,
+			&user.EmailVerified,
+			&user.Status,
+			&user.TOTPEnabled,
 		)
 
 		if err != nil {
-			return nil, fmt.Errorf(`store: unable to fetch users row: %v`, err)
+			return nil, fmt.Errorf(`store: unable to fetch users row: %w`, err)
 		}
+		user.IsAdmin = user.Role == model.RoleAdmin
 
 		users = append(users, user)
 	}
@@ -110,28 +186,48 @@ func (s *Storage) Users() (*model.Users, error) {
 	return model.NewUsers(users), nil
 }
 
-// CheckPassword validate the hashed password.
+// CheckPassword validate the hashed password. Hashes of a weaker algorithm or cost
+// than the configured one are replaced after the password was verified.
 func (s *Storage) CheckPassword(username, password string) error {
+	var userID int64
 	var hash string
 	username = strings.ToLower(username)
 
-	err := s.db.QueryRow("SELECT password FROM users WHERE username=$1", username).Scan(&hash)
+	err := s.queryRow("SELECT user_id, password FROM users WHERE username=$1", username).Scan(&userID, &hash)
 	if err == sql.ErrNoRows {
 		return fmt.Errorf(`store: unable to find this user: %s`, username)
 	} else if err != nil {
-		return fmt.Errorf(`store: unable to fetch user: %v`, err)
+		return fmt.Errorf(`store: unable to fetch user: %w`, err)
+	}
+
+	rehash, err := s.passwords.Verify(hash, password)
+	if err != nil {
+		return fmt.Errorf(`store: invalid password for "%s" (%w)`, username, err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
-		return fmt.Errorf(`store: invalid password for "%s" (%v)`, username, err)
+	if rehash {
+		// the password was correct, a failed upgrade is repeated on the next login
+		if err := s.rehashPassword(userID, hash, password); err != nil {
+			log.Errorf("[CheckPassword] Could not rehash the password of user %d: %v", userID, err)
+		}
 	}
 
 	return nil
 }
 
-func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
+// rehashPassword replaces the hash, unless the password was changed in the meantime.
+func (s *Storage) rehashPassword(userID int64, oldHash, password string) error {
+	hashedPassword, err := s.passwords.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(`UPDATE users SET password=$1 WHERE user_id=$2 AND password=$3`, hashedPassword, userID, oldHash)
+	if err != nil {
+		return fmt.Errorf(`store: unable to rehash password: %w`, err)
+	}
+
+	return nil
 }
 
 // CreateUser creates a new user.
@@ -139,119 +235,162 @@ func (s *Storage) CreateUser(userCreationRequest *model.UserCreationRequest) (*m
 	var hashedPassword string
 	var err error
 	if userCreationRequest.Password != "" {
-		hashedPassword, err = hashPassword(userCreationRequest.Password)
+		hashedPassword, err = s.passwords.Hash(userCreationRequest.Password)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// is_admin is kept in sync with the role for compatibility
 	query := `
 		INSERT INTO users
-			(username, password, is_admin, pseudonym)
+			(username, password, is_admin, pseudonym, email, email_verified, role_id, status)
 		VALUES
-			(LOWER($1), $2, $3, $4)
+			(LOWER($1), $2, $3, $4, $5, $6, (SELECT role_id FROM roles WHERE name = $7), $8)
 		RETURNING
-			user_id,
-			username,
-			is_admin,
-			pseudonym
+			user_id
 	`
 
-	var user model.User
-	err = s.db.QueryRow(
+	role := userCreationRequest.RoleName()
+	status := userCreationRequest.Status
+	if status == "" {
+		status = model.UserStatusActive
+	}
+
+	var userID int64
+	err = s.queryRow(
 		query,
 		userCreationRequest.Username,
 		hashedPassword,
-		userCreationRequest.IsAdmin,
+		role == model.RoleAdmin,
 		userCreationRequest.Pseudonym,
-	).Scan(
-		&user.ID,
-		&user.Username,
-		&user.IsAdmin,
-		&user.Pseudonym,
-	)
+		userCreationRequest.Email,
+		userCreationRequest.EmailVerified && userCreationRequest.Email != "",
+		role,
+		status,
+	).Scan(&userID)
 	if err != nil {
-		return nil, fmt.Errorf(`store: unable to create user %q: %v`, user.Username, err)
+		return nil, fmt.Errorf(`store: unable to create user %q: %w`, userCreationRequest.Username, err)
 	}
-	return &user, nil
+	return s.UserByID(userID)
 }
 
 // UpdateUser updates a user.
 func (s *Storage) UpdateUser(user *model.User) error {
 	if user.Password != "" {
-		hashedPassword, err := hashPassword(user.Password)
+		hashedPassword, err := s.passwords.Hash(user.Password)
 		if err != nil {
 			return err
 		}
 
+		// a new password invalidates all tokens issued so far,
+		// a new email has to be confirmed again
 		query := `
 			UPDATE users SET
 				username=LOWER($1),
 				password=$2,
 				is_admin=$3,
-				pseudonym=$4
+				pseudonym=$4,
+				email=$5,
+				email_verified=(email_verified AND email=$5),
+				role_id=(SELECT role_id FROM roles WHERE name = $6),
+				token_version=token_version+1
 			WHERE
-				user_id=$5
+				user_id=$7
 		`
 
-		_, err = s.db.Exec(
-			query,
-			user.Username,
-			hashedPassword,
-			user.IsAdmin,
-			user.Pseudonym,
-			user.ID,
-		)
+		err = s.WithTx(func(tx Store) error {
+			result, err := tx.(*Storage).exec(
+				query,
+				user.Username,
+				hashedPassword,
+				user.Role == model.RoleAdmin,
+				user.Pseudonym,
+				user.Email,
+				user.Role,
+				user.ID,
+			)
+			if err != nil {
+				return fmt.Errorf(`store: unable to update user: %w`, err)
+			}
+			if err := changedRow(result, "user", user.ID); err != nil {
+				return err
+			}
+
+			return tx.RevokeUserRefreshTokens(user.ID)
+		})
 		if err != nil {
-			return fmt.Errorf(`store: unable to update user: %v`, err)
+			return err
 		}
+		user.TokenVersion++
 	} else {
+		// a new email has to be confirmed again
 		query := `
 			UPDATE users SET
 				username=LOWER($1),
 				is_admin=$2,
-				pseudonym=$3
+				pseudonym=$3,
+				email=$4,
+				email_verified=(email_verified AND email=$4),
+				role_id=(SELECT role_id FROM roles WHERE name = $5)
 			WHERE
-				user_id=$4
+				user_id=$6
 		`
 
-		_, err := s.db.Exec(
+		result, err := s.exec(
 			query,
 			user.Username,
-			user.IsAdmin,
+			user.Role == model.RoleAdmin,
 			user.Pseudonym,
+			user.Email,
+			user.Role,
 			user.ID,
 		)
 
 		if err != nil {
-			return fmt.Errorf(`store: unable to update user: %v`, err)
+			return fmt.Errorf(`store: unable to update user: %w`, err)
 		}
+		return changedRow(result, "user", user.ID)
 	}
 
 	return nil
 }
 
+// SetUserStatus changes the status of the user, e.g. to approve a pending user.
+func (s *Storage) SetUserStatus(userID int64, status string) error {
+	result, err := s.exec(`UPDATE users SET status=$1 WHERE user_id=$2`, status, userID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to set user status: %w`, err)
+	}
+
+	return changedRow(result, "user", userID)
+}
+
 func (s *Storage) DeleteUser(userID int64) error {
-	_, err := s.db.Exec(`DELETE FROM users WHERE user_id=$1`, userID)
-	return err
+	result, err := s.exec(`DELETE FROM users WHERE user_id=$1`, userID)
+	if err != nil {
+		return fmt.Errorf(`store: unable to delete user: %w`, err)
+	}
+
+	return changedRow(result, "user", userID)
 }
 
 // UserExists checks if a user exists by using the given username.
 func (s *Storage) UserExists(username string) bool {
 	var result bool
-	s.db.QueryRow(`SELECT true FROM users WHERE username=LOWER($1)`, username).Scan(&result)
+	s.queryRow(`SELECT true FROM users WHERE username=LOWER($1)`, username).Scan(&result)
 	return result
 }
 
 func (s *Storage) UserWithPseudonymExists(pseudonym string) bool {
 	var result bool
-	s.db.QueryRow(`SELECT true FROM users WHERE pseudonym=$1`, pseudonym).Scan(&result)
+	s.queryRow(`SELECT true FROM users WHERE pseudonym=$1`, pseudonym).Scan(&result)
 	return result
 }
 
 // AnotherUserExists checks if another user exists with the given username.
 func (s *Storage) AnotherUserExists(userID int64, username string) bool {
 	var result bool
-	s.db.QueryRow(`SELECT true FROM users WHERE user_id != $1 AND username=LOWER($2)`, userID, username).Scan(&result)
+	s.queryRow(`SELECT true FROM users WHERE user_id != $1 AND username=LOWER($2)`, userID, username).Scan(&result)
 	return result
 }
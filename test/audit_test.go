@@ -0,0 +1,134 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bookstore/model"
+)
+
+func listAuditEvents(t *testing.T, token string, query url.Values, expectedCode int) []model.AuditEvent {
+	var events []model.AuditEvent
+	if expectedCode != http.StatusOK {
+		requestWithToken(t, token, http.MethodGet, "/admin/audit?"+query.Encode(), nil, expectedCode, nil)
+		return nil
+	}
+	requestWithToken(t, token, http.MethodGet, "/admin/audit?"+query.Encode(), nil, expectedCode, &events)
+	return events
+}
+
+func auditQuery(since time.Time, params ...string) url.Values {
+	query := url.Values{"since": {since.Format(time.RFC3339Nano)}}
+	for i := 0; i+1 < len(params); i += 2 {
+		query.Set(params[i], params[i+1])
+	}
+	return query
+}
+
+func TestAuditLog(t *testing.T) {
+	resetDatabase(t)
+	since := time.Now()
+	admin := createDefaultAdmin(t)
+	author := createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+	reader := createUserWithRole(t, admin, "readeruser", "Phileas Fogg", model.RoleReader)
+	adminToken := getUserJWT(t, admin)
+
+	// failed and successful logins
+	authenticateWithPassword(t, author, "wrong password", http.StatusBadRequest)
+	getUserJWT(t, author)
+	events := listAuditEvents(t, adminToken, auditQuery(since, "actor", "authoruser", "action", "Authenticate"), http.StatusOK)
+	if len(events) != 2 || events[0].Outcome != model.AuditOutcomeSuccess || events[1].Outcome != model.AuditOutcomeFailure {
+		t.Fatalf("Expected a failed and a successful login. Got %+v\n", events)
+	}
+	if events[0].ActorID == nil || *events[0].ActorID != author["id"] || events[1].ActorID != nil {
+		t.Fatalf("Expected the actor id of the successful login only. Got %+v\n", events)
+	}
+
+	// forbidden actions
+	requestWithToken(t, getUserJWT(t, reader), http.MethodDelete, fmt.Sprintf("/users/%d", author["id"]), nil, http.StatusForbidden, nil)
+	events = listAuditEvents(t, adminToken, auditQuery(since, "actor", "readeruser", "outcome", model.AuditOutcomeDenied), http.StatusOK)
+	if len(events) != 1 || events[0].Action != "DeleteUser" || events[0].Status != http.StatusForbidden || events[0].Target != fmt.Sprintf("/users/%d", author["id"]) {
+		t.Fatalf("Expected the refused deletion. Got %+v\n", events)
+	}
+
+	// invalid tokens have no actor
+	requestWithToken(t, "invalid", http.MethodGet, "/users", nil, http.StatusUnauthorized, nil)
+	events = listAuditEvents(t, adminToken, auditQuery(since, "action", "ListUsers", "outcome", model.AuditOutcomeDenied), http.StatusOK)
+	if len(events) != 1 || events[0].Actor != "" || events[0].Status != http.StatusUnauthorized {
+		t.Fatalf("Expected the unauthorized request. Got %+v\n", events)
+	}
+
+	// changes describe what was changed, reading is not audited
+	book := map[string]interface{}{
+		"title":       "Around the World in Eighty Days",
+		"description": "A journey",
+		"image_url":   "https://images.books/cover.jpg",
+		"user_id":     author["id"],
+		"price":       int64(1200),
+	}
+	createBook(t, author, &book, contentJSON)
+	deleteUser(t, admin, &reader, contentJSON)
+	events = listAuditEvents(t, adminToken, auditQuery(since, "action", "DeleteUser", "outcome", model.AuditOutcomeSuccess), http.StatusOK)
+	if len(events) != 1 || events[0].Actor != "admin" || events[0].Detail != "deleted user readeruser" {
+		t.Fatalf("Expected the user deletion. Got %+v\n", events)
+	}
+	events = listAuditEvents(t, adminToken, auditQuery(since, "action", "CreateUserBook", "limit", "1"), http.StatusOK)
+	if len(events) != 1 || events[0].Action != "CreateUserBook" || !strings.Contains(events[0].Detail, "Around the World in Eighty Days") {
+		t.Fatalf("Expected the book creation. Got %+v\n", events)
+	}
+	events = listAuditEvents(t, adminToken, auditQuery(since, "action", "GetBook"), http.StatusOK)
+	if len(events) != 0 {
+		t.Fatalf("Expected no audit events of reading requests. Got %+v\n", events)
+	}
+
+}
+
+func TestAuditLogAccess(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	author := createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+	adminToken := getUserJWT(t, admin)
+
+	listAuditEvents(t, getUserJWT(t, author), url.Values{}, http.StatusForbidden)
+	listAuditEvents(t, authenticateWithScope(t, admin, model.ScopeUsersRead, http.StatusOK)["token"], url.Values{}, http.StatusForbidden)
+
+	for _, query := range []url.Values{
+		{"outcome": {"unknown"}},
+		{"limit": {"0"}},
+		{"limit": {fmt.Sprint(model.MaxAuditEventLimit + 1)}},
+		{"since": {"yesterday"}},
+		{"since": {"2021-02-01T00:00:00Z"}, "until": {"2021-01-01T00:00:00Z"}},
+		{"actor": {""}},
+	} {
+		listAuditEvents(t, adminToken, query, http.StatusBadRequest)
+	}
+
+	// the log is append-only
+	if db == nil {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM audit_events"); err == nil || !strings.Contains(err.Error(), "append-only") {
+		t.Fatalf("Expected deleting audit events to fail. Got %v\n", err)
+	}
+	if _, err := db.Exec("UPDATE audit_events SET outcome = 'success'"); err == nil || !strings.Contains(err.Error(), "append-only") {
+		t.Fatalf("Expected updating audit events to fail. Got %v\n", err)
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+
+	"github.com/form3tech-oss/jwt-go"
+)
+
+func newTestKey(id string) auth.Key {
+	return auth.Key{ID: id, Secret: bytes.Repeat([]byte(id), 32)}
+}
+
+func listUsersWithToken(t *testing.T, token string, expectedCode int) {
+	request, err := http.NewRequest(http.MethodGet, "/users", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	request.Header.Set("Accept", contentJSON)
+	request = addBearerToken(request, token)
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, expectedCode)
+}
+
+func TestKeyRotation(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	oldKeyring, err := auth.NewKeyring(newTestKey("old"))
+	if err != nil {
+		t.Fatalf("Problem creating keyring: %v\n", err)
+	}
+	auth.SetKeyring(oldKeyring)
+
+	oldToken := getUserJWT(t, admin)
+	listUsersWithToken(t, oldToken, http.StatusOK)
+
+	// the new key signs, the old one is still accepted
+	rotatedKeyring, err := auth.NewKeyring(newTestKey("new"), newTestKey("old"))
+	if err != nil {
+		t.Fatalf("Problem creating keyring: %v\n", err)
+	}
+	auth.SetKeyring(rotatedKeyring)
+
+	newToken := getUserJWT(t, admin)
+	listUsersWithToken(t, oldToken, http.StatusOK)
+	listUsersWithToken(t, newToken, http.StatusOK)
+
+	// after the rotation window the old key is removed
+	newKeyring, err := auth.NewKeyring(newTestKey("new"))
+	if err != nil {
+		t.Fatalf("Problem creating keyring: %v\n", err)
+	}
+	auth.SetKeyring(newKeyring)
+
+	listUsersWithToken(t, oldToken, http.StatusUnauthorized)
+	listUsersWithToken(t, newToken, http.StatusOK)
+}
+
+func TestParseKeyring(t *testing.T) {
+	keyring, err := auth.ParseKeyring([]byte(`# comment
+new:bmV3bmV3bmV3bmV3bmV3bmV3bmV3bmV3bmV3bmV3bmV3bmV3,old:b2xkb2xkb2xkb2xkb2xkb2xkb2xkb2xkb2xkb2xkb2xkb2xk
+`))
+	if err != nil {
+		t.Fatalf("Problem parsing keyring: %v\n", err)
+	}
+	if keyring.SigningKey().ID != "new" {
+		t.Fatalf("Expected signing key new. Got %s\n", keyring.SigningKey().ID)
+	}
+	if _, ok := keyring.Lookup("old"); !ok {
+		t.Fatalf("Expected key old in keyring\n")
+	}
+
+	if _, err := auth.ParseKeyring([]byte("short:c2hvcnQ=")); err == nil {
+		t.Fatalf("Expected error for short key\n")
+	}
+}
+
+func authenticate(t *testing.T, user map[string]interface{}) map[string]string {
+	data := url.Values{}
+	data.Set("username", user["username"].(string))
+	data.Set("password", user["password"].(string))
+
+	return postForm(t, "/authenticate", data, http.StatusOK)
+}
+
+func refreshToken(t *testing.T, refreshToken string, expectedCode int) map[string]string {
+	data := url.Values{}
+	data.Set("refresh_token", refreshToken)
+
+	return postForm(t, "/token/refresh", data, expectedCode)
+}
+
+func postForm(t *testing.T, path string, data url.Values, expectedCode int) map[string]string {
+	request, err := http.NewRequest(http.MethodPost, path, strings.NewReader(data.Encode()))
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, expectedCode)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	return m
+}
+
+func TestRefreshToken(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	tokens := authenticate(t, admin)
+	if tokens["refresh_token"] == "" {
+		t.Fatalf("Expected refresh token: empty string received")
+	}
+
+	rotated := refreshToken(t, tokens["refresh_token"], http.StatusOK)
+	if rotated["refresh_token"] == "" || rotated["refresh_token"] == tokens["refresh_token"] {
+		t.Fatalf("Expected a new refresh token. Got %q\n", rotated["refresh_token"])
+	}
+	listUsersWithToken(t, rotated["token"], http.StatusOK)
+
+	refreshToken(t, "unknown", http.StatusBadRequest)
+
+	// reusing the first refresh token revokes the whole family
+	refreshToken(t, tokens["refresh_token"], http.StatusBadRequest)
+	refreshToken(t, rotated["refresh_token"], http.StatusBadRequest)
+
+	// other logins are not affected
+	other := authenticate(t, admin)
+	refreshToken(t, other["refresh_token"], http.StatusOK)
+}
+
+func TestLogout(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	tokens := authenticate(t, admin)
+	listUsersWithToken(t, tokens["token"], http.StatusOK)
+
+	data := url.Values{}
+	data.Set("refresh_token", tokens["refresh_token"])
+	request, err := http.NewRequest(http.MethodPost, "/logout", strings.NewReader(data.Encode()))
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request = addBearerToken(request, tokens["token"])
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, http.StatusNoContent)
+
+	listUsersWithToken(t, tokens["token"], http.StatusUnauthorized)
+	refreshToken(t, tokens["refresh_token"], http.StatusBadRequest)
+
+	// only the logged out token is affected
+	listUsersWithToken(t, getUserJWT(t, admin), http.StatusOK)
+}
+
+func TestPasswordChangeRevokesTokens(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	millerUser := createSimpleUser(t, "millerUser", "Michael Miller")
+
+	tokens := authenticate(t, millerUser)
+	listUsersWithToken(t, tokens["token"], http.StatusOK)
+
+	updateUser(t, admin, &millerUser, map[string]interface{}{"password": "test456"}, contentJSON)
+
+	listUsersWithToken(t, tokens["token"], http.StatusUnauthorized)
+	refreshToken(t, tokens["refresh_token"], http.StatusBadRequest)
+
+	listUsersWithToken(t, getUserJWT(t, millerUser), http.StatusOK)
+}
+
+func getJWKS(t *testing.T) *auth.JWKSet {
+	request, err := http.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, http.StatusOK)
+
+	var set auth.JWKSet
+	if err := json.Unmarshal(response.Body.Bytes(), &set); err != nil {
+		t.Fatalf("Problem unmarshaling key set: %v\n", err)
+	}
+	return &set
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Problem generating key: %v\n", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %v\n", err)
+	}
+
+	for _, key := range []auth.Key{{ID: "rsa", Private: rsaKey}, {ID: "ed", Private: edKey}} {
+		keyring, err := auth.NewKeyring(key, newTestKey("hmac"))
+		if err != nil {
+			t.Fatalf("Problem creating keyring: %v\n", err)
+		}
+		auth.SetKeyring(keyring)
+
+		token := getUserJWT(t, admin)
+		listUsersWithToken(t, token, http.StatusOK)
+
+		// other services only need the published key to verify the token
+		set := getJWKS(t)
+		if len(set.Keys) != 1 || set.Keys[0].KeyID != key.ID {
+			t.Fatalf("Expected only key %s in key set. Got %+v\n", key.ID, set.Keys)
+		}
+
+		parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+			jwk := set.Keys[0]
+			switch jwk.KeyType {
+			case "RSA":
+				n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+				e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+				return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+			case "OKP":
+				x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+				return ed25519.PublicKey(x), nil
+			}
+			return nil, fmt.Errorf("unexpected key type %s", jwk.KeyType)
+		})
+		if err != nil || !parsed.Valid {
+			t.Fatalf("Expected token to verify with published key: %v\n", err)
+		}
+	}
+}
+
+func TestParsePEMKeyring(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %v\n", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("Problem encoding key: %v\n", err)
+	}
+
+	keyFile, err := ioutil.TempFile("", "jwtkey.*.pem")
+	if err != nil {
+		t.Fatalf("Problem creating key file: %v\n", err)
+	}
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	keyFile.Close()
+
+	keyring, err := auth.ParseKeyring([]byte("ed:file:" + keyFile.Name()))
+	if err != nil {
+		t.Fatalf("Problem parsing keyring: %v\n", err)
+	}
+	if keyring.SigningKey().Method().Alg() != "EdDSA" {
+		t.Fatalf("Expected EdDSA signing key. Got %s\n", keyring.SigningKey().Method().Alg())
+	}
+}
+
+func authenticateWithPassword(t *testing.T, user map[string]interface{}, password string, expectedCode int) {
+	data := url.Values{}
+	data.Set("username", user["username"].(string))
+	data.Set("password", password)
+
+	postForm(t, "/authenticate", data, expectedCode)
+}
+
+func TestAccountLockout(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	millerUser := createSimpleUser(t, "millerUser", "Michael Miller")
+
+	defaultThrottle := auth.UserThrottle
+	defer func() { auth.UserThrottle = defaultThrottle }()
+	auth.UserThrottle = auth.ThrottlePolicy{LockoutAfter: 3, LockoutDuration: time.Hour, ResetAfter: time.Hour}
+
+	authenticateWithPassword(t, millerUser, "wrong", http.StatusBadRequest)
+	authenticateWithPassword(t, millerUser, "wrong", http.StatusBadRequest)
+	authenticateWithPassword(t, millerUser, "wrong", http.StatusBadRequest)
+
+	// even the correct password is refused while the account is locked
+	authenticateWithPassword(t, millerUser, "test123", http.StatusTooManyRequests)
+	authenticateWithPassword(t, admin, "test123", http.StatusOK)
+
+	r := NewRequest(admin, fmt.Sprintf("/users/%v/unlock", millerUser["id"]), http.MethodPost, nil, "user", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusNoContent)
+
+	authenticateWithPassword(t, millerUser, "test123", http.StatusOK)
+}
+
+func TestLoginBackoffPerIP(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	millerUser := createSimpleUser(t, "millerUser", "Michael Miller")
+
+	defaultThrottle := auth.IPThrottle
+	defer func() { auth.IPThrottle = defaultThrottle }()
+	auth.IPThrottle = auth.ThrottlePolicy{FreeAttempts: 1, BaseDelay: time.Hour, MaxDelay: time.Hour, ResetAfter: time.Hour}
+
+	authenticateWithPassword(t, millerUser, "wrong", http.StatusBadRequest)
+	authenticateWithPassword(t, admin, "wrong", http.StatusBadRequest)
+
+	// all logins from the address are delayed now
+	authenticateWithPassword(t, admin, "test123", http.StatusTooManyRequests)
+
+	// the following tests use the same address
+	resetDatabase(t)
+}
+
+func TestConcurrentFailedLogins(t *testing.T) {
+	resetDatabase(t)
+	millerUser := createSimpleUser(t, "millerUser", "Michael Miller")
+
+	defaultThrottle := auth.UserThrottle
+	defer func() { auth.UserThrottle = defaultThrottle }()
+	auth.UserThrottle = auth.ThrottlePolicy{FreeAttempts: 100, ResetAfter: time.Hour}
+
+	const attempts = 10
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := url.Values{}
+			data.Set("username", millerUser["username"].(string))
+			data.Set("password", "wrong")
+			request, _ := http.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(data.Encode()))
+			request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			codes <- executeRequest(request).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		checkResponseCode(t, code, http.StatusBadRequest)
+	}
+
+	// every failure is counted, none overwrites another one
+	throttle, err := store.LoginThrottle(auth.UserThrottleSubject(millerUser["username"].(string)))
+	if err != nil || throttle == nil || throttle.Failures != attempts {
+		t.Fatalf("Expected %d failures. Got %+v %v\n", attempts, throttle, err)
+	}
+
+	// the following tests use the same address
+	resetDatabase(t)
+}
+
+func TestThrottlePolicyBackoff(t *testing.T) {
+	policy := auth.ThrottlePolicy{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 5 * time.Second, ResetAfter: time.Hour}
+	now := time.Now()
+
+	var throttle *model.LoginThrottle
+	expectedDelays := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for _, expected := range expectedDelays {
+		throttle = policy.Fail(throttle, "user:test", now)
+		if delay := throttle.BlockedUntil.Sub(now); delay != expected && !(expected == 0 && delay < 0) {
+			t.Fatalf("Expected delay %v after %d failures. Got %v\n", expected, throttle.Failures, delay)
+		}
+	}
+
+	// old failures are forgotten
+	throttle = policy.Fail(throttle, "user:test", now.Add(2*time.Hour))
+	if throttle.Failures != 1 {
+		t.Fatalf("Expected failures to be reset. Got %d\n", throttle.Failures)
+	}
+}
@@ -124,6 +124,33 @@ func TestGeneralBookOperations(t *testing.T) {
 	}
 }
 
+func TestBookValidationErrors(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	for _, contentType := range []string{contentXML, contentJSON} {
+		book := map[string]interface{}{
+			"title":     "",
+			"image_url": "no url",
+			"user_id":   admin["id"],
+			"price":     int64(-1),
+		}
+
+		// every invalid field is reported at once
+		r := NewRequest(admin, fmt.Sprintf("/users/%d/books", admin["id"]), http.MethodPost, book, "book", contentType, contentType)
+		response := r.makeRequest(t)
+		checkResponseCode(t, response.Code, http.StatusBadRequest)
+		checkValidationProblem(t, response, "book_mandatory_fields:title; invalid_book_fields:image_url,price")
+	}
+
+	r := NewRequest(admin, fmt.Sprintf("/users/%d/books", admin["id"]), http.MethodPost, map[string]interface{}{"title": "Priceless", "price": int64(-1)}, "book", contentJSON, contentJSON)
+	response := r.makeRequest(t)
+	checkResponseCode(t, response.Code, http.StatusBadRequest)
+	if p := decodeProblem(t, response); len(p.InvalidParams) != 1 || p.InvalidParams[0].Params["min"] != "0" {
+		t.Fatalf("Expected the minimum price in the params. Got %+v\n", p.InvalidParams)
+	}
+}
+
 func TestListUserBooks(t *testing.T) {
 	resetDatabase(t)
 
@@ -0,0 +1,103 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bookstore/api"
+	"bookstore/database"
+	"bookstore/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestStorageContext(t *testing.T) {
+	sqliteDB, driver, err := database.Open(filepath.Join(t.TempDir(), "context.sqlite"))
+	if err != nil {
+		t.Fatalf("Problem opening the database: %v\n", err)
+	}
+	defer sqliteDB.Close()
+	if err := database.Migrate(sqliteDB, driver); err != nil {
+		t.Fatalf("Problem migrating the database: %v\n", err)
+	}
+	s := storage.NewStorage(sqliteDB)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 10; i++ {
+		if _, err := s.WithContext(ctx).Books(); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Fatalf("Expected the query to be cancelled. Got %v\n", err)
+		}
+		if s.WithContext(ctx).UserExists("admin") {
+			t.Fatalf("Expected no user from a cancelled query\n")
+		}
+	}
+	if inUse := sqliteDB.Stats().InUse; inUse != 0 {
+		t.Fatalf("Expected cancelled queries to release their connections. Got %d in use\n", inUse)
+	}
+
+	// the storage itself is not bound to the context
+	if _, err := s.Books(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	s.SetQueryTimeout(time.Nanosecond)
+	if _, err := s.Users(); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Fatalf("Expected the query timeout to end the query. Got %v\n", err)
+	}
+	s.SetQueryTimeout(0)
+	if _, err := s.Users(); err != nil {
+		t.Fatalf("Unexpected error without query timeout: %v\n", err)
+	}
+}
+
+func TestCancelledRequest(t *testing.T) {
+	if memory != nil {
+		t.Skip("Operations in memory are not cancelled")
+	}
+	resetDatabase(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "/books", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	checkResponseCode(t, executeRequest(request).Code, http.StatusInternalServerError)
+
+	// the request timeout cancels the queries of slow requests
+	router := mux.NewRouter()
+	api.Serve(router, store, &api.Config{RequestTimeout: time.Nanosecond})
+	request, err = http.NewRequest(http.MethodGet, "/books", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	checkResponseCode(t, response.Code, http.StatusInternalServerError)
+
+	request, err = http.NewRequest(http.MethodGet, "/books", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	checkResponseCode(t, executeRequest(request).Code, http.StatusOK)
+}
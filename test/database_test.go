@@ -0,0 +1,78 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"bookstore/database"
+	"bookstore/storage"
+)
+
+func TestOpenDatabase(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "opendatabase.*.sqlite")
+	if err != nil {
+		t.Fatalf("Problem creating temporary file: %v\n", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	sqliteDB, driver, err := database.Open("sqlite://" + tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Problem opening the SQLite database: %v\n", err)
+	}
+	defer sqliteDB.Close()
+	if driver != database.DriverSQLite {
+		t.Fatalf("Expected driver %s. Got %s\n", database.DriverSQLite, driver)
+	}
+
+	if err := database.CurrentDBSchema(sqliteDB, driver); err == nil {
+		t.Fatalf("Expected an outdated schema before the migration\n")
+	}
+	// migrating twice, e.g. by two replicas, does nothing the second time
+	for i := 0; i < 2; i++ {
+		if err := database.Migrate(sqliteDB, driver); err != nil {
+			t.Fatalf("Problem migrating the database: %v\n", err)
+		}
+	}
+	if err := database.CurrentDBSchema(sqliteDB, driver); err != nil {
+		t.Fatalf("Expected a current schema: %v\n", err)
+	}
+	if err := storage.NewStorage(sqliteDB).Ping(); err != nil {
+		t.Fatalf("Problem connecting to the database: %v\n", err)
+	}
+
+	postgresDB, driver, err := database.Open("postgres://bookstore@localhost/bookstore?sslmode=disable")
+	if driver != database.DriverPostgres {
+		t.Fatalf("Expected driver %s. Got %s\n", database.DriverPostgres, driver)
+	}
+	if !postgresDriverLinked() && err == nil {
+		t.Fatalf("Expected an error without PostgreSQL driver\n")
+	}
+	if postgresDB != nil {
+		postgresDB.Close()
+	}
+}
+
+func postgresDriverLinked() bool {
+	for _, name := range sql.Drivers() {
+		if name == string(database.DriverPostgres) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"bookstore/hasher"
+)
+
+func storedPasswordHash(t *testing.T, username string) string {
+	if db == nil {
+		t.Skip("The stored password hashes are only readable in a SQL database")
+	}
+
+	var hash string
+	if err := db.QueryRow(`SELECT password FROM users WHERE username = $1`, username).Scan(&hash); err != nil {
+		t.Fatalf("Problem loading the password hash: %v\n", err)
+	}
+	return hash
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	resetDatabase(t)
+	defer store.SetPasswordPolicy(testPasswordPolicy)
+
+	store.SetPasswordPolicy(hasher.NewPolicy(hasher.NewBcrypt(4)))
+	user := createSimpleUser(t, "legacyuser", "Old Timer")
+	if hash := storedPasswordHash(t, "legacyuser"); !strings.HasPrefix(hash, "$2a$04$") {
+		t.Fatalf("Expected bcrypt hash. Got %s\n", hash)
+	}
+
+	// a higher bcrypt cost upgrades the hash
+	store.SetPasswordPolicy(hasher.NewPolicy(hasher.NewBcrypt(5)))
+	authenticateWithPassword(t, user, "test123", http.StatusOK)
+	if hash := storedPasswordHash(t, "legacyuser"); !strings.HasPrefix(hash, "$2a$05$") {
+		t.Fatalf("Expected bcrypt hash with cost 5. Got %s\n", hash)
+	}
+
+	store.SetPasswordPolicy(testPasswordPolicy)
+	authenticateWithPassword(t, user, "wrong", http.StatusBadRequest)
+	if hash := storedPasswordHash(t, "legacyuser"); !strings.HasPrefix(hash, "$2a$05$") {
+		t.Fatalf("Expected unchanged hash after failed login. Got %s\n", hash)
+	}
+
+	authenticateWithPassword(t, user, "test123", http.StatusOK)
+	hash := storedPasswordHash(t, "legacyuser")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("Expected argon2id hash. Got %s\n", hash)
+	}
+
+	authenticateWithPassword(t, user, "test123", http.StatusOK)
+	if storedPasswordHash(t, "legacyuser") != hash {
+		t.Fatalf("Expected hash with current parameters to be kept\n")
+	}
+
+	// argon2id is not downgraded to bcrypt
+	store.SetPasswordPolicy(hasher.NewPolicy(hasher.NewBcrypt(4)))
+	authenticateWithPassword(t, user, "test123", http.StatusOK)
+	if storedPasswordHash(t, "legacyuser") != hash {
+		t.Fatalf("Expected argon2id hash to be kept\n")
+	}
+}
+
+func TestArgon2idParameters(t *testing.T) {
+	weak := hasher.NewArgon2id(hasher.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	strong := hasher.NewArgon2id(hasher.Argon2idParams{Memory: 2048, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+
+	hash, err := weak.Hash("test123")
+	if err != nil {
+		t.Fatalf("Problem hashing: %v\n", err)
+	}
+	if err := strong.Verify(hash, "test123"); err != nil {
+		t.Fatalf("Expected hash to be verified with its own parameters: %v\n", err)
+	}
+	if err := strong.Verify(hash, "test124"); err != hasher.ErrMismatch {
+		t.Fatalf("Expected mismatch. Got %v\n", err)
+	}
+	if !strong.NeedsRehash(hash) || weak.NeedsRehash(hash) {
+		t.Fatalf("Expected only the stronger parameters to require a rehash\n")
+	}
+	if _, err := hasher.DefaultPolicy().Verify("plaintext", "plaintext"); err == nil {
+		t.Fatalf("Expected error for unknown hash format\n")
+	}
+}
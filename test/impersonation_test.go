@@ -0,0 +1,108 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"bookstore/api"
+	"bookstore/model"
+)
+
+func impersonate(t *testing.T, caller map[string]interface{}, user map[string]interface{}, payload map[string]interface{}, expectedCode int) string {
+	var m map[string]string
+	requestWithToken(t, getUserJWT(t, caller), http.MethodPost, fmt.Sprintf("/users/%d/impersonate", user["id"]), payload, expectedCode, &m)
+	return m["token"]
+}
+
+func TestImpersonation(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	support := createUserWithRole(t, admin, "support", "Support Staff", model.RoleAdmin)
+	author := createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+	otherAuthor := createUserWithRole(t, admin, "otherauthor", "H. G. Wells", model.RoleAuthor)
+
+	impersonate(t, author, otherAuthor, nil, http.StatusForbidden)
+	impersonate(t, support, admin, nil, http.StatusForbidden)
+	impersonate(t, support, support, nil, http.StatusForbidden)
+
+	since := time.Now()
+	token := impersonate(t, support, author, nil, http.StatusCreated)
+
+	request, err := http.NewRequest(http.MethodGet, "/me", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	response := executeRequest(addBearerToken(request, token))
+	checkResponseCode(t, response.Code, http.StatusOK)
+	if header := response.Header().Get(api.ImpersonatedByHeader); header != "support" {
+		t.Fatalf("Expected %s header support. Got %s\n", api.ImpersonatedByHeader, header)
+	}
+
+	var me model.CurrentUser
+	requestWithToken(t, token, http.MethodGet, "/me", nil, http.StatusOK, &me)
+	checkUser(t, author, me.User)
+	if me.Actor == nil || me.Actor.Username != "support" {
+		t.Fatalf("Expected actor support. Got %+v\n", me.Actor)
+	}
+
+	// the token is read-only by default
+	booksPath := fmt.Sprintf("/users/%d/books", author["id"])
+	requestWithToken(t, token, http.MethodGet, booksPath, nil, http.StatusOK, nil)
+	requestWithToken(t, token, http.MethodPost, booksPath, map[string]interface{}{"title": "Fake", "description": "Written by support", "price": 100}, http.StatusForbidden, nil)
+
+	result := introspect(t, getUserJWT(t, admin), token, http.StatusOK)
+	if !result.Active || result.Username != "authoruser" || result.Actor == nil || result.Actor.Subject != "support" {
+		t.Fatalf("Expected an active token of authoruser acting as support. Got %+v\n", result)
+	}
+
+	query := url.Values{"actor": {"authoruser"}, "target": {booksPath}, "since": {since.Format(time.RFC3339Nano)}}
+	events := listAuditEvents(t, getUserJWT(t, admin), query, http.StatusOK)
+	if len(events) != 2 || events[0].Impersonator != "support" || events[0].Outcome != model.AuditOutcomeDenied || events[1].Outcome != model.AuditOutcomeSuccess {
+		t.Fatalf("Expected audit events of the impersonated requests. Got %+v\n", events)
+	}
+
+	// neither nested impersonation nor long-lived tokens while impersonating
+	token = impersonate(t, support, author, map[string]interface{}{"scope": "users:admin users:write"}, http.StatusCreated)
+	requestWithToken(t, token, http.MethodPost, fmt.Sprintf("/users/%d/impersonate", otherAuthor["id"]), nil, http.StatusForbidden, nil)
+	requestWithToken(t, token, http.MethodPost, fmt.Sprintf("/users/%d/tokens", author["id"]), map[string]interface{}{"name": "backdoor"}, http.StatusForbidden, nil)
+
+	// the token dies with the permission of the actor
+	updateUser(t, admin, &support, map[string]interface{}{"is_admin": false, "role": model.RoleAuthor}, contentJSON)
+	requestWithToken(t, token, http.MethodGet, "/me", nil, http.StatusUnauthorized, nil)
+}
+
+func TestTokensOfDeletedUser(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	support := createUserWithRole(t, admin, "support", "Support Staff", model.RoleAdmin)
+	author := createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+	token := getUserJWT(t, author)
+	impersonation := impersonate(t, support, author, nil, http.StatusCreated)
+
+	// a new user with the name of a deleted one neither takes over its tokens nor acts in them
+	deleteUser(t, admin, &support, contentJSON)
+	createUserWithRole(t, admin, "support", "Support Staff", model.RoleAdmin)
+	requestWithToken(t, impersonation, http.MethodGet, "/me", nil, http.StatusUnauthorized, nil)
+
+	deleteUser(t, admin, &author, contentJSON)
+	author = createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+	requestWithToken(t, token, http.MethodGet, "/me", nil, http.StatusUnauthorized, nil)
+	requestWithToken(t, getUserJWT(t, author), http.MethodGet, "/me", nil, http.StatusOK, nil)
+}
@@ -27,21 +27,45 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 
 	"bookstore/api"
 	"bookstore/database"
+	"bookstore/hasher"
 	"bookstore/model"
+	"bookstore/notify"
+	"bookstore/oidc"
 	"bookstore/storage"
 
 	"github.com/gorilla/mux"
 )
 
-var store *storage.Storage
+// testStorage is implemented by the SQL and the in-memory storage.
+type testStorage interface {
+	storage.Store
+	SetPasswordPolicy(passwords *hasher.Policy)
+}
+
+var store testStorage
+var memory *storage.MemoryStorage
 var db *sql.DB
+var dbDriver database.Driver
 var r *mux.Router
+var outboxFile string
+var oidcProvider *mockOIDCProvider
+var apiConfig *api.Config
+
+// testPasswordPolicy keeps the tests fast, the default parameters need 64 MiB per hash
+var testPasswordPolicy = hasher.NewPolicy(hasher.NewArgon2id(hasher.Argon2idParams{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}))
 
 const (
 	contentJSON         = "application/json"
@@ -144,41 +168,107 @@ func (r *requestStruct) makeRequest(t *testing.T) *httptest.ResponseRecorder {
 }
 
 func TestMain(m *testing.M) {
-	tmpfile, err := ioutil.TempFile("", "testdatabase.*.sqlite")
-	if err != nil {
-		log.Fatal(err)
+	// the tests run against SQLite, unless a database is given, e.g.
+	// BOOKSTORE_TEST_DATABASE=postgres://... go test -tags postgres ./...
+	// or BOOKSTORE_TEST_DATABASE=memory for the in-memory storage
+	var err error
+	var tmpfile *os.File
+	dsn := os.Getenv("BOOKSTORE_TEST_DATABASE")
+	if dsn == "" {
+		tmpfile, err = ioutil.TempFile("", "testdatabase.*.sqlite")
+		if err != nil {
+			log.Fatal(err)
+		}
+		dsn = tmpfile.Name()
 	}
 
-	db, err = database.NewDatabaseConnection(tmpfile.Name())
-	if err != nil {
-		log.Fatalf("Unable to initialize database connection pool: %v", err)
+	if dsn == "memory" {
+		memory = storage.NewMemoryStorage()
+		store = memory
+	} else {
+		db, dbDriver, err = database.Open(dsn)
+		if err != nil {
+			log.Fatalf("Unable to initialize database connection pool: %v", err)
+		}
+		store = storage.NewStorage(db)
 	}
 
-	store = storage.NewStorage(db)
 	if err = store.Ping(); err != nil {
 		log.Fatalf("Unable to connect to the database: %v", err)
 	}
+	store.SetPasswordPolicy(testPasswordPolicy)
+
+	if db != nil {
+		if err = database.Migrate(db, dbDriver); err != nil {
+			log.Fatalf(`%v`, err)
+		}
+
+		if err = database.CurrentDBSchema(db, dbDriver); err != nil {
+			log.Fatalf("The DB version should have been correct, %v", err)
+		}
+	}
 
-	if err = database.Migrate(db); err != nil {
-		log.Fatalf(`%v`, err)
+	outbox, err := ioutil.TempFile("", "outbox.*.jsonl")
+	if err != nil {
+		log.Fatal(err)
 	}
+	outboxFile = outbox.Name()
+	outbox.Close()
 
-	if err = database.CurrentDBSchema(db); err != nil {
-		log.Fatalf("The DB version should have been correct, %v", err)
+	oidcProvider, err = newMockOIDCProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	provider, err := oidc.NewProvider(oidc.Config{
+		IssuerURL:    oidcProvider.URL,
+		ClientID:     mockClientID,
+		ClientSecret: mockClientSecret,
+		RedirectURL:  mockRedirectURL,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	r = mux.NewRouter()
-	api.Serve(r, store)
+	apiConfig = &api.Config{Notifier: notify.NewOutboxNotifier(outboxFile), OIDC: provider}
+	api.Serve(r, store, apiConfig)
 	code := m.Run()
 
 	// os.Exit() does not respect defer statements
-	db.Close()
-	os.Remove(tmpfile.Name()) // clean up
+	if db != nil {
+		db.Close()
+	}
+	if tmpfile != nil {
+		os.Remove(tmpfile.Name()) // clean up
+	}
+	os.Remove(outboxFile)
+	oidcProvider.Close()
 	os.Exit(code)
 }
 
 func resetDatabase(t *testing.T) {
-	_, err := db.Exec("DELETE FROM books")
+	if memory != nil {
+		memory.Reset()
+		return
+	}
+
+	if dbDriver == database.DriverPostgres {
+		_, err := db.Exec("TRUNCATE login_throttles, settings, books, users RESTART IDENTITY CASCADE")
+		if err != nil {
+			t.Fatalf("Problem cleaning the database: %v\n", err)
+		}
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM login_throttles")
+	if err != nil {
+		t.Fatalf("Problem cleaning the database: %v\n", err)
+	}
+	_, err = db.Exec("DELETE FROM settings")
+	if err != nil {
+		t.Fatalf("Problem cleaning the database: %v\n", err)
+	}
+	_, err = db.Exec("DELETE FROM books")
 	if err != nil {
 		t.Fatalf("Problem cleaning the database: %v\n", err)
 	}
@@ -293,6 +383,10 @@ func checkUser(t *testing.T, user map[string]interface{}, userResponse *model.Us
 		t.Fatalf("Expected is_admin %t. Got %t\n", user["is_admin"].(bool), userResponse.IsAdmin)
 	}
 
+	if role, ok := user["role"]; ok && userResponse.Role != role.(string) {
+		t.Fatalf("Expected role %s. Got %s\n", role.(string), userResponse.Role)
+	}
+
 	if userResponse.ID != user["id"].(int64) {
 		t.Fatalf("Expected id %d. Got %d\n", user["id"].(int64), userResponse.ID)
 	}
@@ -333,10 +427,75 @@ func checkBook(t *testing.T, book map[string]interface{}, bookResponse *model.Bo
 	}
 }
 
-func getXMLError(errMsg string) string {
-	return "<error><error_message>" + errMsg + "</error_message></error>"
+// problem holds the RFC 7807 problem details of an error response.
+type problem struct {
+	XMLName       xml.Name `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type          string   `json:"type" xml:"type"`
+	Title         string   `json:"title" xml:"title"`
+	Status        int      `json:"status" xml:"status"`
+	Detail        string   `json:"detail" xml:"detail"`
+	Instance      string   `json:"instance" xml:"instance"`
+	Code          string   `json:"code" xml:"code"`
+	InvalidParams []struct {
+		Name   string            `json:"name" xml:"name"`
+		Reason string            `json:"reason" xml:"reason"`
+		Params map[string]string `json:"params" xml:"-"`
+	} `json:"invalid_params" xml:"invalid_params>i"`
+}
+
+// decodeProblem decodes the problem details of the response as JSON or XML, depending on the Content-Type.
+func decodeProblem(t *testing.T, response *httptest.ResponseRecorder) *problem {
+	var p problem
+	var err error
+	switch contentType := response.Header().Get("Content-Type"); {
+	case strings.HasPrefix(contentType, api.ApplicationProblemJSON):
+		err = json.Unmarshal(response.Body.Bytes(), &p)
+	case strings.HasPrefix(contentType, api.ApplicationProblemXML):
+		err = xml.Unmarshal(response.Body.Bytes(), &p)
+	default:
+		t.Fatalf("Expected problem details. Got %s: %s\n", contentType, response.Body.String())
+	}
+	if err != nil {
+		t.Fatalf("Problem unmarshaling problem details: %v\n", err)
+	}
+	if p.Status != response.Code || p.Title != http.StatusText(response.Code) {
+		t.Fatalf("Expected status %d in the problem details. Got %+v\n", response.Code, p)
+	}
+	return &p
 }
 
-func getJSONError(errMsg string) string {
-	return `{"error_message":"` + errMsg + `"}`
+// checkValidationProblem checks that the response is the problem of validation errors like
+// "book_mandatory_fields:title; invalid_book_fields:image_url,price", with an invalid param per field.
+func checkValidationProblem(t *testing.T, response *httptest.ResponseRecorder, errorKey string) {
+	p := decodeProblem(t, response)
+	if p.Detail != errorKey {
+		t.Fatalf("Expected the problem %s. Got %+v\n", errorKey, p)
+	}
+
+	var code string
+	var expected []string
+	for _, key := range strings.Split(errorKey, "; ") {
+		parts := strings.SplitN(key, ":", 2)
+		if code == "" {
+			code = parts[0]
+		} else if code != parts[0] {
+			code = "validation_failed"
+		}
+		for _, field := range strings.Split(parts[len(parts)-1], ",") {
+			expected = append(expected, field+":"+parts[0])
+		}
+	}
+	if p.Code != code || p.Type != "urn:bookstore:problem:"+code {
+		t.Fatalf("Expected the code %s. Got %+v\n", code, p)
+	}
+
+	var actual []string
+	for _, param := range p.InvalidParams {
+		actual = append(actual, param.Name+":"+param.Reason)
+	}
+	sort.Strings(expected)
+	sort.Strings(actual)
+	if strings.Join(actual, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected invalid params %v. Got %+v\n", expected, p.InvalidParams)
+	}
 }
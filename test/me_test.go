@@ -0,0 +1,117 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bookstore/model"
+)
+
+func introspect(t *testing.T, callerToken, token string, expectedCode int) *model.TokenIntrospection {
+	data := url.Values{}
+	data.Set("token", token)
+	request, err := http.NewRequest(http.MethodPost, "/token/introspect", strings.NewReader(data.Encode()))
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request = addBearerToken(request, callerToken)
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, expectedCode)
+
+	var m model.TokenIntrospection
+	json.Unmarshal(response.Body.Bytes(), &m)
+	return &m
+}
+
+func TestMe(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	var me model.CurrentUser
+	requestWithToken(t, getUserJWT(t, admin), http.MethodGet, "/me", nil, http.StatusOK, &me)
+	checkUser(t, admin, me.User)
+	if me.Token.Type != model.TokenTypeJWT {
+		t.Fatalf("Expected token type %s. Got %s\n", model.TokenTypeJWT, me.Token.Type)
+	}
+	if me.Token.ID == "" || me.Token.IssuedAt == nil || me.Token.ExpiresAt == nil {
+		t.Fatalf("Expected id, issued_at and expires_at. Got %+v\n", me.Token)
+	}
+	if validity := me.Token.ExpiresAt.Sub(*me.Token.IssuedAt); validity != 15*time.Minute {
+		t.Fatalf("Expected a validity of 15m. Got %v\n", validity)
+	}
+
+	pat := createUserToken(t, admin, admin, "ci", contentJSON)
+	me = model.CurrentUser{}
+	requestWithToken(t, pat.Token, http.MethodGet, "/me", nil, http.StatusOK, &me)
+	checkUser(t, admin, me.User)
+	if me.Token.Type != model.TokenTypePersonalAccessToken {
+		t.Fatalf("Expected token type %s. Got %s\n", model.TokenTypePersonalAccessToken, me.Token.Type)
+	}
+	if me.Token.ExpiresAt != nil {
+		t.Fatalf("Expected no expiry of a personal access token. Got %v\n", me.Token.ExpiresAt)
+	}
+
+	requestWithToken(t, "invalid", http.MethodGet, "/me", nil, http.StatusUnauthorized, nil)
+}
+
+func TestTokenIntrospection(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	author := createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+
+	service := createUserToken(t, admin, admin, "service", contentJSON).Token
+	token := getUserJWT(t, author)
+
+	result := introspect(t, service, token, http.StatusOK)
+	if !result.Active {
+		t.Fatalf("Expected an active token\n")
+	}
+	if result.Username != author["username"] || result.UserID != author["id"] {
+		t.Fatalf("Expected user %v with id %v. Got %s with id %d\n", author["username"], author["id"], result.Username, result.UserID)
+	}
+	if result.TokenType != model.TokenTypeJWT || result.ExpiresAt <= time.Now().Unix() || result.Issuer != "bookstore" {
+		t.Fatalf("Unexpected token metadata %+v\n", result)
+	}
+
+	if result := introspect(t, service, service, http.StatusOK); !result.Active || result.TokenType != model.TokenTypePersonalAccessToken {
+		t.Fatalf("Expected an active personal access token. Got %+v\n", result)
+	}
+
+	requestWithToken(t, token, http.MethodPost, "/logout", nil, http.StatusNoContent, nil)
+	if result := introspect(t, service, token, http.StatusOK); result.Active || result.Username != "" {
+		t.Fatalf("Expected an inactive token without details. Got %+v\n", result)
+	}
+	if result := introspect(t, service, "bspat_unknown", http.StatusOK); result.Active {
+		t.Fatalf("Expected an inactive token\n")
+	}
+	if result := introspect(t, service, "not.a.jwt", http.StatusOK); result.Active {
+		t.Fatalf("Expected an inactive token\n")
+	}
+
+	introspect(t, service, "", http.StatusBadRequest)
+	introspect(t, "invalid", token, http.StatusUnauthorized)
+
+	// reading users is not enough, the response reveals the owner of any token
+	introspect(t, getUserJWT(t, author), service, http.StatusForbidden)
+	readOnly := authenticateWithScope(t, admin, model.ScopeUsersRead, http.StatusOK)["token"]
+	introspect(t, readOnly, token, http.StatusForbidden)
+}
@@ -0,0 +1,354 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+
+	"github.com/form3tech-oss/jwt-go"
+)
+
+const (
+	mockClientID     = "bookstore"
+	mockClientSecret = "bookstore-secret"
+	mockRedirectURL  = "http://bookstore.test/oidc/callback"
+)
+
+type mockAuthorization struct {
+	claims        jwt.MapClaims
+	codeChallenge string
+}
+
+// mockOIDCProvider is a minimal OpenID Connect provider, which signs ID tokens with an RSA key.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+func newMockOIDCProvider() (*mockOIDCProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &mockOIDCProvider{key: key, codes: make(map[string]mockAuthorization)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/keys", p.keys)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+
+	return p, nil
+}
+
+func (p *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/keys",
+	})
+}
+
+func (p *mockOIDCProvider) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(auth.JWKSet{Keys: []auth.JWK{{
+		KeyType:   "RSA",
+		KeyID:     "mock",
+		Use:       "sig",
+		Algorithm: "RS256",
+		N:         base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+	}}})
+}
+
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != mockClientID || clientSecret != mockClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	p.mu.Lock()
+	authorization, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("redirect_uri") != mockRedirectURL || base64.RawURLEncoding.EncodeToString(verifier[:]) != authorization.codeChallenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, authorization.claims)
+	token.Header["kid"] = "mock"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "token_type": "Bearer", "id_token": idToken})
+}
+
+// authorize plays the login of the user at the provider and returns the code for the callback.
+func (p *mockOIDCProvider) authorize(t *testing.T, authURL *url.URL, claims jwt.MapClaims) string {
+	params := authURL.Query()
+	if params.Get("client_id") != mockClientID || params.Get("redirect_uri") != mockRedirectURL {
+		t.Fatalf("Unexpected authorization request %s\n", authURL)
+	}
+	if params.Get("code_challenge_method") != "S256" {
+		t.Fatalf("Expected PKCE challenge in %s\n", authURL)
+	}
+
+	claims["iss"] = p.URL
+	claims["aud"] = mockClientID
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["iat"] = time.Now().Unix()
+	claims["nonce"] = params.Get("nonce")
+
+	code, _ := auth.OpaqueToken()
+	p.mu.Lock()
+	p.codes[code] = mockAuthorization{claims: claims, codeChallenge: params.Get("code_challenge")}
+	p.mu.Unlock()
+
+	return code
+}
+
+func startOIDCLogin(t *testing.T) *url.URL {
+	request, err := http.NewRequest(http.MethodGet, "/oidc/login", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, http.StatusFound)
+
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Problem parsing the redirect: %v\n", err)
+	}
+	return location
+}
+
+func oidcCallback(t *testing.T, state, code string, expectedCode int) map[string]string {
+	request, err := http.NewRequest(http.MethodGet, "/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	request.Header.Set("Accept", contentJSON)
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, expectedCode)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	return m
+}
+
+func oidcLogin(t *testing.T, claims jwt.MapClaims, expectedCode int) map[string]string {
+	location := startOIDCLogin(t)
+	code := oidcProvider.authorize(t, location, claims)
+	return oidcCallback(t, location.Query().Get("state"), code, expectedCode)
+}
+
+func TestOIDCLoginLinksByEmail(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	user := map[string]interface{}{
+		"username":  "sso",
+		"pseudonym": "Ursula Le Guin",
+		"password":  "test123",
+		"email":     "ursula@example.com",
+		"is_admin":  false,
+	}
+	createUser(t, admin, &user, contentJSON)
+
+	// the email is only linked, once the user confirmed it
+	oidcLogin(t, jwt.MapClaims{"sub": "42", "email": "ursula@example.com", "email_verified": true}, http.StatusForbidden)
+	confirmEmail(t, "ursula@example.com", http.StatusNoContent)
+
+	// an unverified email is not enough to take over the account
+	oidcLogin(t, jwt.MapClaims{"sub": "42", "email": "ursula@example.com"}, http.StatusForbidden)
+
+	tokens := oidcLogin(t, jwt.MapClaims{"sub": "42", "email": "ursula@example.com", "email_verified": true}, http.StatusOK)
+	listUsersWithToken(t, tokens["token"], http.StatusOK)
+
+	// the subject stays linked, even if the email changes at the provider
+	tokens = oidcLogin(t, jwt.MapClaims{"sub": "42", "email": "ursula@example.org", "email_verified": true}, http.StatusOK)
+	var u model.User
+	requestWithToken(t, tokens["token"], http.MethodGet, fmt.Sprintf("/users/%v", user["id"]), nil, http.StatusOK, &u)
+	if u.Username != "sso" {
+		t.Fatalf("Expected user sso. Got %s\n", u.Username)
+	}
+}
+
+// confirmEmail confirms the email with the token of the last message sent to it.
+func confirmEmail(t *testing.T, email string, expectedCode int) {
+	messages := outboxMessages(t)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To != email {
+			continue
+		}
+		match := resetTokenPattern.FindStringSubmatch(messages[i].Body)
+		if match == nil {
+			t.Fatalf("Expected confirmation token in message. Got %s\n", messages[i].Body)
+		}
+		data := url.Values{}
+		data.Set("token", match[1])
+		postForm(t, "/email/confirm", data, expectedCode)
+		return
+	}
+	t.Fatalf("Expected a message to %s\n", email)
+}
+
+// setEmail changes and confirms the email of the user.
+func setEmail(t *testing.T, admin, user map[string]interface{}, email string) {
+	r := NewRequest(admin, fmt.Sprintf("/users/%v", user["id"]), http.MethodPut, map[string]interface{}{"email": email}, "user", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusOK)
+	confirmEmail(t, email, http.StatusNoContent)
+}
+
+func TestOIDCIgnoresUnconfirmedEmail(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	// anybody can sign up with the address of somebody else
+	squatter := map[string]interface{}{"username": "squatter", "password": "test123", "pseudonym": "Squatter", "email": "victim@example.com"}
+	var created model.User
+	requestWithToken(t, "", http.MethodPost, "/signup", squatter, http.StatusCreated, &created)
+	if created.EmailVerified {
+		t.Fatalf("Expected an unconfirmed email\n")
+	}
+	oidcLogin(t, jwt.MapClaims{"sub": "7", "email": "victim@example.com", "email_verified": true}, http.StatusForbidden)
+
+	// the unconfirmed address neither blocks the linking of the owner
+	victim := createUserWithRole(t, admin, "victim", "Victor Hugo", model.RoleAuthor)
+	setEmail(t, admin, victim, "victim@example.com")
+	tokens := oidcLogin(t, jwt.MapClaims{"sub": "7", "email": "victim@example.com", "email_verified": true}, http.StatusOK)
+	var me model.User
+	requestWithToken(t, tokens["token"], http.MethodGet, fmt.Sprintf("/users/%v", victim["id"]), nil, http.StatusOK, &me)
+	if me.Username != "victim" || !me.EmailVerified {
+		t.Fatalf("Expected the confirmed user victim. Got %+v\n", me)
+	}
+
+	// a changed email has to be confirmed again and the old token is refused
+	r := NewRequest(admin, fmt.Sprintf("/users/%v", victim["id"]), http.MethodPut, map[string]interface{}{"email": "victor@example.com"}, "user", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusOK)
+	confirmEmail(t, "victim@example.com", http.StatusBadRequest)
+	confirmEmail(t, "victor@example.com", http.StatusNoContent)
+}
+
+func linkOIDCIdentity(t *testing.T, user map[string]interface{}, code string, expectedCode int) *url.URL {
+	data := url.Values{}
+	data.Set("username", user["username"].(string))
+	data.Set("password", user["password"].(string))
+	data.Set("code", code)
+
+	m := postForm(t, "/oidc/link", data, expectedCode)
+	location, err := url.Parse(m["url"])
+	if err != nil {
+		t.Fatalf("Problem parsing the URL: %v\n", err)
+	}
+	return location
+}
+
+func TestOIDCLinkRequiresSecondFactor(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	setEmail(t, admin, admin, "admin@example.com")
+	user := createUserWithRole(t, admin, "secureuser", "Mary Shelley", model.RoleAuthor)
+	setEmail(t, admin, user, "mary@example.com")
+	secret, step, _ := enrolTOTP(t, user, authenticate(t, user)["token"])
+
+	// neither admins nor users with TOTP are linked by their email
+	oidcLogin(t, jwt.MapClaims{"sub": "1", "email": "admin@example.com", "email_verified": true}, http.StatusForbidden)
+	oidcLogin(t, jwt.MapClaims{"sub": "2", "email": "mary@example.com", "email_verified": true}, http.StatusForbidden)
+
+	// the link is started with the password and the second factor
+	linkOIDCIdentity(t, user, "", http.StatusBadRequest)
+	location := linkOIDCIdentity(t, user, totpCode(t, secret, step+1), http.StatusOK)
+	code := oidcProvider.authorize(t, location, jwt.MapClaims{"sub": "2", "email": "mary@example.com", "email_verified": true})
+	tokens := oidcCallback(t, location.Query().Get("state"), code, http.StatusOK)
+	var me map[string]interface{}
+	requestWithToken(t, tokens["token"], http.MethodGet, "/me", nil, http.StatusOK, &me)
+	if me["user"].(map[string]interface{})["username"] != "secureuser" {
+		t.Fatalf("Expected user secureuser. Got %v\n", me)
+	}
+	oidcLogin(t, jwt.MapClaims{"sub": "2"}, http.StatusOK)
+
+	// an identity can not be linked to a second user
+	location = linkOIDCIdentity(t, admin, "", http.StatusOK)
+	code = oidcProvider.authorize(t, location, jwt.MapClaims{"sub": "2"})
+	oidcCallback(t, location.Query().Get("state"), code, http.StatusConflict)
+}
+
+func TestOIDCAutoProvisioning(t *testing.T) {
+	resetDatabase(t)
+	createDefaultAdmin(t)
+
+	claims := jwt.MapClaims{"sub": "4711", "preferred_username": "newauthor", "name": "Octavia Butler", "email": "octavia@example.com", "email_verified": true}
+	oidcLogin(t, claims, http.StatusForbidden)
+
+	apiConfig.OIDCAutoProvision = true
+	defer func() { apiConfig.OIDCAutoProvision = false }()
+
+	tokens := oidcLogin(t, claims, http.StatusOK)
+	user, err := store.UserByUsername("newauthor")
+	if err != nil || user == nil {
+		t.Fatalf("Expected provisioned user: %v\n", err)
+	}
+	if user.Pseudonym != "Octavia Butler" || user.Email != "octavia@example.com" || user.Role != model.RoleAuthor {
+		t.Fatalf("Unexpected provisioned user %+v\n", user)
+	}
+	listUsersWithToken(t, tokens["token"], http.StatusOK)
+
+	// the provisioned user has no password
+	authenticateWithPassword(t, map[string]interface{}{"username": "newauthor"}, "test123", http.StatusBadRequest)
+
+	// a different subject with a taken user name is refused
+	oidcLogin(t, jwt.MapClaims{"sub": "4712", "preferred_username": "newauthor", "name": "Someone Else"}, http.StatusConflict)
+}
+
+func TestOIDCCallbackErrors(t *testing.T) {
+	resetDatabase(t)
+	createDefaultAdmin(t)
+
+	location := startOIDCLogin(t)
+	state := location.Query().Get("state")
+	oidcCallback(t, "unknown", "code", http.StatusBadRequest)
+	oidcCallback(t, state, "unknown", http.StatusBadRequest)
+	// the state is used up by the failed attempt
+	code := oidcProvider.authorize(t, location, jwt.MapClaims{"sub": "1"})
+	oidcCallback(t, state, code, http.StatusBadRequest)
+}
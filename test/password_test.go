@@ -0,0 +1,240 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"bookstore/hasher"
+	"bookstore/notify"
+	"bookstore/validator"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var resetTokenPattern = regexp.MustCompile(`(?m)^([A-Za-z0-9_-]{43})$`)
+
+func forgotPassword(t *testing.T, username string) {
+	data := url.Values{}
+	data.Set("username", username)
+	postForm(t, "/password/forgot", data, http.StatusNoContent)
+}
+
+func resetPassword(t *testing.T, token, password string, expectedCode int) map[string]string {
+	data := url.Values{}
+	data.Set("token", token)
+	data.Set("password", password)
+	return postForm(t, "/password/reset", data, expectedCode)
+}
+
+func outboxMessages(t *testing.T) []notify.Message {
+	messages, err := notify.ReadOutbox(outboxFile)
+	if err != nil {
+		t.Fatalf("Problem reading the outbox: %v\n", err)
+	}
+	return messages
+}
+
+// waitForMessages returns the messages of the outbox, once it holds at least count messages.
+func waitForMessages(t *testing.T, count int) []notify.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages := outboxMessages(t)
+		if len(messages) >= count || time.Now().After(deadline) {
+			return messages
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	user := map[string]interface{}{
+		"username":  "forgetful",
+		"pseudonym": "Jack London",
+		"password":  "test123",
+		"email":     "jack@example.com",
+		"is_admin":  false,
+	}
+	createUser(t, admin, &user, contentJSON)
+	tokens := authenticate(t, user)
+
+	sent := len(outboxMessages(t))
+	forgotPassword(t, "unknown")
+	forgotPassword(t, "forgetful")
+
+	// the token is sent in the background
+	messages := waitForMessages(t, sent+1)
+	if len(messages) != sent+1 {
+		t.Fatalf("Expected one new message. Got %d\n", len(messages)-sent)
+	}
+	msg := messages[len(messages)-1]
+	if msg.To != "jack@example.com" {
+		t.Fatalf("Expected message to jack@example.com. Got %s\n", msg.To)
+	}
+	match := resetTokenPattern.FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("Expected reset token in message. Got %s\n", msg.Body)
+	}
+	token := match[1]
+
+	resetPassword(t, "unknown", "test456", http.StatusBadRequest)
+	if m := resetPassword(t, token, "test", http.StatusBadRequest); m["code"] != "password_min_length" {
+		t.Fatalf("Expected password_min_length. Got %v\n", m)
+	}
+
+	// a failed update keeps the token valid
+	store.SetPasswordPolicy(hasher.NewPolicy(hasher.NewBcrypt(bcrypt.MaxCost + 1)))
+	resetPassword(t, token, "test456", http.StatusInternalServerError)
+	store.SetPasswordPolicy(testPasswordPolicy)
+
+	resetPassword(t, token, "test456", http.StatusNoContent)
+
+	// the token is single-use and the old sessions are revoked
+	resetPassword(t, token, "test789", http.StatusBadRequest)
+	listUsersWithToken(t, tokens["token"], http.StatusUnauthorized)
+
+	authenticateWithPassword(t, user, "test123", http.StatusBadRequest)
+	authenticateWithPassword(t, user, "test456", http.StatusOK)
+
+	// a failed delivery is only possible for existing users, so it is not revealed either
+	notifier := apiConfig.Notifier
+	defer func() { apiConfig.Notifier = notifier }()
+	failing := &failingNotifier{attempts: make(chan *notify.Message, 1)}
+	apiConfig.Notifier = failing
+	forgotPassword(t, "forgetful")
+	if msg := <-failing.attempts; msg.To != "jack@example.com" {
+		t.Fatalf("Expected message to jack@example.com. Got %s\n", msg.To)
+	}
+}
+
+// failingNotifier reports every message it could not deliver.
+type failingNotifier struct {
+	attempts chan *notify.Message
+}
+
+func (n *failingNotifier) Send(msg *notify.Message) error {
+	n.attempts <- msg
+	return errors.New("delivery failed")
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	dir, err := ioutil.TempDir("", "passwords")
+	if err != nil {
+		t.Fatalf("Problem creating directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listFile := filepath.Join(dir, "common.txt")
+	if err := ioutil.WriteFile(listFile, []byte("# common\nSummer2021!\n"), 0600); err != nil {
+		t.Fatalf("Problem writing password list: %v\n", err)
+	}
+	list, err := validator.LoadPasswordList(listFile)
+	if err != nil {
+		t.Fatalf("Problem loading password list: %v\n", err)
+	}
+
+	sum := sha1.Sum([]byte("Tr0ub4dor&3"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	rangeFile := fmt.Sprintf("0018A45C4D1DEF81644B54AB7F969B88D65:1\n%s:3645804\n", hash[5:])
+	if err := ioutil.WriteFile(filepath.Join(dir, hash[:5]), []byte(rangeFile), 0600); err != nil {
+		t.Fatalf("Problem writing hash range: %v\n", err)
+	}
+	ranges, err := validator.NewHashPrefixDirectory(dir)
+	if err != nil {
+		t.Fatalf("Problem opening hash ranges: %v\n", err)
+	}
+
+	defaultPolicy := validator.Passwords
+	defer func() { validator.Passwords = defaultPolicy }()
+	policy := validator.PasswordPolicy{MinLength: 8, MaxLength: 20, RequireLower: true, RequireUpper: true, RequireDigit: true, RequireSymbol: true}
+
+	policy.Breached = list
+	validator.Passwords = policy
+
+	cases := map[string]string{
+		"Sh0rt!":                   "password_min_length:password",
+		"Much-T00-Long-For-Policy": "password_max_length:password",
+		"NOLOWER1!":                "password_lowercase_required:password",
+		"noupper1!":                "password_uppercase_required:password",
+		"NoDigits!":                "password_digit_required:password",
+		"NoSymbol1":                "password_symbol_required:password",
+		"1Policyuser!":             "password_contains_username:password",
+		"My ada lovelace9":         "password_contains_pseudonym:password",
+		"sUMMER2021!":              "password_breached:password",
+	}
+	for password, key := range cases {
+		user := map[string]interface{}{
+			"username":  "policyuser",
+			"pseudonym": "Ada Lovelace",
+			"password":  password,
+		}
+		createUserWithError(t, admin, &user, contentJSON, http.StatusBadRequest, key)
+	}
+
+	policy.Breached = ranges
+	validator.Passwords = policy
+	user := map[string]interface{}{
+		"username":  "policyuser",
+		"pseudonym": "Ada Lovelace",
+		"password":  "Tr0ub4dor&3",
+	}
+	createUserWithError(t, admin, &user, contentJSON, http.StatusBadRequest, "password_breached:password")
+
+	user = map[string]interface{}{
+		"username":  "policyuser",
+		"pseudonym": "Ada Lovelace",
+		"password":  "C0rrect-Horse",
+		"is_admin":  false,
+	}
+	createUser(t, admin, &user, contentJSON)
+
+	// the new pseudonym is checked together with the new password
+	r := NewRequest(admin, fmt.Sprintf("/users/%v", user["id"]), http.MethodPut, map[string]interface{}{"pseudonym": "Horse Rider", "password": "Horse Rider1!"}, "user", contentJSON, contentJSON)
+	response := r.makeRequest(t)
+	checkResponseCode(t, response.Code, http.StatusBadRequest)
+	checkValidationProblem(t, response, "password_contains_pseudonym:password")
+
+	// a failed breach check is no fault of the request
+	policy.Breached = unavailableBreachCheck{}
+	validator.Passwords = policy
+	r = NewRequest(admin, fmt.Sprintf("/users/%v", user["id"]), http.MethodPut, map[string]interface{}{"password": "Another-H0rse"}, "user", contentJSON, contentJSON)
+	response = r.makeRequest(t)
+	checkResponseCode(t, response.Code, http.StatusInternalServerError)
+}
+
+// unavailableBreachCheck fails like a breach check whose service cannot be reached.
+type unavailableBreachCheck struct{}
+
+func (unavailableBreachCheck) Contains(password string) (bool, error) {
+	return false, errors.New("breach check unavailable")
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"bookstore/model"
+)
+
+func createUserWithRole(t *testing.T, caller map[string]interface{}, username, pseudonym, role string) map[string]interface{} {
+	user := map[string]interface{}{
+		"username":  username,
+		"pseudonym": pseudonym,
+		"password":  "test123",
+		"is_admin":  role == model.RoleAdmin,
+		"role":      role,
+	}
+
+	createUser(t, caller, &user, contentJSON)
+	return user
+}
+
+func TestRoles(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	editor := createUserWithRole(t, admin, "editor", "Max Perkins", model.RoleEditor)
+	author := createUserWithRole(t, admin, "author", "Dan Brown", model.RoleAuthor)
+	otherAuthor := createUserWithRole(t, admin, "other", "Michael Miller", model.RoleAuthor)
+	reader := createUserWithRole(t, admin, "reader", "Jane Doe", model.RoleReader)
+
+	book := map[string]interface{}{
+		"title":       "Inferno",
+		"description": "More about symbolic stuff",
+		"image_url":   "https://images.books/inferno.jpg",
+		"user_id":     author["id"],
+		"price":       int64(2000),
+	}
+	createBook(t, author, &book, contentJSON)
+
+	// the catalog editor can change every book, but can not manage users
+	updateBook(t, editor, &book, map[string]interface{}{"price": int64(1500)}, contentJSON)
+
+	newUser := map[string]interface{}{
+		"username":  "newuser",
+		"pseudonym": "New User",
+		"password":  "test123",
+		"is_admin":  false,
+	}
+	r := NewRequest(editor, "/users", http.MethodPost, newUser, "user", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusUnauthorized)
+
+	r = NewRequest(editor, fmt.Sprintf("/users/%v", author["id"]), http.MethodPut, map[string]interface{}{"pseudonym": "Changed"}, "user", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusForbidden)
+
+	// authors can only change their own books
+	r = NewRequest(otherAuthor, fmt.Sprintf("/users/%v/books/%v", author["id"], book["id"]), http.MethodPut, map[string]interface{}{"price": int64(1)}, "book", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusForbidden)
+
+	// readers can not write books at all
+	readerBook := map[string]interface{}{
+		"title":       "My book",
+		"description": "Not allowed",
+		"image_url":   "https://images.books/mine.jpg",
+		"price":       int64(100),
+	}
+	r = NewRequest(reader, fmt.Sprintf("/users/%v/books", reader["id"]), http.MethodPost, readerBook, "book", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusForbidden)
+
+	// only user managers can change roles
+	r = NewRequest(author, fmt.Sprintf("/users/%v", author["id"]), http.MethodPut, map[string]interface{}{"role": model.RoleEditor}, "user", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusBadRequest)
+
+	updateUser(t, admin, &reader, map[string]interface{}{"role": model.RoleAuthor}, contentJSON)
+
+	createUserWithError(t, admin, &map[string]interface{}{
+		"username":  "unknownrole",
+		"pseudonym": "Unknown Role",
+		"password":  "test123",
+		"role":      "unknown",
+	}, contentJSON, http.StatusBadRequest, "invalid_user_fields:role")
+}
+
+func TestListRoles(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	contentTypes := []string{contentXML, contentJSON, contentAlternateXML}
+
+	for _, contentType := range contentTypes {
+		var m model.Roles
+		r := NewRequest(admin, "/roles", http.MethodGet, nil, "role", contentType, contentType)
+		response := r.makeRequest(t)
+		checkResponseCode(t, response.Code, http.StatusOK)
+		r.unmarshal(t, response, &m)
+
+		if len(m.Roles) != 4 || m.Roles[0].Name != model.RoleAdmin {
+			t.Fatalf("Expected the four default roles. Got %+v\n", m.Roles)
+		}
+		if len(m.Roles[0].Permissions) != 4 {
+			t.Fatalf("Expected four permissions for admin. Got %v\n", m.Roles[0].Permissions)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"bookstore/model"
+)
+
+func authenticateWithScope(t *testing.T, user map[string]interface{}, scope string, expectedCode int) map[string]string {
+	data := url.Values{}
+	data.Set("username", user["username"].(string))
+	data.Set("password", user["password"].(string))
+	data.Set("scope", scope)
+
+	return postForm(t, "/authenticate", data, expectedCode)
+}
+
+func TestScopedTokens(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	booksPath := fmt.Sprintf("/users/%d/books", admin["id"])
+	book := map[string]interface{}{
+		"title":       "The test book",
+		"description": "More details for testing",
+		"price":       1995,
+	}
+
+	authenticateWithScope(t, admin, "books:read books:delete", http.StatusBadRequest)
+
+	tokens := authenticateWithScope(t, admin, model.ScopeBooksRead, http.StatusOK)
+	if tokens["scope"] != model.ScopeBooksRead {
+		t.Fatalf("Expected scope %s. Got %s\n", model.ScopeBooksRead, tokens["scope"])
+	}
+
+	readToken := tokens["token"]
+	requestWithToken(t, readToken, http.MethodGet, booksPath, nil, http.StatusOK, nil)
+	requestWithToken(t, readToken, http.MethodPost, booksPath, book, http.StatusForbidden, nil)
+	listUsersWithToken(t, readToken, http.StatusForbidden)
+
+	var me model.CurrentUser
+	requestWithToken(t, readToken, http.MethodGet, "/me", nil, http.StatusOK, &me)
+	if len(me.Token.Scopes) != 1 || me.Token.Scopes[0] != model.ScopeBooksRead {
+		t.Fatalf("Expected scopes [%s]. Got %v\n", model.ScopeBooksRead, me.Token.Scopes)
+	}
+
+	// the refreshed token keeps the scope
+	refreshed := refreshToken(t, tokens["refresh_token"], http.StatusOK)
+	if refreshed["scope"] != model.ScopeBooksRead {
+		t.Fatalf("Expected scope %s. Got %s\n", model.ScopeBooksRead, refreshed["scope"])
+	}
+	requestWithToken(t, refreshed["token"], http.MethodPost, booksPath, book, http.StatusForbidden, nil)
+
+	// without scope all scopes are granted
+	tokens = authenticate(t, admin)
+	if tokens["scope"] != strings.Join(model.Scopes, " ") {
+		t.Fatalf("Expected all scopes. Got %s\n", tokens["scope"])
+	}
+	requestWithToken(t, tokens["token"], http.MethodPost, booksPath, book, http.StatusCreated, nil)
+}
+
+func TestInsufficientScopeHeader(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	request, err := http.NewRequest(http.MethodGet, "/users", nil)
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	request = addBearerToken(request, authenticateWithScope(t, admin, model.ScopeBooksRead, http.StatusOK)["token"])
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, http.StatusForbidden)
+
+	expected := `Bearer error="insufficient_scope", scope="users:read"`
+	if header := response.Header().Get("WWW-Authenticate"); header != expected {
+		t.Fatalf("Expected WWW-Authenticate %s. Got %s\n", expected, header)
+	}
+}
+
+func TestScopedPersonalAccessTokens(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	tokensPath := fmt.Sprintf("/users/%d/tokens", admin["id"])
+
+	token := authenticateWithScope(t, admin, "users:write books:read", http.StatusOK)["token"]
+
+	// a token can not grant more than it has
+	requestWithToken(t, token, http.MethodPost, tokensPath, map[string]interface{}{"name": "admin", "scope": model.ScopeUsersAdmin}, http.StatusBadRequest, nil)
+
+	var pat model.PersonalAccessToken
+	requestWithToken(t, token, http.MethodPost, tokensPath, map[string]interface{}{"name": "inherited"}, http.StatusCreated, &pat)
+	if pat.Scope != "users:write books:read" {
+		t.Fatalf("Expected the scope of the creating token. Got %s\n", pat.Scope)
+	}
+
+	requestWithToken(t, token, http.MethodPost, tokensPath, map[string]interface{}{"name": "dashboard", "scope": model.ScopeBooksRead}, http.StatusCreated, &pat)
+	if pat.Scope != model.ScopeBooksRead {
+		t.Fatalf("Expected scope %s. Got %s\n", model.ScopeBooksRead, pat.Scope)
+	}
+
+	requestWithToken(t, pat.Token, http.MethodGet, fmt.Sprintf("/users/%d/books", admin["id"]), nil, http.StatusOK, nil)
+	listUsersWithToken(t, pat.Token, http.StatusForbidden)
+
+	if result := introspect(t, getUserJWT(t, admin), pat.Token, http.StatusOK); result.Scope != model.ScopeBooksRead {
+		t.Fatalf("Expected scope %s. Got %s\n", model.ScopeBooksRead, result.Scope)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"bookstore/model"
+)
+
+func signup(t *testing.T, username, pseudonym string, expectedCode int) (map[string]interface{}, *model.User) {
+	user := map[string]interface{}{
+		"username":  username,
+		"password":  "test123",
+		"pseudonym": pseudonym,
+		"is_admin":  true,
+	}
+
+	var created model.User
+	requestWithToken(t, "", http.MethodPost, "/signup", user, expectedCode, &created)
+
+	// signing up never grants admin permissions
+	user["is_admin"] = false
+	user["id"] = created.ID
+	return user, &created
+}
+
+func listPendingUsers(t *testing.T, admin map[string]interface{}) []model.User {
+	var users []model.User
+	requestWithToken(t, getUserJWT(t, admin), http.MethodGet, "/users/pending", nil, http.StatusOK, &users)
+	return users
+}
+
+func TestSignupWithAdminApproval(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	user, created := signup(t, "jverne", "Jules Verne", http.StatusCreated)
+	checkUser(t, user, created)
+	if created.Status != model.UserStatusPending {
+		t.Fatalf("Expected status %s. Got %s\n", model.UserStatusPending, created.Status)
+	}
+	if created.Role != model.DefaultRole {
+		t.Fatalf("Expected role %s. Got %s\n", model.DefaultRole, created.Role)
+	}
+
+	signup(t, "jverne", "Jules Verne", http.StatusBadRequest)
+	authenticateWithPassword(t, user, "test123", http.StatusForbidden)
+
+	rejected, _ := signup(t, "hgwells", "H. G. Wells", http.StatusCreated)
+
+	pending := listPendingUsers(t, admin)
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 pending users. Got %d\n", len(pending))
+	}
+
+	adminToken := getUserJWT(t, admin)
+	var approved model.User
+	requestWithToken(t, adminToken, http.MethodPost, fmt.Sprintf("/users/%d/approve", user["id"]), nil, http.StatusOK, &approved)
+	if approved.Status != model.UserStatusActive {
+		t.Fatalf("Expected status %s. Got %s\n", model.UserStatusActive, approved.Status)
+	}
+	requestWithToken(t, adminToken, http.MethodPost, fmt.Sprintf("/users/%d/approve", user["id"]), nil, http.StatusNotFound, nil)
+
+	// approved users can not list pending users
+	requestWithToken(t, getUserJWT(t, user), http.MethodGet, "/users/pending", nil, http.StatusForbidden, nil)
+
+	requestWithToken(t, adminToken, http.MethodPost, fmt.Sprintf("/users/%d/reject", rejected["id"]), nil, http.StatusNoContent, nil)
+	requestWithToken(t, adminToken, http.MethodGet, fmt.Sprintf("/users/%d", rejected["id"]), nil, http.StatusNotFound, nil)
+	requestWithToken(t, adminToken, http.MethodPost, fmt.Sprintf("/users/%d/reject", user["id"]), nil, http.StatusNotFound, nil)
+
+	if pending := listPendingUsers(t, admin); len(pending) != 0 {
+		t.Fatalf("Expected no pending users. Got %d\n", len(pending))
+	}
+}
+
+func TestSignupWithAutoApproval(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	adminToken := getUserJWT(t, admin)
+
+	requestWithToken(t, adminToken, http.MethodPut, "/settings", map[string]interface{}{"signup_approval": "never"}, http.StatusBadRequest, nil)
+
+	var settings model.Settings
+	requestWithToken(t, adminToken, http.MethodPut, "/settings", map[string]interface{}{"signup_approval": model.SignupApprovalAuto}, http.StatusOK, &settings)
+	if settings.SignupApproval != model.SignupApprovalAuto {
+		t.Fatalf("Expected signup_approval %s. Got %s\n", model.SignupApprovalAuto, settings.SignupApproval)
+	}
+
+	user, created := signup(t, "jverne", "Jules Verne", http.StatusCreated)
+	if created.Status != model.UserStatusActive {
+		t.Fatalf("Expected status %s. Got %s\n", model.UserStatusActive, created.Status)
+	}
+
+	tokens := authenticate(t, user)
+	token := tokens["token"]
+	requestWithToken(t, token, http.MethodGet, fmt.Sprintf("/users/%d", user["id"]), nil, http.StatusOK, nil)
+
+	// outstanding tokens stop working, once the user is pending again
+	if err := store.SetUserStatus(user["id"].(int64), model.UserStatusPending); err != nil {
+		t.Fatalf("Problem changing the user status: %v\n", err)
+	}
+	requestWithToken(t, token, http.MethodGet, fmt.Sprintf("/users/%d", user["id"]), nil, http.StatusForbidden, nil)
+	refreshToken(t, tokens["refresh_token"], http.StatusForbidden)
+
+	// the family was revoked, an approval does not bring the session back
+	if err := store.SetUserStatus(user["id"].(int64), model.UserStatusActive); err != nil {
+		t.Fatalf("Problem changing the user status: %v\n", err)
+	}
+	refreshToken(t, tokens["refresh_token"], http.StatusBadRequest)
+}
+
+func TestConcurrentSignup(t *testing.T) {
+	resetDatabase(t)
+
+	body, err := json.Marshal(map[string]interface{}{"username": "jverne", "password": "test123", "pseudonym": "Jules Verne"})
+	if err != nil {
+		t.Fatalf("Problem marshaling request: %v\n", err)
+	}
+
+	// validation and creation share a transaction, so only one of the racing requests wins
+	const requests = 8
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request, _ := http.NewRequest(http.MethodPost, "/signup", bytes.NewReader(body))
+			request.Header.Set("Content-Type", contentJSON)
+			codes <- executeRequest(request).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusBadRequest, http.StatusConflict:
+		default:
+			t.Fatalf("Expected the signups to succeed or be refused. Got %d\n", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected exactly one signup to succeed. Got %d\n", created)
+	}
+}
@@ -0,0 +1,844 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"bookstore/database"
+	"bookstore/model"
+	"bookstore/storage"
+)
+
+// storageBackends are checked by the conformance suite, every test gets an empty storage.
+var storageBackends = []struct {
+	name string
+	open func(t *testing.T) storage.Store
+}{
+	{"sqlite", openSQLiteStorage},
+	{"memory", func(t *testing.T) storage.Store {
+		s := storage.NewMemoryStorage()
+		s.SetPasswordPolicy(testPasswordPolicy)
+		return s
+	}},
+}
+
+func openSQLiteStorage(t *testing.T) storage.Store {
+	db, driver, err := database.Open(filepath.Join(t.TempDir(), "conformance.sqlite"))
+	if err != nil {
+		t.Fatalf("Problem opening the database: %v\n", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := database.Migrate(db, driver); err != nil {
+		t.Fatalf("Problem migrating the database: %v\n", err)
+	}
+
+	s := storage.NewStorage(db)
+	s.SetPasswordPolicy(testPasswordPolicy)
+	return s
+}
+
+func TestStorageConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s storage.Store)
+	}{
+		{"Users", conformUsers},
+		{"PasswordChange", conformPasswordChange},
+		{"Roles", conformRoles},
+		{"Books", conformBooks},
+		{"DeleteUserCascades", conformDeleteUserCascades},
+		{"Tokens", conformTokens},
+		{"PersonalAccessTokens", conformPersonalAccessTokens},
+		{"TOTP", conformTOTP},
+		{"OIDC", conformOIDC},
+		{"SettingsAndThrottles", conformSettingsAndThrottles},
+		{"AuditEvents", conformAuditEvents},
+		{"Transactions", conformTransactions},
+	}
+
+	for _, backend := range storageBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Parallel()
+			for _, test := range tests {
+				test := test
+				t.Run(test.name, func(t *testing.T) {
+					test.run(t, backend.open(t))
+				})
+			}
+		})
+	}
+}
+
+func mustCreateUser(t *testing.T, s storage.Store, request *model.UserCreationRequest) *model.User {
+	t.Helper()
+	if request.Password == "" {
+		request.Password = "secret123"
+	}
+	user, err := s.CreateUser(request)
+	if err != nil {
+		t.Fatalf("Problem creating user %s: %v\n", request.Username, err)
+	}
+	return user
+}
+
+func mustCreateBook(t *testing.T, s storage.Store, userID int64, title string, price int64, description string) *model.Book {
+	t.Helper()
+	book, err := s.CreateBook(userID, &model.BookCreationRequest{Title: title, Description: description, Price: price})
+	if err != nil {
+		t.Fatalf("Problem creating book %s: %v\n", title, err)
+	}
+	return book
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+}
+
+func bookTitles(books *model.Books) []string {
+	titles := []string{}
+	for _, book := range books.Books {
+		titles = append(titles, book.Title)
+	}
+	return titles
+}
+
+func conformUsers(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "Alice", Pseudonym: "A", Email: "a@example.com", EmailVerified: true})
+	if alice.Username != "alice" || alice.Role != model.DefaultRole || alice.IsAdmin || alice.Status != model.UserStatusActive {
+		t.Fatalf("Unexpected user %+v\n", alice)
+	}
+	if !reflect.DeepEqual(alice.Permissions, []model.Permission{model.PermissionWriteOwnBook, model.PermissionReadUsers}) {
+		t.Fatalf("Unexpected permissions %v\n", alice.Permissions)
+	}
+
+	if _, err := s.CreateUser(&model.UserCreationRequest{Username: "ALICE", Password: "secret123", Pseudonym: "A2"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected duplicate username to conflict\n")
+	}
+	if _, err := s.CreateUser(&model.UserCreationRequest{Username: "bob", Password: "secret123", Pseudonym: "A"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected duplicate pseudonym to conflict\n")
+	}
+
+	bob := mustCreateUser(t, s, &model.UserCreationRequest{Username: "bob", Pseudonym: "B", Email: "A@example.com", EmailVerified: true, IsAdmin: true})
+	if bob.Role != model.RoleAdmin || !bob.IsAdmin || len(bob.Permissions) != 4 {
+		t.Fatalf("Unexpected admin %+v\n", bob)
+	}
+	carol := mustCreateUser(t, s, &model.UserCreationRequest{Username: "carol", Pseudonym: "C", Email: "c@example.com", EmailVerified: true, Role: model.RoleEditor})
+	nobody := mustCreateUser(t, s, &model.UserCreationRequest{Username: "dave", Pseudonym: "D", Email: "d@example.com", Role: "unknown"})
+	if nobody.Role != "" || len(nobody.Permissions) != 0 {
+		t.Fatalf("Expected user of an unknown role without permissions. Got %+v\n", nobody)
+	}
+
+	// shared addresses identify nobody
+	if user, err := s.UserByEmail("a@example.com"); err != nil || user != nil {
+		t.Fatalf("Expected no user for a shared address. Got %v %v\n", user, err)
+	}
+	if user, err := s.UserByEmail("C@EXAMPLE.COM"); err != nil || user == nil || user.ID != carol.ID || !user.EmailVerified {
+		t.Fatalf("Expected carol. Got %v %v\n", user, err)
+	}
+	// unconfirmed addresses identify nobody either
+	if user, err := s.UserByEmail("d@example.com"); err != nil || user != nil {
+		t.Fatalf("Expected no user for an unconfirmed address. Got %v %v\n", user, err)
+	}
+
+	if user, err := s.UserByUsername("BOB"); err != nil || user == nil || user.ID != bob.ID {
+		t.Fatalf("Expected bob. Got %v %v\n", user, err)
+	}
+	if user, err := s.UserByID(1000); !errors.Is(err, storage.ErrNotFound) || user != nil {
+		t.Fatalf("Expected no user. Got %v %v\n", user, err)
+	}
+
+	must(t, s.SetUserStatus(carol.ID, model.UserStatusPending))
+	users, err := s.Users()
+	must(t, err)
+	var usernames []string
+	for _, user := range users.Users {
+		usernames = append(usernames, user.Username)
+	}
+	if !reflect.DeepEqual(usernames, []string{"alice", "bob", "carol", "dave"}) {
+		t.Fatalf("Expected users ordered by username. Got %v\n", usernames)
+	}
+	pending, err := s.PendingUsers()
+	must(t, err)
+	if len(pending.Users) != 1 || pending.Users[0].ID != carol.ID || pending.Users[0].Role != model.RoleEditor {
+		t.Fatalf("Expected carol to be pending. Got %+v\n", pending.Users)
+	}
+
+	if !s.UserExists("ALICE") || s.UserExists("eve") {
+		t.Fatalf("Unexpected result of UserExists\n")
+	}
+	if !s.UserWithPseudonymExists("B") || s.UserWithPseudonymExists("b") {
+		t.Fatalf("Unexpected result of UserWithPseudonymExists\n")
+	}
+	if s.AnotherUserExists(alice.ID, "alice") || !s.AnotherUserExists(bob.ID, "Alice") {
+		t.Fatalf("Unexpected result of AnotherUserExists\n")
+	}
+
+	carol.Username = "Bob"
+	if err := s.UpdateUser(carol); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected renaming to an existing username to conflict\n")
+	}
+	carol.Username, carol.Pseudonym = "Caroline", "A"
+	if err := s.UpdateUser(carol); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected an existing pseudonym to conflict\n")
+	}
+	carol.Pseudonym, carol.Role = "Caro", model.RoleReader
+	must(t, s.UpdateUser(carol))
+	updated, err := s.UserByUsername("caroline")
+	must(t, err)
+	if updated == nil || updated.Pseudonym != "Caro" || updated.Role != model.RoleReader || updated.TokenVersion != 0 {
+		t.Fatalf("Unexpected updated user %+v\n", updated)
+	}
+
+	must(t, s.CheckPassword("ALICE", "secret123"))
+	if err := s.CheckPassword("alice", "wrong"); err == nil {
+		t.Fatalf("Expected wrong password to fail\n")
+	}
+	if err := s.CheckPassword("eve", "secret123"); err == nil {
+		t.Fatalf("Expected unknown user to fail\n")
+	}
+}
+
+func conformPasswordChange(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+	must(t, s.CreateRefreshToken(alice.ID, "family", "refresh", "", time.Now().Add(time.Hour)))
+
+	alice.Password = "changed123"
+	must(t, s.UpdateUser(alice))
+	if alice.TokenVersion != 1 {
+		t.Fatalf("Expected token version 1. Got %d\n", alice.TokenVersion)
+	}
+
+	stored, err := s.UserByID(alice.ID)
+	must(t, err)
+	if stored.TokenVersion != 1 {
+		t.Fatalf("Expected stored token version 1. Got %d\n", stored.TokenVersion)
+	}
+	token, err := s.RefreshTokenByHash("refresh")
+	must(t, err)
+	if !token.Revoked {
+		t.Fatalf("Expected refresh tokens to be revoked\n")
+	}
+	if err := s.CheckPassword("alice", "secret123"); err == nil {
+		t.Fatalf("Expected old password to fail\n")
+	}
+	must(t, s.CheckPassword("alice", "changed123"))
+}
+
+func conformRoles(t *testing.T, s storage.Store) {
+	roles, err := s.Roles()
+	must(t, err)
+
+	expected := []model.Role{
+		{Name: model.RoleAdmin, Permissions: []model.Permission{model.PermissionWriteAnyBook, model.PermissionWriteOwnBook, model.PermissionManageUsers, model.PermissionReadUsers}},
+		{Name: model.RoleAuthor, Permissions: []model.Permission{model.PermissionWriteOwnBook, model.PermissionReadUsers}},
+		{Name: model.RoleEditor, Permissions: []model.Permission{model.PermissionWriteAnyBook, model.PermissionWriteOwnBook, model.PermissionReadUsers}},
+		{Name: model.RoleReader, Permissions: []model.Permission{model.PermissionReadUsers}},
+	}
+	if !reflect.DeepEqual(roles.Roles, expected) {
+		t.Fatalf("Expected %v. Got %v\n", expected, roles.Roles)
+	}
+	if !s.RoleExists(model.RoleEditor) || s.RoleExists("unknown") {
+		t.Fatalf("Unexpected result of RoleExists\n")
+	}
+}
+
+func conformBooks(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+	bob := mustCreateUser(t, s, &model.UserCreationRequest{Username: "bob", Pseudonym: "B"})
+
+	first := mustCreateBook(t, s, alice.ID, "B title", 10, "first")
+	if first.User == nil || first.User.ID != alice.ID || first.UserID != alice.ID {
+		t.Fatalf("Expected the book with its user. Got %+v\n", first)
+	}
+	second := mustCreateBook(t, s, alice.ID, "A title", 20, "")
+	mustCreateBook(t, s, bob.ID, "C title", 30, "Second book")
+
+	if _, err := s.CreateBook(alice.ID, &model.BookCreationRequest{Title: "A title"}); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected duplicate title to conflict\n")
+	}
+	if !s.BookForUserExists(alice.ID, "A title") || s.BookForUserExists(bob.ID, "A title") {
+		t.Fatalf("Unexpected result of BookForUserExists\n")
+	}
+	mustCreateBook(t, s, bob.ID, "A title", 5, "")
+	if _, err := s.CreateBook(1000, &model.BookCreationRequest{Title: "Orphan"}); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected book of unknown user to fail\n")
+	}
+
+	books, err := s.Books()
+	must(t, err)
+	if titles := bookTitles(books); !reflect.DeepEqual(titles, []string{"C title", "B title", "A title", "A title"}) {
+		t.Fatalf("Expected books ordered by title descending. Got %v\n", titles)
+	}
+	if user := books.Books[0].User; user == nil || user.Username != "bob" || user.Pseudonym != "B" {
+		t.Fatalf("Expected the book with its user. Got %+v\n", user)
+	}
+
+	title, description, minPrice, maxPrice, author := "TITLE", "second", int64(15), int64(10), alice.ID
+	for _, test := range []struct {
+		search   model.BookListingRequest
+		expected []string
+	}{
+		{model.BookListingRequest{Title: &title, MinPrice: &minPrice}, []string{"C title", "A title"}},
+		{model.BookListingRequest{Description: &description}, []string{"C title"}},
+		{model.BookListingRequest{MaxPrice: &maxPrice}, []string{"B title", "A title"}},
+		{model.BookListingRequest{AutorID: &author}, []string{"B title", "A title"}},
+	} {
+		books, err := s.SearchBooks(test.search)
+		must(t, err)
+		if titles := bookTitles(books); !reflect.DeepEqual(titles, test.expected) {
+			t.Fatalf("Expected %v. Got %v\n", test.expected, titles)
+		}
+	}
+
+	userBooks, err := s.UserBooks(bob.ID)
+	must(t, err)
+	if titles := bookTitles(userBooks); !reflect.DeepEqual(titles, []string{"C title", "A title"}) {
+		t.Fatalf("Unexpected books of bob %v\n", titles)
+	}
+
+	if book, err := s.BookByIDAndUserID(bob.ID, first.ID); !errors.Is(err, storage.ErrNotFound) || book != nil {
+		t.Fatalf("Expected no book. Got %v %v\n", book, err)
+	}
+	if book, err := s.BookByID(1000); !errors.Is(err, storage.ErrNotFound) || book != nil {
+		t.Fatalf("Expected no book. Got %v %v\n", book, err)
+	}
+
+	if !s.BookWithSameTitle(alice.ID, first.ID, "A title") ||
+		s.BookWithSameTitle(alice.ID, second.ID, "A title") ||
+		s.BookWithSameTitle(alice.ID, first.ID, "C title") {
+		t.Fatalf("Unexpected result of BookWithSameTitle\n")
+	}
+
+	first.Title = "A title"
+	if err := s.UpdateBook(first); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected renaming to an existing title to conflict\n")
+	}
+	first.Title, first.Price = "D title", 15
+	must(t, s.UpdateBook(first))
+	book, err := s.BookByIDAndUserID(alice.ID, first.ID)
+	must(t, err)
+	if book == nil || book.Title != "D title" || book.Price != 15 || book.Description != "first" {
+		t.Fatalf("Unexpected updated book %+v\n", book)
+	}
+
+	must(t, s.DeleteBook(first.ID))
+	if _, err := s.BookByID(first.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected deleted book to be gone\n")
+	}
+	if err := s.DeleteBook(first.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected deleting a missing book to be not found. Got %v\n", err)
+	}
+	if err := s.UpdateBook(first); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected updating a missing book to be not found. Got %v\n", err)
+	}
+}
+
+func conformDeleteUserCascades(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+	bob := mustCreateUser(t, s, &model.UserCreationRequest{Username: "bob", Pseudonym: "B"})
+	expiry := time.Now().Add(time.Hour)
+
+	mustCreateBook(t, s, alice.ID, "Alice's book", 10, "")
+	mustCreateBook(t, s, bob.ID, "Bob's book", 10, "")
+	must(t, s.CreateRefreshToken(alice.ID, "family", "refresh", "", expiry))
+	_, err := s.CreatePersonalAccessToken(alice.ID, "ci", "pat", "")
+	must(t, err)
+	must(t, s.CreatePasswordResetToken(alice.ID, "reset", expiry))
+	must(t, s.CreateEmailConfirmationToken(alice.ID, "alice@example.com", "confirm", expiry))
+	must(t, s.EnableTOTP(alice.ID, 1, []string{"code"}))
+	must(t, s.CreateMFAChallenge(alice.ID, "challenge", "", expiry))
+	must(t, s.LinkIdentity(alice.ID, "issuer", "subject"))
+	must(t, s.CreateAuditEvent(&model.AuditEvent{CreatedAt: time.Now(), ActorID: &alice.ID, Actor: "alice", Action: "Test"}))
+
+	must(t, s.DeleteUser(alice.ID))
+
+	if _, err := s.UserByID(alice.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected deleted user to be gone\n")
+	}
+	for name, err := range map[string]error{
+		"delete": s.DeleteUser(alice.ID),
+		"update": s.UpdateUser(alice),
+		"status": s.SetUserStatus(alice.ID, model.UserStatusActive),
+	} {
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("Expected %s of a missing user to be not found. Got %v\n", name, err)
+		}
+	}
+	books, err := s.Books()
+	must(t, err)
+	if titles := bookTitles(books); !reflect.DeepEqual(titles, []string{"Bob's book"}) {
+		t.Fatalf("Expected only the books of bob. Got %v\n", titles)
+	}
+	if token, _ := s.RefreshTokenByHash("refresh"); token != nil {
+		t.Fatalf("Expected refresh token to be deleted\n")
+	}
+	if token, _ := s.PersonalAccessTokenByHash("pat"); token != nil {
+		t.Fatalf("Expected personal access token to be deleted\n")
+	}
+	if token, _ := s.PasswordResetTokenByHash("reset"); token != nil {
+		t.Fatalf("Expected password reset token to be deleted\n")
+	}
+	if token, _ := s.EmailConfirmationTokenByHash("confirm"); token != nil {
+		t.Fatalf("Expected email confirmation token to be deleted\n")
+	}
+	if used, _ := s.UseRecoveryCode(alice.ID, "code"); used {
+		t.Fatalf("Expected recovery codes to be deleted\n")
+	}
+	if challenge, _ := s.MFAChallengeByHash("challenge"); challenge != nil {
+		t.Fatalf("Expected mfa challenge to be deleted\n")
+	}
+	if user, _ := s.UserByIdentity("issuer", "subject"); user != nil {
+		t.Fatalf("Expected identity to be deleted\n")
+	}
+	events, err := s.AuditEvents(model.AuditEventListingRequest{})
+	must(t, err)
+	if len(events.Events) != 1 || *events.Events[0].ActorID != alice.ID {
+		t.Fatalf("Expected audit events to be kept. Got %+v\n", events.Events)
+	}
+
+	// ids are not reused and references to deleted users fail
+	carol := mustCreateUser(t, s, &model.UserCreationRequest{Username: "carol", Pseudonym: "C"})
+	if carol.ID <= bob.ID {
+		t.Fatalf("Expected a new id. Got %d\n", carol.ID)
+	}
+	must(t, s.LinkIdentity(carol.ID, "issuer", "subject"))
+	if err := s.CreateRefreshToken(alice.ID, "family", "other", "", expiry); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected refresh token of deleted user to fail\n")
+	}
+	if _, err := s.CreateBook(alice.ID, &model.BookCreationRequest{Title: "Ghost"}); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected book of deleted user to fail\n")
+	}
+}
+
+func conformTokens(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	must(t, s.CreateRefreshToken(alice.ID, "family", "first", "books:read", expiry))
+	must(t, s.CreateRefreshToken(alice.ID, "family", "second", "", expiry))
+	if err := s.CreateRefreshToken(alice.ID, "other", "first", "", expiry); err == nil {
+		t.Fatalf("Expected duplicate token hash to fail\n")
+	}
+
+	first, err := s.RefreshTokenByHash("first")
+	must(t, err)
+	if first == nil || first.UserID != alice.ID || first.FamilyID != "family" || first.Scope != "books:read" || !first.ExpiresAt.Equal(expiry) || first.Used || first.Revoked {
+		t.Fatalf("Unexpected refresh token %+v\n", first)
+	}
+	if used, err := s.UseRefreshToken(first.ID); err != nil || !used {
+		t.Fatalf("Expected refresh token to be used. Got %v %v\n", used, err)
+	}
+	if used, _ := s.UseRefreshToken(first.ID); used {
+		t.Fatalf("Expected refresh token to be used only once\n")
+	}
+
+	must(t, s.RevokeRefreshTokenFamily("family"))
+	second, err := s.RefreshTokenByHash("second")
+	must(t, err)
+	if !second.Revoked {
+		t.Fatalf("Expected the family to be revoked\n")
+	}
+	if used, _ := s.UseRefreshToken(second.ID); used {
+		t.Fatalf("Expected revoked token to be refused\n")
+	}
+
+	must(t, s.DenyToken("expired", time.Now().Add(-time.Minute)))
+	must(t, s.DenyToken("jti", expiry))
+	must(t, s.DenyToken("jti", expiry))
+	if denied, err := s.TokenDenied("jti"); err != nil || !denied {
+		t.Fatalf("Expected token to be denied. Got %v %v\n", denied, err)
+	}
+	if denied, _ := s.TokenDenied("expired"); denied {
+		t.Fatalf("Expected expired entries to be purged\n")
+	}
+	if denied, _ := s.TokenDenied("unknown"); denied {
+		t.Fatalf("Expected unknown token not to be denied\n")
+	}
+
+	must(t, s.CreatePasswordResetToken(alice.ID, "old", expiry))
+	must(t, s.CreatePasswordResetToken(alice.ID, "new", expiry))
+	if token, _ := s.PasswordResetTokenByHash("old"); token != nil {
+		t.Fatalf("Expected older reset tokens to be discarded\n")
+	}
+	reset, err := s.PasswordResetTokenByHash("new")
+	must(t, err)
+	if reset == nil || reset.UserID != alice.ID || !reset.ExpiresAt.Equal(expiry) {
+		t.Fatalf("Unexpected reset token %+v\n", reset)
+	}
+	if used, err := s.UsePasswordResetToken(reset.ID); err != nil || !used {
+		t.Fatalf("Expected reset token to be used. Got %v %v\n", used, err)
+	}
+	if used, _ := s.UsePasswordResetToken(reset.ID); used {
+		t.Fatalf("Expected reset token to be used only once\n")
+	}
+
+	// a confirmation only verifies the email, which it was sent to
+	alice.Email = "alice@example.com"
+	must(t, s.UpdateUser(alice))
+	must(t, s.CreateEmailConfirmationToken(alice.ID, "alice@example.com", "confirm", expiry))
+	confirmation, err := s.EmailConfirmationTokenByHash("confirm")
+	must(t, err)
+	if confirmation == nil || confirmation.UserID != alice.ID || confirmation.Email != "alice@example.com" || !confirmation.ExpiresAt.Equal(expiry) {
+		t.Fatalf("Unexpected confirmation token %+v\n", confirmation)
+	}
+	if confirmed, err := s.ConfirmEmail(confirmation.ID); err != nil || !confirmed {
+		t.Fatalf("Expected email to be confirmed. Got %v %v\n", confirmed, err)
+	}
+	if confirmed, _ := s.ConfirmEmail(confirmation.ID); confirmed {
+		t.Fatalf("Expected confirmation token to be used only once\n")
+	}
+	alice.Pseudonym = "A2"
+	must(t, s.UpdateUser(alice))
+	if user, err := s.UserByEmail("alice@example.com"); err != nil || user == nil || !user.EmailVerified {
+		t.Fatalf("Expected the confirmed email to be kept. Got %v %v\n", user, err)
+	}
+
+	must(t, s.CreateEmailConfirmationToken(alice.ID, "alice@example.com", "outdated", expiry))
+	alice.Email = "alice@example.org"
+	must(t, s.UpdateUser(alice))
+	if user, _ := s.UserByID(alice.ID); user.EmailVerified {
+		t.Fatalf("Expected a changed email to be unconfirmed\n")
+	}
+	outdated, err := s.EmailConfirmationTokenByHash("outdated")
+	must(t, err)
+	if confirmed, err := s.ConfirmEmail(outdated.ID); err != nil || confirmed {
+		t.Fatalf("Expected the token of the previous email to be refused. Got %v %v\n", confirmed, err)
+	}
+}
+
+func conformPersonalAccessTokens(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+	bob := mustCreateUser(t, s, &model.UserCreationRequest{Username: "bob", Pseudonym: "B"})
+
+	zeta, err := s.CreatePersonalAccessToken(alice.ID, "zeta", "hash1", "books:read")
+	must(t, err)
+	if zeta.UserID != alice.ID || zeta.Name != "zeta" || zeta.Scope != "books:read" || zeta.CreatedAt.IsZero() || zeta.LastUsedAt != nil {
+		t.Fatalf("Unexpected token %+v\n", zeta)
+	}
+	_, err = s.CreatePersonalAccessToken(alice.ID, "alpha", "hash2", "")
+	must(t, err)
+	if _, err := s.CreatePersonalAccessToken(alice.ID, "zeta", "hash3", ""); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected duplicate name to conflict\n")
+	}
+	if _, err := s.CreatePersonalAccessToken(bob.ID, "other", "hash1", ""); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected duplicate hash to conflict\n")
+	}
+	_, err = s.CreatePersonalAccessToken(bob.ID, "zeta", "hash4", "")
+	must(t, err)
+
+	if !s.PersonalAccessTokenExists(alice.ID, "alpha") || s.PersonalAccessTokenExists(bob.ID, "alpha") {
+		t.Fatalf("Unexpected result of PersonalAccessTokenExists\n")
+	}
+
+	tokens, err := s.PersonalAccessTokens(alice.ID)
+	must(t, err)
+	if len(tokens.Tokens) != 2 || tokens.Tokens[0].Name != "alpha" || tokens.Tokens[1].Name != "zeta" {
+		t.Fatalf("Expected tokens ordered by name. Got %+v\n", tokens.Tokens)
+	}
+
+	if _, err := s.PersonalAccessTokenByIDAndUserID(bob.ID, zeta.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected no token of another user\n")
+	}
+	must(t, s.TouchPersonalAccessToken(zeta.ID))
+	token, err := s.PersonalAccessTokenByHash("hash1")
+	must(t, err)
+	if token == nil || token.ID != zeta.ID || token.LastUsedAt == nil {
+		t.Fatalf("Expected the last use to be recorded. Got %+v\n", token)
+	}
+
+	must(t, s.DeletePersonalAccessToken(zeta.ID))
+	if _, err := s.PersonalAccessTokenByIDAndUserID(alice.ID, zeta.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected deleted token to be gone\n")
+	}
+	if err := s.DeletePersonalAccessToken(zeta.ID); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Expected deleting a missing token to be not found. Got %v\n", err)
+	}
+}
+
+func conformTOTP(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+
+	totp, err := s.UserTOTP(alice.ID)
+	must(t, err)
+	if *totp != (model.TOTP{}) {
+		t.Fatalf("Expected no totp. Got %+v\n", totp)
+	}
+	if totp, _ := s.UserTOTP(1000); totp != nil {
+		t.Fatalf("Expected no totp for unknown user\n")
+	}
+
+	must(t, s.SetTOTPSecret(alice.ID, "SECRET"))
+	must(t, s.EnableTOTP(alice.ID, 10, []string{"code1", "code2"}))
+	totp, err = s.UserTOTP(alice.ID)
+	must(t, err)
+	if *totp != (model.TOTP{Secret: "SECRET", Enabled: true, LastStep: 10}) {
+		t.Fatalf("Unexpected totp %+v\n", totp)
+	}
+	if user, _ := s.UserByID(alice.ID); !user.TOTPEnabled {
+		t.Fatalf("Expected totp to be enabled for the user\n")
+	}
+
+	if used, _ := s.UseTOTPStep(alice.ID, 10); used {
+		t.Fatalf("Expected the step of the enrolment to be used\n")
+	}
+	if used, err := s.UseTOTPStep(alice.ID, 11); err != nil || !used {
+		t.Fatalf("Expected step to be used. Got %v %v\n", used, err)
+	}
+	if used, _ := s.UseTOTPStep(alice.ID, 11); used {
+		t.Fatalf("Expected steps to be used only once\n")
+	}
+
+	if used, err := s.UseRecoveryCode(alice.ID, "code1"); err != nil || !used {
+		t.Fatalf("Expected recovery code to be used. Got %v %v\n", used, err)
+	}
+	if used, _ := s.UseRecoveryCode(alice.ID, "code1"); used {
+		t.Fatalf("Expected recovery code to be used only once\n")
+	}
+	must(t, s.EnableTOTP(alice.ID, 20, []string{"code3"}))
+	if used, _ := s.UseRecoveryCode(alice.ID, "code2"); used {
+		t.Fatalf("Expected recovery codes to be replaced\n")
+	}
+
+	must(t, s.SetTOTPSecret(alice.ID, "OTHER"))
+	totp, err = s.UserTOTP(alice.ID)
+	must(t, err)
+	if *totp != (model.TOTP{Secret: "OTHER"}) {
+		t.Fatalf("Expected a new secret to be inactive. Got %+v\n", totp)
+	}
+	must(t, s.DisableTOTP(alice.ID))
+	if used, _ := s.UseRecoveryCode(alice.ID, "code3"); used {
+		t.Fatalf("Expected recovery codes to be deleted\n")
+	}
+
+	must(t, s.CreateMFAChallenge(alice.ID, "expired", "", time.Now().Add(-time.Minute)))
+	must(t, s.CreateMFAChallenge(alice.ID, "challenge", "books:read", time.Now().Add(time.Minute)))
+	if challenge, _ := s.MFAChallengeByHash("expired"); challenge != nil {
+		t.Fatalf("Expected expired challenges to be purged\n")
+	}
+	challenge, err := s.MFAChallengeByHash("challenge")
+	must(t, err)
+	if challenge == nil || challenge.UserID != alice.ID || challenge.Scope != "books:read" {
+		t.Fatalf("Unexpected challenge %+v\n", challenge)
+	}
+	if deleted, err := s.DeleteMFAChallenge(challenge.ID); err != nil || !deleted {
+		t.Fatalf("Expected challenge to be deleted. Got %v %v\n", deleted, err)
+	}
+	if deleted, _ := s.DeleteMFAChallenge(challenge.ID); deleted {
+		t.Fatalf("Expected challenge to be deleted only once\n")
+	}
+}
+
+func conformOIDC(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+	bob := mustCreateUser(t, s, &model.UserCreationRequest{Username: "bob", Pseudonym: "B"})
+
+	must(t, s.CreateOIDCLogin("expired", "nonce0", "verifier0", 0, time.Now().Add(-time.Minute)))
+	must(t, s.CreateOIDCLogin("state", "nonce", "verifier", 0, time.Now().Add(time.Minute)))
+	must(t, s.CreateOIDCLogin("link", "nonce1", "verifier1", bob.ID, time.Now().Add(time.Minute)))
+	if login, _ := s.UseOIDCLogin("expired"); login != nil {
+		t.Fatalf("Expected expired logins to be purged\n")
+	}
+	login, err := s.UseOIDCLogin("state")
+	must(t, err)
+	if login == nil || login.Nonce != "nonce" || login.CodeVerifier != "verifier" || login.UserID != 0 {
+		t.Fatalf("Unexpected login %+v\n", login)
+	}
+	if login, _ := s.UseOIDCLogin("link"); login == nil || login.UserID != bob.ID {
+		t.Fatalf("Expected login linking bob. Got %+v\n", login)
+	}
+	if login, _ := s.UseOIDCLogin("state"); login != nil {
+		t.Fatalf("Expected login to be used only once\n")
+	}
+
+	must(t, s.LinkIdentity(alice.ID, "issuer", "subject"))
+	if err := s.LinkIdentity(bob.ID, "issuer", "subject"); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected duplicate identity to conflict\n")
+	}
+	must(t, s.LinkIdentity(bob.ID, "other", "subject"))
+
+	user, err := s.UserByIdentity("issuer", "subject")
+	must(t, err)
+	if user == nil || user.ID != alice.ID || len(user.Permissions) == 0 {
+		t.Fatalf("Expected alice. Got %+v\n", user)
+	}
+	if user, _ := s.UserByIdentity("issuer", "unknown"); user != nil {
+		t.Fatalf("Expected no user\n")
+	}
+}
+
+func conformSettingsAndThrottles(t *testing.T, s storage.Store) {
+	settings, err := s.Settings()
+	must(t, err)
+	if settings.SignupApproval != model.SignupApprovalAdmin || settings.RequireAdminTOTP {
+		t.Fatalf("Expected default settings. Got %+v\n", settings)
+	}
+	settings.SignupApproval, settings.RequireAdminTOTP = model.SignupApprovalAuto, true
+	must(t, s.UpdateSettings(settings))
+	settings, err = s.Settings()
+	must(t, err)
+	if settings.SignupApproval != model.SignupApprovalAuto || !settings.RequireAdminTOTP {
+		t.Fatalf("Expected updated settings. Got %+v\n", settings)
+	}
+
+	if throttle, err := s.LoginThrottle("alice"); err != nil || throttle != nil {
+		t.Fatalf("Expected no throttle. Got %v %v\n", throttle, err)
+	}
+	now := time.Now().Truncate(time.Second)
+	must(t, s.SaveLoginThrottle(&model.LoginThrottle{Subject: "alice", Failures: 1, LastFailureAt: now, BlockedUntil: now}))
+	must(t, s.SaveLoginThrottle(&model.LoginThrottle{Subject: "alice", Failures: 2, LastFailureAt: now, BlockedUntil: now.Add(time.Minute), Locked: true}))
+	throttle, err := s.LoginThrottle("alice")
+	must(t, err)
+	if throttle == nil || throttle.Failures != 2 || !throttle.LastFailureAt.Equal(now) || !throttle.BlockedUntil.Equal(now.Add(time.Minute)) || !throttle.Locked {
+		t.Fatalf("Unexpected throttle %+v\n", throttle)
+	}
+	must(t, s.DeleteLoginThrottle("alice"))
+	if throttle, _ := s.LoginThrottle("alice"); throttle != nil {
+		t.Fatalf("Expected throttle to be deleted\n")
+	}
+
+	must(t, s.WithTx(func(tx storage.Store) error {
+		throttle, err := tx.LockLoginThrottle("alice")
+		if err != nil || throttle == nil || throttle.Failures != 0 || throttle.Locked {
+			t.Fatalf("Expected a new throttle. Got %+v %v\n", throttle, err)
+		}
+		return nil
+	}))
+}
+
+func conformAuditEvents(t *testing.T, s storage.Store) {
+	start := time.Now().Truncate(time.Second)
+	actorID := int64(42)
+	for i, action := range []string{"Authenticate", "DeleteUser", "Authenticate"} {
+		event := &model.AuditEvent{
+			CreatedAt: start.Add(time.Duration(i) * time.Minute),
+			Actor:     "alice",
+			Action:    action,
+			Target:    "/users/1",
+			Outcome:   model.AuditOutcomeSuccess,
+			Status:    200,
+		}
+		if i == 1 {
+			event.ActorID = &actorID
+			event.Outcome = model.AuditOutcomeDenied
+		}
+		must(t, s.CreateAuditEvent(event))
+		if event.ID == 0 {
+			t.Fatalf("Expected the event id to be set\n")
+		}
+	}
+
+	action, outcome, since, until, limit := "Authenticate", model.AuditOutcomeDenied, start.Add(time.Minute), start.Add(2*time.Minute), int64(1)
+	for _, test := range []struct {
+		search   model.AuditEventListingRequest
+		expected []int
+	}{
+		{model.AuditEventListingRequest{}, []int{2, 1, 0}},
+		{model.AuditEventListingRequest{Action: &action}, []int{2, 0}},
+		{model.AuditEventListingRequest{Outcome: &outcome}, []int{1}},
+		{model.AuditEventListingRequest{Since: &since}, []int{2, 1}},
+		{model.AuditEventListingRequest{Until: &until}, []int{1, 0}},
+		{model.AuditEventListingRequest{Limit: &limit}, []int{2}},
+	} {
+		events, err := s.AuditEvents(test.search)
+		must(t, err)
+		var got []int
+		for _, event := range events.Events {
+			got = append(got, int(event.CreatedAt.Sub(start)/time.Minute))
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Fatalf("Expected events %v. Got %v\n", test.expected, got)
+		}
+	}
+
+	events, err := s.AuditEvents(model.AuditEventListingRequest{Outcome: &outcome})
+	must(t, err)
+	if event := events.Events[0]; event.ActorID == nil || *event.ActorID != actorID || event.Action != "DeleteUser" || event.Status != 200 {
+		t.Fatalf("Unexpected event %+v\n", event)
+	}
+}
+
+func conformTransactions(t *testing.T, s storage.Store) {
+	alice := mustCreateUser(t, s, &model.UserCreationRequest{Username: "alice", Pseudonym: "A"})
+
+	failure := errors.New("failure")
+	err := s.WithTx(func(tx storage.Store) error {
+		mustCreateBook(t, tx, alice.ID, "Rolled back", 10, "")
+		mustCreateUser(t, tx, &model.UserCreationRequest{Username: "bob", Pseudonym: "B"})
+		if !tx.BookForUserExists(alice.ID, "Rolled back") {
+			t.Fatalf("Expected the transaction to see its own writes\n")
+		}
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("Expected the error of the transaction. Got %v\n", err)
+	}
+	if s.BookForUserExists(alice.ID, "Rolled back") || s.UserExists("bob") {
+		t.Fatalf("Expected the writes of the failed transaction to be rolled back\n")
+	}
+
+	err = s.WithTx(func(tx storage.Store) error {
+		mustCreateBook(t, tx, alice.ID, "Committed", 10, "")
+		// a nested transaction joins the outer one
+		return tx.WithTx(func(nested storage.Store) error {
+			_, err := nested.CreateBook(alice.ID, &model.BookCreationRequest{Title: "Nested"})
+			return err
+		})
+	})
+	must(t, err)
+	if !s.BookForUserExists(alice.ID, "Committed") || !s.BookForUserExists(alice.ID, "Nested") {
+		t.Fatalf("Expected the writes of the transaction to be committed\n")
+	}
+
+	err = s.WithTx(func(tx storage.Store) error {
+		mustCreateBook(t, tx, alice.ID, "Before the conflict", 10, "")
+		_, err := tx.CreateBook(alice.ID, &model.BookCreationRequest{Title: "Committed"})
+		return err
+	})
+	if !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("Expected a conflict. Got %v\n", err)
+	}
+	if s.BookForUserExists(alice.ID, "Before the conflict") {
+		t.Fatalf("Expected the writes before the conflict to be rolled back\n")
+	}
+
+	// a write outside of a running transaction waits for it and survives its rollback
+	outside := make(chan error, 1)
+	err = s.WithTx(func(tx storage.Store) error {
+		mustCreateBook(t, tx, alice.ID, "Rolled back again", 10, "")
+		go func() {
+			_, err := s.CreateBook(alice.ID, &model.BookCreationRequest{Title: "Outside"})
+			outside <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		return failure
+	})
+	if err != failure {
+		t.Fatalf("Expected the error of the transaction. Got %v\n", err)
+	}
+	must(t, <-outside)
+	if s.BookForUserExists(alice.ID, "Rolled back again") || !s.BookForUserExists(alice.ID, "Outside") {
+		t.Fatalf("Expected only the writes of the failed transaction to be rolled back\n")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bookstore/model"
+	"bookstore/tlsconfig"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %v\n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Problem creating certificate: %v\n", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Problem parsing certificate: %v\n", err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key for the common name.
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Problem generating key: %v\n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Problem creating certificate: %v\n", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Problem marshaling key: %v\n", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) clientCertificate(t *testing.T, serial int64, commonName string) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, serial, commonName, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Problem loading client certificate: %v\n", err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Problem writing %s: %v\n", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Problem touching %s: %v\n", path, err)
+	}
+}
+
+func servedSerial(t *testing.T, reloader *tlsconfig.CertReloader) int64 {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Problem getting certificate: %v\n", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Problem parsing certificate: %v\n", err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("Problem creating directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 10, "localhost", x509.ExtKeyUsageServerAuth)
+	modTime := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, certPEM, modTime)
+	writeFile(t, keyFile, keyPEM, modTime)
+
+	reloader, err := tlsconfig.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Problem loading certificate: %v\n", err)
+	}
+	if serial := servedSerial(t, reloader); serial != 10 {
+		t.Fatalf("Expected serial 10. Got %d\n", serial)
+	}
+
+	certPEM, keyPEM = ca.issue(t, 11, "localhost", x509.ExtKeyUsageServerAuth)
+	modTime = modTime.Add(time.Second)
+	writeFile(t, certFile, certPEM, modTime)
+	writeFile(t, keyFile, keyPEM, modTime)
+	if serial := servedSerial(t, reloader); serial != 11 {
+		t.Fatalf("Expected the renewed certificate with serial 11. Got %d\n", serial)
+	}
+
+	// a broken renewal keeps the previous certificate
+	writeFile(t, keyFile, []byte("broken"), modTime.Add(time.Second))
+	if serial := servedSerial(t, reloader); serial != 11 {
+		t.Fatalf("Expected the previous certificate with serial 11. Got %d\n", serial)
+	}
+
+	if _, err := tlsconfig.NewCertReloader(certFile, keyFile); err == nil {
+		t.Fatalf("Expected an error for a broken key\n")
+	}
+
+	// the broken files are not read again on every handshake, only once they change
+	certPEM, keyPEM = ca.issue(t, 12, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, modTime)
+	writeFile(t, keyFile, keyPEM, modTime.Add(time.Second))
+	if serial := servedSerial(t, reloader); serial != 11 {
+		t.Fatalf("Expected the previous certificate with serial 11. Got %d\n", serial)
+	}
+	writeFile(t, keyFile, keyPEM, modTime.Add(2*time.Second))
+	if serial := servedSerial(t, reloader); serial != 12 {
+		t.Fatalf("Expected the repaired certificate with serial 12. Got %d\n", serial)
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("Problem creating directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 2, "127.0.0.1", x509.ExtKeyUsageServerAuth)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+	writeFile(t, caFile, ca.pem, time.Now())
+
+	reloader, err := tlsconfig.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Problem loading certificate: %v\n", err)
+	}
+	config, err := tlsconfig.Config(reloader, caFile)
+	if err != nil {
+		t.Fatalf("Problem configuring TLS: %v\n", err)
+	}
+
+	apiConfig.ClientCertificates = true
+	defer func() { apiConfig.ClientCertificates = false }()
+
+	server := httptest.NewUnstartedServer(r)
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cert *tls.Certificate, token string) (*http.Response, error) {
+		// a new transport for every request, so no connection with another certificate is reused
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		client := &http.Client{Transport: transport}
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/me", nil)
+		if err != nil {
+			t.Fatalf("Problem creating request: %v\n", err)
+		}
+		request.Header.Set("Accept", contentJSON)
+		if token != "" {
+			addBearerToken(request, token)
+		}
+		return client.Do(request)
+	}
+
+	adminCert := ca.clientCertificate(t, 3, "admin")
+	response, err := get(&adminCert, "")
+	if err != nil {
+		t.Fatalf("Problem sending request: %v\n", err)
+	}
+	defer response.Body.Close()
+	checkResponseCode(t, response.StatusCode, http.StatusOK)
+
+	var me model.CurrentUser
+	if err := json.NewDecoder(response.Body).Decode(&me); err != nil {
+		t.Fatalf("Problem unmarshaling response: %v\n", err)
+	}
+	checkUser(t, admin, me.User)
+	if me.Token.Type != model.TokenTypeClientCertificate || me.Token.ID != "3" {
+		t.Fatalf("Expected client certificate 3. Got %+v\n", me.Token)
+	}
+
+	// a token takes precedence over the certificate
+	author := createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+	response, err = get(&adminCert, getUserJWT(t, author))
+	if err != nil {
+		t.Fatalf("Problem sending request: %v\n", err)
+	}
+	defer response.Body.Close()
+	checkResponseCode(t, response.StatusCode, http.StatusOK)
+	if err := json.NewDecoder(response.Body).Decode(&me); err != nil {
+		t.Fatalf("Problem unmarshaling response: %v\n", err)
+	}
+	if me.User.Username != "authoruser" {
+		t.Fatalf("Expected user authoruser. Got %s\n", me.User.Username)
+	}
+
+	unknownCert := ca.clientCertificate(t, 4, "unknown")
+	response, err = get(&unknownCert, "")
+	if err != nil {
+		t.Fatalf("Problem sending request: %v\n", err)
+	}
+	response.Body.Close()
+	checkResponseCode(t, response.StatusCode, http.StatusUnauthorized)
+
+	response, err = get(nil, "")
+	if err != nil {
+		t.Fatalf("Problem sending request: %v\n", err)
+	}
+	response.Body.Close()
+	checkResponseCode(t, response.StatusCode, http.StatusUnauthorized)
+
+	// certificates of other CAs fail the handshake
+	foreignCert := newTestCA(t).clientCertificate(t, 5, "admin")
+	if response, err := get(&foreignCert, ""); err == nil {
+		response.Body.Close()
+		t.Fatalf("Expected the handshake to fail. Got status %d\n", response.StatusCode)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"bookstore/model"
+)
+
+func createUserToken(t *testing.T, caller map[string]interface{}, user map[string]interface{}, name string, contentType string) *model.PersonalAccessToken {
+	var m model.PersonalAccessToken
+	r := NewRequest(caller, fmt.Sprintf("/users/%v/tokens", user["id"]), http.MethodPost, map[string]interface{}{"name": name}, "token", contentType, contentType)
+	response := r.makeRequest(t)
+	checkResponseCode(t, response.Code, http.StatusCreated)
+
+	r.unmarshal(t, response, &m)
+	if m.Name != name {
+		t.Fatalf("Expected name %s. Got %s\n", name, m.Name)
+	}
+	if m.Token == "" {
+		t.Fatalf("Expected token: empty string received")
+	}
+	return &m
+}
+
+func listUserTokens(t *testing.T, caller map[string]interface{}, user map[string]interface{}, contentType string) *model.PersonalAccessTokens {
+	var m model.PersonalAccessTokens
+	r := NewRequest(caller, fmt.Sprintf("/users/%v/tokens", user["id"]), http.MethodGet, nil, "token", contentType, contentType)
+	response := r.makeRequest(t)
+	checkResponseCode(t, response.Code, http.StatusOK)
+
+	r.unmarshal(t, response, &m)
+	return &m
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	resetDatabase(t)
+	createDefaultAdmin(t)
+	millerUser := createSimpleUser(t, "millerUser", "Michael Miller")
+	brownUser := createSimpleUser(t, "brownUser", "Dan Brown")
+	updateUser(t, millerUser, &brownUser, map[string]interface{}{"is_admin": false, "role": model.RoleAuthor}, contentJSON)
+
+	contentTypes := []string{contentXML, contentJSON, contentAlternateXML}
+
+	for idx, contentType := range contentTypes {
+		name := fmt.Sprintf("ci-%d", idx)
+		token := createUserToken(t, brownUser, brownUser, name, contentType)
+
+		tokens := listUserTokens(t, brownUser, brownUser, contentType)
+		if len(tokens.Tokens) != 1 || tokens.Tokens[0].Name != name || tokens.Tokens[0].Token != "" {
+			t.Fatalf("Expected only token %s without secret. Got %+v\n", name, tokens.Tokens)
+		}
+		if tokens.Tokens[0].LastUsedAt != nil {
+			t.Fatalf("Expected unused token. Got last used %v\n", tokens.Tokens[0].LastUsedAt)
+		}
+
+		listUsersWithToken(t, token.Token, http.StatusOK)
+
+		tokens = listUserTokens(t, brownUser, brownUser, contentType)
+		if tokens.Tokens[0].LastUsedAt == nil {
+			t.Fatalf("Expected last used time to be set\n")
+		}
+
+		r := NewRequest(brownUser, fmt.Sprintf("/users/%v/tokens", brownUser["id"]), http.MethodPost, map[string]interface{}{"name": name}, "token", contentType, contentType)
+		checkResponseCode(t, r.makeRequest(t).Code, http.StatusBadRequest)
+
+		r = NewRequest(brownUser, fmt.Sprintf("/users/%v/tokens", millerUser["id"]), http.MethodGet, nil, "token", contentType, contentType)
+		checkResponseCode(t, r.makeRequest(t).Code, http.StatusForbidden)
+
+		r = NewRequest(brownUser, fmt.Sprintf("/users/%v/tokens/%d", brownUser["id"], token.ID), http.MethodDelete, nil, "token", contentType, contentType)
+		checkResponseCode(t, r.makeRequest(t).Code, http.StatusNoContent)
+
+		listUsersWithToken(t, token.Token, http.StatusUnauthorized)
+	}
+
+	listUsersWithToken(t, "bspat_unknown", http.StatusUnauthorized)
+
+	// managers see and revoke the tokens of others, but can not create one to act as them
+	token := createUserToken(t, brownUser, brownUser, "ci", contentJSON)
+	r := NewRequest(millerUser, fmt.Sprintf("/users/%v/tokens", brownUser["id"]), http.MethodPost, map[string]interface{}{"name": "stolen"}, "token", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusForbidden)
+	if tokens := listUserTokens(t, millerUser, brownUser, contentJSON); len(tokens.Tokens) != 1 {
+		t.Fatalf("Expected one token. Got %+v\n", tokens.Tokens)
+	}
+	r = NewRequest(millerUser, fmt.Sprintf("/users/%v/tokens/%d", brownUser["id"], token.ID), http.MethodDelete, nil, "token", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusNoContent)
+}
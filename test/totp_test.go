@@ -0,0 +1,237 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bookstore/auth"
+	"bookstore/model"
+)
+
+func requestWithToken(t *testing.T, token, method, path string, payload map[string]interface{}, expectedCode int, m interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Problem marshaling request: %v\n", err)
+	}
+	request, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Problem creating request: %v\n", err)
+	}
+	request.Header.Set("Content-Type", contentJSON)
+	request.Header.Set("Accept", contentJSON)
+	request = addBearerToken(request, token)
+	response := executeRequest(request)
+	checkResponseCode(t, response.Code, expectedCode)
+
+	// error responses are problem details, not the object of the request
+	if m != nil && response.Code < http.StatusBadRequest {
+		if err := json.Unmarshal(response.Body.Bytes(), m); err != nil {
+			t.Fatalf("Problem unmarshaling response: %v\n", err)
+		}
+	}
+}
+
+func totpCode(t *testing.T, secret string, step int64) string {
+	code, err := auth.TOTPCode(secret, step)
+	if err != nil {
+		t.Fatalf("Problem creating TOTP code: %v\n", err)
+	}
+	return code
+}
+
+// enrolTOTP enrols the user and returns the secret, the verified time step and the recovery codes.
+func enrolTOTP(t *testing.T, user map[string]interface{}, token string) (string, int64, []string) {
+	var enrolment model.TOTPEnrolment
+	requestWithToken(t, token, http.MethodPost, fmt.Sprintf("/users/%v/totp", user["id"]), nil, http.StatusCreated, &enrolment)
+	if !strings.HasPrefix(enrolment.ProvisioningURI, "otpauth://totp/bookstore:"+user["username"].(string)+"?") {
+		t.Fatalf("Unexpected provisioning URI %s\n", enrolment.ProvisioningURI)
+	}
+	if !strings.Contains(enrolment.ProvisioningURI, "secret="+enrolment.Secret) {
+		t.Fatalf("Expected secret in provisioning URI %s\n", enrolment.ProvisioningURI)
+	}
+
+	step := auth.TOTPStep(time.Now())
+	path := fmt.Sprintf("/users/%v/totp/verify", user["id"])
+	requestWithToken(t, token, http.MethodPost, path, map[string]interface{}{"code": totpCode(t, enrolment.Secret, step-10)}, http.StatusBadRequest, nil)
+
+	var codes model.RecoveryCodes
+	requestWithToken(t, token, http.MethodPost, path, map[string]interface{}{"code": totpCode(t, enrolment.Secret, step)}, http.StatusOK, &codes)
+	if len(codes.Codes) != 10 {
+		t.Fatalf("Expected 10 recovery codes. Got %d\n", len(codes.Codes))
+	}
+
+	return enrolment.Secret, step, codes.Codes
+}
+
+func authenticateTOTP(t *testing.T, mfaToken, code string, expectedCode int) map[string]string {
+	data := url.Values{}
+	data.Set("mfa_token", mfaToken)
+	data.Set("code", code)
+
+	return postForm(t, "/authenticate/totp", data, expectedCode)
+}
+
+func mfaToken(t *testing.T, user map[string]interface{}) string {
+	m := authenticate(t, user)
+	if m["token"] != "" || m["mfa_token"] == "" {
+		t.Fatalf("Expected MFA challenge instead of token. Got %v\n", m)
+	}
+	return m["mfa_token"]
+}
+
+func TestTOTPLogin(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	user := createUserWithRole(t, admin, "secureuser", "Mary Shelley", model.RoleAuthor)
+
+	tokens := authenticate(t, user)
+
+	r := NewRequest(admin, fmt.Sprintf("/users/%v/totp", user["id"]), http.MethodPost, nil, "totp", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusForbidden)
+
+	secret, step, recoveryCodes := enrolTOTP(t, user, tokens["token"])
+
+	// a second enrolment has to be preceded by disabling TOTP
+	requestWithToken(t, tokens["token"], http.MethodPost, fmt.Sprintf("/users/%v/totp", user["id"]), nil, http.StatusBadRequest, nil)
+
+	challenge := mfaToken(t, user)
+	authenticateTOTP(t, "unknown", totpCode(t, secret, step+1), http.StatusBadRequest)
+	// the code used for the enrolment cannot be replayed
+	authenticateTOTP(t, challenge, totpCode(t, secret, step), http.StatusBadRequest)
+	if m := authenticateTOTP(t, challenge, totpCode(t, secret, step+1), http.StatusOK); m["token"] == "" {
+		t.Fatalf("Expected token: empty string received")
+	}
+	authenticateTOTP(t, challenge, recoveryCodes[1], http.StatusBadRequest)
+
+	challenge = mfaToken(t, user)
+	if m := authenticateTOTP(t, challenge, strings.ToUpper(recoveryCodes[0]), http.StatusOK); m["token"] == "" {
+		t.Fatalf("Expected token: empty string received")
+	}
+	challenge = mfaToken(t, user)
+	authenticateTOTP(t, challenge, recoveryCodes[0], http.StatusBadRequest)
+
+	r = NewRequest(admin, fmt.Sprintf("/users/%v/totp", user["id"]), http.MethodDelete, nil, "totp", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusNoContent)
+
+	if m := authenticate(t, user); m["token"] == "" {
+		t.Fatalf("Expected token: empty string received")
+	}
+}
+
+func TestDisableOwnTOTP(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	user := createUserWithRole(t, admin, "secureuser", "Mary Shelley", model.RoleAuthor)
+
+	secret, step, recoveryCodes := enrolTOTP(t, user, authenticate(t, user)["token"])
+	tokens := authenticateTOTP(t, mfaToken(t, user), totpCode(t, secret, step+1), http.StatusOK)
+	path := fmt.Sprintf("/users/%v/totp", user["id"])
+
+	// the token alone does not remove the second factor
+	requestWithToken(t, tokens["token"], http.MethodDelete, path, nil, http.StatusBadRequest, nil)
+	requestWithToken(t, tokens["token"], http.MethodDelete, path, map[string]interface{}{"code": "000000"}, http.StatusBadRequest, nil)
+	requestWithToken(t, tokens["token"], http.MethodDelete, path, map[string]interface{}{"code": recoveryCodes[0]}, http.StatusNoContent, nil)
+
+	if m := authenticate(t, user); m["token"] == "" {
+		t.Fatalf("Expected token: empty string received")
+	}
+
+	// admins confirm the removal of their own enrolment as well
+	adminTokens := authenticate(t, admin)
+	secret, step, recoveryCodes = enrolTOTP(t, admin, adminTokens["token"])
+	adminTokens = authenticateTOTP(t, mfaToken(t, admin), totpCode(t, secret, step+1), http.StatusOK)
+	requestWithToken(t, adminTokens["token"], http.MethodDelete, fmt.Sprintf("/users/%v/totp", admin["id"]), nil, http.StatusBadRequest, nil)
+	requestWithToken(t, adminTokens["token"], http.MethodDelete, fmt.Sprintf("/users/%v/totp", admin["id"]), map[string]interface{}{"code": recoveryCodes[0]}, http.StatusNoContent, nil)
+}
+
+func TestTOTPCodeLockout(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	user := createUserWithRole(t, admin, "secureuser", "Mary Shelley", model.RoleAuthor)
+
+	defaultThrottle := auth.UserThrottle
+	defer func() { auth.UserThrottle = defaultThrottle }()
+	auth.UserThrottle = auth.ThrottlePolicy{LockoutAfter: 3, LockoutDuration: time.Hour, ResetAfter: time.Hour}
+
+	secret, step, _ := enrolTOTP(t, user, authenticate(t, user)["token"])
+
+	challenge := mfaToken(t, user)
+	authenticateTOTP(t, challenge, "wrong", http.StatusBadRequest)
+	authenticateTOTP(t, challenge, "wrong", http.StatusBadRequest)
+	// the correct password does not reset the failed codes
+	challenge = mfaToken(t, user)
+	authenticateTOTP(t, challenge, "wrong", http.StatusBadRequest)
+	authenticateTOTP(t, challenge, totpCode(t, secret, step+1), http.StatusTooManyRequests)
+}
+
+func TestRequireAdminTOTP(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	author := createUserWithRole(t, admin, "authoruser", "Jules Verne", model.RoleAuthor)
+
+	r := NewRequest(author, "/settings", http.MethodPut, map[string]interface{}{"require_admin_totp": true}, "settings", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusForbidden)
+
+	var settings model.Settings
+	r = NewRequest(admin, "/settings", http.MethodPut, map[string]interface{}{"require_admin_totp": true}, "settings", contentJSON, contentJSON)
+	response := r.makeRequest(t)
+	checkResponseCode(t, response.Code, http.StatusOK)
+	r.unmarshal(t, response, &settings)
+	if !settings.RequireAdminTOTP {
+		t.Fatalf("Expected require_admin_totp to be set\n")
+	}
+
+	// only admins have to enrol
+	r = NewRequest(author, "/users", http.MethodGet, nil, "users", contentJSON, contentJSON)
+	checkResponseCode(t, r.makeRequest(t).Code, http.StatusOK)
+
+	token := authenticate(t, admin)["token"]
+	listUsersWithToken(t, token, http.StatusForbidden)
+
+	secret, step, _ := enrolTOTP(t, admin, token)
+	listUsersWithToken(t, token, http.StatusOK)
+
+	token = authenticateTOTP(t, mfaToken(t, admin), totpCode(t, secret, step+1), http.StatusOK)["token"]
+	requestWithToken(t, token, http.MethodGet, "/settings", nil, http.StatusOK, &settings)
+	if !settings.RequireAdminTOTP {
+		t.Fatalf("Expected require_admin_totp to be set\n")
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// test vector of RFC 6238 appendix B for SHA1, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if code := totpCode(t, secret, 59/auth.TOTPPeriod); code != "287082" {
+		t.Fatalf("Expected code 287082. Got %s\n", code)
+	}
+	if code := totpCode(t, secret, 1111111109/auth.TOTPPeriod); code != "081804" {
+		t.Fatalf("Expected code 081804. Got %s\n", code)
+	}
+
+	if _, ok := auth.ValidateTOTP(secret, "287082", time.Unix(59+auth.TOTPPeriod, 0)); !ok {
+		t.Fatalf("Expected code of the previous period to be accepted\n")
+	}
+	if _, ok := auth.ValidateTOTP(secret, "287082", time.Unix(59+3*auth.TOTPPeriod, 0)); ok {
+		t.Fatalf("Expected outdated code to be refused\n")
+	}
+}
@@ -41,19 +41,7 @@ func createUserWithError(t *testing.T, caller map[string]interface{}, user *map[
 	response := r.makeRequest(t)
 
 	checkResponseCode(t, response.Code, int(errorCode))
-
-	var expectedString string
-	switch contentType {
-	case contentJSON:
-		expectedString = getJSONError(errorString)
-	case contentXML, contentAlternateXML:
-		expectedString = getXMLError(errorString)
-	default:
-		expectedString = getJSONError(errorString)
-	}
-	if response.Body.String() != expectedString {
-		t.Fatalf("Error does not match. Expected %s - received %s\n", expectedString, response.Body.String())
-	}
+	checkValidationProblem(t, response, errorString)
 }
 func updateUser(t *testing.T, caller map[string]interface{}, user *map[string]interface{}, change map[string]interface{}, contentType string) {
 	var m model.User
@@ -161,7 +149,7 @@ func TestGeneralErrorCases(t *testing.T) {
 			"is_admin":  false,
 		}
 
-		createUserWithError(t, admin, &duplicateUsernameUser, contentType, http.StatusBadRequest, "user_already_exists")
+		createUserWithError(t, admin, &duplicateUsernameUser, contentType, http.StatusBadRequest, "user_already_exists:username")
 
 		emptyUsernameUser := map[string]interface{}{
 			"username":  "",
@@ -179,7 +167,7 @@ func TestGeneralErrorCases(t *testing.T) {
 			"is_admin":  false,
 		}
 
-		createUserWithError(t, admin, &duplicatePseudonymUser, contentType, http.StatusBadRequest, "user_already_exists")
+		createUserWithError(t, admin, &duplicatePseudonymUser, contentType, http.StatusBadRequest, "user_already_exists:pseudonym")
 
 		emptyPseudonymUser := map[string]interface{}{
 			"username":  "testuser344",
@@ -197,7 +185,66 @@ func TestGeneralErrorCases(t *testing.T) {
 			"is_admin":  false,
 		}
 
-		createUserWithError(t, admin, &shortPasswordUser, contentType, http.StatusBadRequest, "password_min_length")
+		createUserWithError(t, admin, &shortPasswordUser, contentType, http.StatusBadRequest, "password_min_length:password")
 	}
 
 }
+
+func TestProblemDetails(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	token := getUserJWT(t, admin)
+
+	request, _ := http.NewRequest(http.MethodGet, "/users/4711", nil)
+	request.Header.Set("Accept", contentXML)
+	response := executeRequest(addBearerToken(request, token))
+	checkResponseCode(t, response.Code, http.StatusNotFound)
+	p := decodeProblem(t, response)
+	if p.Type != "about:blank" || p.Code != "not_found" || p.Instance != "/users/4711" {
+		t.Fatalf("Expected the not_found problem of /users/4711. Got %+v\n", p)
+	}
+
+	request, _ = http.NewRequest(http.MethodGet, "/unknown", nil)
+	response = executeRequest(request)
+	checkResponseCode(t, response.Code, http.StatusNotFound)
+	if p := decodeProblem(t, response); p.Code != "not_found" || p.Instance != "/unknown" {
+		t.Fatalf("Expected the not_found problem of /unknown. Got %+v\n", p)
+	}
+}
+
+func TestEmailVisibility(t *testing.T) {
+	resetDatabase(t)
+	admin := createDefaultAdmin(t)
+	reader := createUserWithRole(t, admin, "readeruser", "Rita Reader", model.RoleReader)
+	author := createUserWithRole(t, admin, "authoruser", "Arthur Author", model.RoleAuthor)
+	setEmail(t, admin, reader, "rita@example.com")
+	setEmail(t, admin, author, "arthur@example.com")
+
+	readerToken := authenticate(t, reader)["token"]
+	var users []model.User
+	requestWithToken(t, readerToken, http.MethodGet, "/users", nil, http.StatusOK, &users)
+	if len(users) != 3 {
+		t.Fatalf("Expected 3 users. Got %d\n", len(users))
+	}
+	for _, u := range users {
+		if u.ID != reader["id"].(int64) && u.Email != "" {
+			t.Fatalf("Expected no email of user %s. Got %s\n", u.Username, u.Email)
+		}
+	}
+
+	var u model.User
+	requestWithToken(t, readerToken, http.MethodGet, fmt.Sprintf("/users/%v", author["id"]), nil, http.StatusOK, &u)
+	if u.Email != "" {
+		t.Fatalf("Expected no email of user %s. Got %s\n", u.Username, u.Email)
+	}
+	requestWithToken(t, readerToken, http.MethodGet, fmt.Sprintf("/users/%v", reader["id"]), nil, http.StatusOK, &u)
+	if u.Email != "rita@example.com" {
+		t.Fatalf("Expected the own email. Got %s\n", u.Email)
+	}
+
+	// admins manage users and see the emails
+	requestWithToken(t, authenticate(t, admin)["token"], http.MethodGet, fmt.Sprintf("/users/%v", author["id"]), nil, http.StatusOK, &u)
+	if u.Email != "arthur@example.com" {
+		t.Fatalf("Expected the email of the author. Got %s\n", u.Email)
+	}
+}
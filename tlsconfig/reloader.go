@@ -0,0 +1,121 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tlsconfig builds the TLS configuration of the server,
+// with certificates which are reloaded when the files change.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CertReloader serves a certificate and key pair from files and reloads them,
+// once one of the files was modified, e.g. after a renewal. If the new files
+// can not be loaded, the previous certificate is served further.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// NewCertReloader loads the certificate and the key. They have to be valid on start.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile}
+
+	modTimes, err := reloader.stat()
+	if err != nil {
+		return nil, err
+	}
+	reloader.modTimes = modTimes
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// GetCertificate returns the current certificate, it is meant to be used as tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.reloadIfModified()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *CertReloader) reloadIfModified() {
+	modTimes, err := c.stat()
+	if err != nil {
+		log.Errorf("[TLS] Could not check the certificate files: %v", err)
+		return
+	}
+
+	c.mu.RLock()
+	modified := modTimes != c.modTimes
+	c.mu.RUnlock()
+	if !modified {
+		return
+	}
+
+	// the modification times are stored before the load, so a failed load is not
+	// retried on every handshake, but only once the files change again
+	c.mu.Lock()
+	if modTimes == c.modTimes {
+		// another handshake loads the files already
+		c.mu.Unlock()
+		return
+	}
+	c.modTimes = modTimes
+	c.mu.Unlock()
+
+	if err := c.load(); err != nil {
+		log.Errorf("[TLS] Could not reload the certificate, keeping the previous one: %v", err)
+		return
+	}
+	log.Infof("[TLS] Reloaded the certificate from %q", c.certFile)
+}
+
+func (c *CertReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTimes, fmt.Errorf("tls: %v", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+func (c *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
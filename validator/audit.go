@@ -0,0 +1,51 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"strconv"
+
+	"bookstore/model"
+)
+
+// ValidateAuditEventListing validates the filter of the audit log.
+func ValidateAuditEventListing(r model.AuditEventListingRequest) error {
+	var errs ValidationErrors
+	if r.Actor != nil && *r.Actor == "" {
+		errs.Add("actor", "invalid_search_fields")
+	}
+	if r.Action != nil && *r.Action == "" {
+		errs.Add("action", "invalid_search_fields")
+	}
+	if r.Target != nil && *r.Target == "" {
+		errs.Add("target", "invalid_search_fields")
+	}
+	if r.Outcome != nil {
+		switch *r.Outcome {
+		case model.AuditOutcomeSuccess, model.AuditOutcomeFailure, model.AuditOutcomeDenied:
+		default:
+			errs.Add("outcome", "invalid_search_fields")
+		}
+	}
+	if r.Since != nil && r.Until != nil && !r.Since.Before(*r.Until) {
+		errs.Add("since", "invalid_search_fields")
+		errs.Add("until", "invalid_search_fields")
+	}
+	if r.Limit != nil && (*r.Limit <= 0 || *r.Limit > model.MaxAuditEventLimit) {
+		errs.Add("limit", "invalid_search_fields", "max", strconv.Itoa(model.MaxAuditEventLimit))
+	}
+
+	return errs.Err()
+}
@@ -22,71 +22,74 @@ import (
 )
 
 // ValidateBookCreation validates user creation with a password.
-func ValidateBookCreation(store *storage.Storage, userID int64, request *model.BookCreationRequest) error {
+func ValidateBookCreation(store storage.Store, userID int64, request *model.BookCreationRequest) error {
+	var errs ValidationErrors
 	if request.Title == "" {
-		return NewValidationError("book_mandatory_fields:title")
+		errs.Add("title", "book_mandatory_fields")
+	} else if store.BookForUserExists(userID, request.Title) {
+		errs.Add("title", "book_already_exists")
 	}
 
-	if store.BookForUserExists(userID, request.Title) {
-		return NewValidationError("book_already_exists")
-	}
 	if request.ImageURL != "" {
 		_, err := url.ParseRequestURI(request.ImageURL)
 		if err != nil {
-			return NewValidationError("invalid_book_fields:image_url")
+			errs.Add("image_url", "invalid_book_fields")
 		}
 	}
 
 	if request.Price < 0 {
-		return NewValidationError("invalid_book_fields:price")
+		errs.Add("price", "invalid_book_fields", "min", "0")
 	}
 
-	return nil
+	return errs.Err()
 }
 
 // ValidateBookModification validates user modifications.
-func ValidateBookModification(store *storage.Storage, userID int64, bookID int64, changes *model.BookModificationRequest) error {
+func ValidateBookModification(store storage.Store, userID int64, bookID int64, changes *model.BookModificationRequest) error {
+	var errs ValidationErrors
 	if changes.Title != nil {
 		if *changes.Title == "" {
-			return NewValidationError("book_mandatory_fields:title")
+			errs.Add("title", "book_mandatory_fields")
 		} else if store.BookWithSameTitle(userID, bookID, *changes.Title) {
-			return NewValidationError("book_already_exists")
+			errs.Add("title", "book_already_exists")
 		}
 	}
 
 	if changes.Price != nil {
 		if *changes.Price < 0 {
-			return NewValidationError("invalid_book_fields:price")
+			errs.Add("price", "invalid_book_fields", "min", "0")
 		}
 	}
 
-	return nil
+	return errs.Err()
 }
 
 func ValidateBookListing(r model.BookListingRequest) error {
+	var errs ValidationErrors
 	if r.AutorID != nil && *r.AutorID <= 0 {
-		return NewValidationError("invalid_search_fields:author-id")
+		errs.Add("author-id", "invalid_search_fields")
 	}
 	if r.Description != nil && *r.Description == "" {
-		return NewValidationError("invalid_search_fields:description")
+		errs.Add("description", "invalid_search_fields")
 	}
 	if r.Title != nil && *r.Title == "" {
-		return NewValidationError("invalid_search_fields:title")
+		errs.Add("title", "invalid_search_fields")
 	}
 
 	if r.MinPrice != nil && *r.MinPrice <= 0 {
-		return NewValidationError("invalid_search_fields:min-price")
+		errs.Add("min-price", "invalid_search_fields")
 	}
 
 	if r.MaxPrice != nil && *r.MaxPrice <= 0 {
-		return NewValidationError("invalid_search_fields:min-price")
+		errs.Add("max-price", "invalid_search_fields")
 	}
 
-	if r.MinPrice != nil && r.MaxPrice != nil {
+	if r.MinPrice != nil && r.MaxPrice != nil && !errs.Has("min-price") && !errs.Has("max-price") {
 		if *r.MinPrice > *r.MaxPrice {
-			return NewValidationError("invalid_search_fields:min-price,max-price")
+			errs.Add("min-price", "invalid_search_fields")
+			errs.Add("max-price", "invalid_search_fields")
 		}
 	}
 
-	return nil
+	return errs.Err()
 }
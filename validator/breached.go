@@ -0,0 +1,114 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedPasswords reports whether a password is known from breaches or is too common to be used.
+type BreachedPasswords interface {
+	Contains(password string) (bool, error)
+}
+
+// PasswordList is a list of plain text passwords, which is kept in memory.
+type PasswordList struct {
+	passwords map[string]bool
+}
+
+// LoadPasswordList reads a file with one password per line. Passwords are compared case-insensitively.
+func LoadPasswordList(path string) (*PasswordList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("password list: %v", err)
+	}
+	defer file.Close()
+
+	list := &PasswordList{passwords: make(map[string]bool)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			list.passwords[strings.ToLower(password)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("password list: %v", err)
+	}
+
+	return list, nil
+}
+
+func (l *PasswordList) Contains(password string) (bool, error) {
+	return l.passwords[strings.ToLower(password)], nil
+}
+
+const hashPrefixLength = 5
+
+// HashPrefixDirectory looks up passwords in a directory of hash range files, as served by
+// the k-anonymity API of Have I Been Pwned: the SHA-1 hashes are split after the first five hex
+// digits, the file named by the prefix holds one "SUFFIX:COUNT" line per hash with that prefix.
+// Only the file of the prefix is read, so the directory does not have to fit in memory.
+type HashPrefixDirectory struct {
+	dir string
+}
+
+// NewHashPrefixDirectory returns a lookup in the directory.
+func NewHashPrefixDirectory(dir string) (*HashPrefixDirectory, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("hash prefix directory: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("hash prefix directory: %s is not a directory", dir)
+	}
+
+	return &HashPrefixDirectory{dir}, nil
+}
+
+func (d *HashPrefixDirectory) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:hashPrefixLength], hash[hashPrefixLength:]
+
+	file, err := os.Open(filepath.Join(d.dir, prefix))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("hash prefix directory: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("hash prefix directory: %v", err)
+	}
+
+	return false, nil
+}
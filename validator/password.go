@@ -0,0 +1,128 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"bookstore/model"
+)
+
+// PasswordPolicy describes the rules for new passwords.
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength limits the work of the password hasher, 0 disables the limit
+	MaxLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Breached is consulted for known and common passwords, if set
+	Breached BreachedPasswords
+}
+
+// Passwords is the policy applied to new passwords.
+var Passwords = PasswordPolicy{
+	MinLength: 6,
+	MaxLength: 256,
+}
+
+// minIdentityLength is the length from which user names and pseudonyms are looked for in passwords,
+// shorter ones would refuse too many passwords by accident.
+const minIdentityLength = 3
+
+// ValidatePassword checks a new password of the user, which is set without the rest of the user.
+func ValidatePassword(user *model.User, password string) error {
+	var errs ValidationErrors
+	if err := validatePassword(&errs, password, user.Username, user.Pseudonym); err != nil {
+		return err
+	}
+	return errs.Err()
+}
+
+// validatePassword checks the password against the rules of the policy and adds
+// every failed rule with its own code to errs. It only fails, if the breached passwords can not be read.
+func validatePassword(errs *ValidationErrors, password, username, pseudonym string) error {
+	policy := Passwords
+	length := utf8.RuneCountInString(password)
+
+	if length < policy.MinLength {
+		errs.Add("password", "password_min_length", "min", strconv.Itoa(policy.MinLength))
+	}
+
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		errs.Add("password", "password_max_length", "max", strconv.Itoa(policy.MaxLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if policy.RequireLower && !lower {
+		errs.Add("password", "password_lowercase_required")
+	}
+
+	if policy.RequireUpper && !upper {
+		errs.Add("password", "password_uppercase_required")
+	}
+
+	if policy.RequireDigit && !digit {
+		errs.Add("password", "password_digit_required")
+	}
+
+	if policy.RequireSymbol && !symbol {
+		errs.Add("password", "password_symbol_required")
+	}
+
+	if containsIdentity(password, username) {
+		errs.Add("password", "password_contains_username")
+	}
+
+	if containsIdentity(password, pseudonym) {
+		errs.Add("password", "password_contains_pseudonym")
+	}
+
+	if policy.Breached != nil {
+		breached, err := policy.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			errs.Add("password", "password_breached")
+		}
+	}
+
+	return nil
+}
+
+func containsIdentity(password, identity string) bool {
+	if utf8.RuneCountInString(identity) < minIdentityLength {
+		return false
+	}
+	return strings.Contains(strings.ToLower(password), strings.ToLower(identity))
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import "bookstore/model"
+
+// ValidateScope checks that a requested scope only contains known scopes,
+// which are all part of the granted scopes, e.g. those of the token creating a new one.
+func ValidateScope(scope string, granted []string) error {
+	var errs ValidationErrors
+	validateScope(&errs, scope, granted)
+	return errs.Err()
+}
+
+func validateScope(errs *ValidationErrors, scope string, granted []string) {
+	for _, s := range model.ParseScope(scope) {
+		if !model.HasScope(model.Scopes, s) {
+			errs.Add("scope", "invalid_scope", "scope", s)
+		} else if !model.HasScope(granted, s) {
+			errs.Add("scope", "scope_exceeds_grant", "scope", s)
+		}
+	}
+}
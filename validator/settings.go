@@ -0,0 +1,31 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import "bookstore/model"
+
+// ValidateSettingsModification validates the changes to the settings.
+func ValidateSettingsModification(changes *model.SettingsModificationRequest) error {
+	var errs ValidationErrors
+	if changes.SignupApproval != nil {
+		switch *changes.SignupApproval {
+		case model.SignupApprovalAdmin, model.SignupApprovalAuto:
+		default:
+			errs.Add("signup_approval", "invalid_settings_fields")
+		}
+	}
+
+	return errs.Err()
+}
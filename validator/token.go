@@ -0,0 +1,33 @@
+// Copyright 2021 essquare GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validator
+
+import (
+	"bookstore/model"
+	"bookstore/storage"
+)
+
+func ValidatePersonalAccessTokenCreation(store storage.Store, userID int64, request *model.PersonalAccessTokenCreationRequest, granted []string) error {
+	var errs ValidationErrors
+	if request.Name == "" {
+		errs.Add("name", "token_mandatory_fields")
+	} else if store.PersonalAccessTokenExists(userID, request.Name) {
+		errs.Add("name", "token_already_exists")
+	}
+
+	validateScope(&errs, request.Scope, granted)
+
+	return errs.Err()
+}
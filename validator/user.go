@@ -15,56 +15,94 @@
 package validator
 
 import (
+	"net/mail"
+
 	"bookstore/model"
 	"bookstore/storage"
 )
 
 // ValidateUserCreationWithPassword validates user creation with a password.
-func ValidateUserCreation(store *storage.Storage, request *model.UserCreationRequest) error {
-	if request.Username == "" {
-		return NewValidationError("user_mandatory_fields:username")
-	}
+func ValidateUserCreation(store storage.Store, request *model.UserCreationRequest) error {
+	var errs ValidationErrors
+	validateUserFields(store, request, &errs)
 
-	if request.Pseudonym == "" {
-		return NewValidationError("user_mandatory_fields:pseudonym")
+	if err := validatePassword(&errs, request.Password, request.Username, request.Pseudonym); err != nil {
+		return err
 	}
 
-	if store.UserExists(request.Username) {
-		return NewValidationError("user_already_exists")
+	return errs.Err()
+}
+
+// ValidateExternalUserCreation validates the creation of a user, who logs in
+// through an identity provider and has no password.
+func ValidateExternalUserCreation(store storage.Store, request *model.UserCreationRequest) error {
+	var errs ValidationErrors
+	validateUserFields(store, request, &errs)
+	return errs.Err()
+}
+
+func validateUserFields(store storage.Store, request *model.UserCreationRequest, errs *ValidationErrors) {
+	if request.Username == "" {
+		errs.Add("username", "user_mandatory_fields")
+	} else if store.UserExists(request.Username) {
+		errs.Add("username", "user_already_exists")
 	}
 
-	if store.UserWithPseudonymExists(request.Pseudonym) {
-		return NewValidationError("user_already_exists")
+	if request.Pseudonym == "" {
+		errs.Add("pseudonym", "user_mandatory_fields")
+	} else if store.UserWithPseudonymExists(request.Pseudonym) {
+		errs.Add("pseudonym", "user_already_exists")
 	}
 
-	if err := validatePassword(request.Password); err != nil {
-		return err
+	if request.Role != "" && !store.RoleExists(request.Role) {
+		errs.Add("role", "invalid_user_fields")
 	}
 
-	return nil
+	if request.Email != "" && !validEmail(request.Email) {
+		errs.Add("email", "invalid_user_fields")
+	}
 }
 
 // ValidateUserModification validates user modifications.
-func ValidateUserModification(store *storage.Storage, userID int64, changes *model.UserModificationRequest) error {
+func ValidateUserModification(store storage.Store, userID int64, changes *model.UserModificationRequest) error {
+	var errs ValidationErrors
 	if changes.Username != nil {
 		if *changes.Username == "" {
-			return NewValidationError("user_mandatory_fields:username")
+			errs.Add("username", "user_mandatory_fields")
 		} else if store.AnotherUserExists(userID, *changes.Username) {
-			return NewValidationError("user_already_exists")
+			errs.Add("username", "user_already_exists")
 		}
 	}
 
 	if changes.Password != nil {
-		if err := validatePassword(*changes.Password); err != nil {
+		user, err := store.UserByID(userID)
+		if err != nil {
+			return err
+		}
+		username, pseudonym := user.Username, user.Pseudonym
+		if changes.Username != nil {
+			username = *changes.Username
+		}
+		if changes.Pseudonym != nil {
+			pseudonym = *changes.Pseudonym
+		}
+		if err := validatePassword(&errs, *changes.Password, username, pseudonym); err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
-func validatePassword(password string) error {
-	if len(password) < 6 {
-		return NewValidationError("password_min_length")
+	if changes.Role != nil && !store.RoleExists(*changes.Role) {
+		errs.Add("role", "invalid_user_fields")
 	}
-	return nil
+
+	if changes.Email != nil && *changes.Email != "" && !validEmail(*changes.Email) {
+		errs.Add("email", "invalid_user_fields")
+	}
+
+	return errs.Err()
+}
+
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
 }
@@ -14,22 +14,87 @@
 
 package validator
 
-import "errors"
+import "strings"
 
-// ValidationError represents a validation error.
+// ValidationError is the violation of a rule by a field of the request.
+// Params hold the arguments of the rule, e.g. the minimum length of a password.
 type ValidationError struct {
-	ErrorKey string
+	Field  string
+	Code   string
+	Params map[string]string
 }
 
-// NewValidationError initializes a validation error.
-func NewValidationError(errorKey string) error {
-	return (&ValidationError{ErrorKey: errorKey}).Error()
+// Error returns the key of the violation like "invalid_book_fields:price".
+func (v *ValidationError) Error() string {
+	if v.Field == "" {
+		return v.Code
+	}
+	return v.Code + ":" + v.Field
 }
 
-func (v *ValidationError) String() string {
-	return v.ErrorKey
+// ValidationErrors holds every violation found in a request, in the order they were found.
+type ValidationErrors []*ValidationError
+
+// Add records the violation of a rule by the field, params are given as name and value pairs.
+func (v *ValidationErrors) Add(field, code string, params ...string) {
+	e := &ValidationError{Field: field, Code: code}
+	for i := 0; i+1 < len(params); i += 2 {
+		if e.Params == nil {
+			e.Params = make(map[string]string)
+		}
+		e.Params[params[i]] = params[i+1]
+	}
+	*v = append(*v, e)
+}
+
+// Has reports whether the field violates any rule.
+func (v ValidationErrors) Has(field string) bool {
+	for _, e := range v {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns the violations as error, or nil if there are none.
+func (v ValidationErrors) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// Error returns the keys of the violations grouped by code, e.g.
+// "book_mandatory_fields:title; invalid_book_fields:image_url,price".
+func (v ValidationErrors) Error() string {
+	var codes []string
+	fields := make(map[string][]string)
+	for _, e := range v {
+		if _, ok := fields[e.Code]; !ok {
+			codes = append(codes, e.Code)
+			fields[e.Code] = nil
+		}
+		if e.Field != "" && !contains(fields[e.Code], e.Field) {
+			fields[e.Code] = append(fields[e.Code], e.Field)
+		}
+	}
+
+	keys := make([]string, len(codes))
+	for i, code := range codes {
+		keys[i] = code
+		if len(fields[code]) > 0 {
+			keys[i] += ":" + strings.Join(fields[code], ",")
+		}
+	}
+	return strings.Join(keys, "; ")
 }
 
-func (v *ValidationError) Error() error {
-	return errors.New(v.String())
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }